@@ -19,6 +19,7 @@ func init() {
 		clientReloadCmd,
 		clientUpdateCmd,
 		clientConfigCmd,
+		clientNatCmd,
 	)
 }
 
@@ -161,3 +162,18 @@ var clientConfigCmd = &cobra.Command{
 		return nil
 	},
 }
+
+var clientNatCmd = &cobra.Command{
+	Use:   "nat id",
+	Short: "detect the udp nat type of one anchorage core client by probing its nodes.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := getCmdContext(cmd)
+		bytes, err := command.CallBytes(ctx, command.CmdDetectClientNat, command.IdData[any]{Id: args[0]})
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	},
+}
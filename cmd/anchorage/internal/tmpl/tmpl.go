@@ -39,6 +39,8 @@ func makeServerTmpl() error {
 				},
 				HandshakeTimeout: 0,
 				HandleTimeout:    0,
+				Priority:         0,
+				Weight:           0,
 				Auth: &config.AuthInfo{
 					UserName: "",
 					Password: "",
@@ -52,11 +54,104 @@ func makeServerTmpl() error {
 					Crypto:           nil,
 					HandshakeTimeout: 0,
 					HandleTimeout:    0,
+					Priority:         0,
+					Weight:           0,
 					Auth:             nil,
 				},
 			},
 			SyncTimeInterval: 0,
-			LinkTimeout:      0,
+			SyncPaused:       []string{},
+			SyncBackoff: &config.SyncBackoffConfig{
+				Min:        0,
+				Max:        0,
+				Multiplier: 0,
+				Jitter:     0,
+			},
+			LinkTimeout: 0,
+			IdleTimeout: 0,
+			KeepAlive:   0,
+			ServiceOwners: []config.ServiceOwnerConfig{
+				{
+					Name:   "",
+					Owners: []string{},
+				},
+			},
+			Users: []config.UserConfig{
+				{
+					UserName: "",
+					Password: "",
+					Disable:  false,
+					ExpireAt: "",
+					Roles:    []string{},
+				},
+			},
+			UsersFile:        "",
+			DefaultRoles:     []string{},
+			DisableProxy:     false,
+			DisableRouteView: false,
+			ProxyPolicy: []config.ProxyPolicyConfig{
+				{
+					Action:  "",
+					Users:   []string{},
+					Network: []string{},
+					CIDR:    []string{},
+					Ports:   []string{},
+					Domains: []string{},
+				},
+			},
+			ProxyPolicyDefault: "",
+			ProxyUpstreams: []config.ProxyUpstreamConfig{
+				{
+					Name:    "",
+					Type:    "",
+					Address: "",
+					Auth: &config.AuthInfo{
+						UserName: "",
+						Password: "",
+					},
+				},
+			},
+			ProxyRoutes: []config.ProxyRouteConfig{
+				{
+					Chain:   []string{},
+					Users:   []string{},
+					Network: []string{},
+					CIDR:    []string{},
+					Ports:   []string{},
+					Domains: []string{},
+				},
+			},
+			RateLimit: &config.RateLimitConfig{
+				Server:   0,
+				User:     0,
+				Service:  0,
+				Link:     0,
+				Users:    map[string]int64{},
+				Services: map[string]int64{},
+			},
+			Traffic: &config.TrafficConfig{
+				File:         "",
+				SaveInterval: 0,
+				Quotas: []config.TrafficQuotaConfig{
+					{
+						Kind:    "",
+						Name:    "",
+						Daily:   0,
+						Monthly: 0,
+					},
+				},
+			},
+			Resolver: &config.ResolverConfig{
+				Upstreams: []config.ResolverUpstreamConfig{
+					{
+						Network:     "",
+						Address:     "",
+						InsecureTls: false,
+					},
+				},
+				PreferIPv4: false,
+				MaxTTL:     0,
+			},
 		},
 	}
 	return hyaml.SavePathT("server.yaml", cfg)
@@ -96,12 +191,16 @@ func makeClientTmpl() error {
 					},
 					HandshakeTimeout: 0,
 					HandleTimeout:    0,
+					Priority:         0,
+					Weight:           0,
 					Auth: &config.AuthInfo{
 						UserName: "",
 						Password: "",
 					},
 				},
 			},
+			FailBack:    0,
+			PortPredict: 0,
 		},
 	}
 	return hyaml.SavePathT("client.yaml", cfg)
@@ -110,17 +209,21 @@ func makeClientTmpl() error {
 func makeListenTmpl() error {
 	cfg := &sdk.ListenConfig{
 		Enable: false,
-		Node:   "",
+		Node:   nil,
 		Name:   "",
 		Notes:  "",
 		Auth: &config.AuthInfo{
 			UserName: "",
 			Password: "",
 		},
-		SwitchHide: false,
-		SwitchLink: false,
-		SwitchUP2P: false,
-		SwitchTP2P: false,
+		SwitchHide:  false,
+		SwitchLink:  false,
+		SwitchUP2P:  false,
+		SwitchTP2P:  false,
+		Balance:     "",
+		Weight:      0,
+		IdleTimeout: 0,
+		Grants:      []string{},
 		OutNetwork: &sdk.NetworkConfig{
 			Network: "",
 			Address: "",
@@ -144,6 +247,14 @@ func makeDialTmpl() error {
 			UserName: "",
 			Password: "",
 		},
+		Retry: &config.DialRetryConfig{
+			Attempts:   0,
+			Timeout:    0,
+			Min:        0,
+			Max:        0,
+			Multiplier: 0,
+			Errors:     nil,
+		},
 		InNetwork: &sdk.NetworkConfig{
 			Network: "",
 			Address: "",
@@ -154,6 +265,7 @@ func makeDialTmpl() error {
 		},
 		Multi:     0,
 		MultiIdle: 0,
+		UDPIdle:   0,
 		Plugin:    "",
 	}
 	return hyaml.SavePathT("dial.yaml", cfg)
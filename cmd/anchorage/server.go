@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"github.com/peakedshout/anchorage-core/cmd/anchorage/internal"
 	"github.com/peakedshout/anchorage-core/pkg/command"
+	"github.com/peakedshout/anchorage-core/pkg/config"
 	"github.com/peakedshout/anchorage-core/pkg/sdk"
+	"github.com/peakedshout/anchorage-core/pkg/server"
 	"github.com/peakedshout/go-pandorasbox/tool/hyaml"
 	"github.com/spf13/cobra"
+	"time"
 )
 
 func init() {
@@ -16,10 +19,21 @@ func init() {
 		serverDelCmd,
 		serverStartCmd,
 		serverStopCmd,
+		serverDrainCmd,
 		serverReloadCmd,
+		serverReloadUsersCmd,
+		serverPasswdCmd,
+		serverTrafficResetCmd,
 		serverUpdateCmd,
 		serverConfigCmd,
+		serverSyncAddCmd,
+		serverSyncDelCmd,
+		serverSyncPauseCmd,
+		serverSyncResumeCmd,
 	)
+	_ = serverPasswdCmd.Flags().Bool("argon2id", false, "use argon2id instead of bcrypt")
+	_ = serverDrainCmd.Flags().Duration("timeout", 30*time.Second, "max wait for the active links and proxies")
+	_ = serverReloadCmd.Flags().Duration("drain", 0, "drain the server first, max wait for the active links and proxies (0 reloads at once)")
 }
 
 var serverCmd = &cobra.Command{
@@ -90,13 +104,70 @@ var serverStopCmd = &cobra.Command{
 	},
 }
 
+var serverDrainCmd = &cobra.Command{
+	Use:   "drain id",
+	Short: "drain one anchorage core server, then stop it.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := getCmdContext(cmd)
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		return command.CallAny(ctx, command.CmdDrainServer, command.IdData[uint]{Id: args[0], Data: uint(timeout.Milliseconds())}, nil)
+	},
+}
+
 var serverReloadCmd = &cobra.Command{
 	Use:   "reload id",
 	Short: "reload one anchorage core server.",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		ctx := getCmdContext(cmd)
-		return command.CallAny(ctx, command.CmdReloadServer, command.IdData[any]{Id: args[0]}, nil)
+		drain, _ := cmd.Flags().GetDuration("drain")
+		return command.CallAny(ctx, command.CmdReloadServer, command.IdData[uint]{Id: args[0], Data: uint(drain.Milliseconds())}, nil)
+	},
+}
+
+var serverReloadUsersCmd = &cobra.Command{
+	Use:   "reload-users id",
+	Short: "reload the users of one anchorage core server without restarting it.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := getCmdContext(cmd)
+		return command.CallAny(ctx, command.CmdReloadServerUsers, command.IdData[any]{Id: args[0]}, nil)
+	},
+}
+
+var serverPasswdCmd = &cobra.Command{
+	Use:   "passwd password",
+	Short: "print the password hash used by the server users config. (bcrypt by default)",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fn := server.HashPassword
+		if argon2id, _ := cmd.Flags().GetBool("argon2id"); argon2id {
+			fn = server.HashPasswordArgon2id
+		}
+		hash, err := fn(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+		return nil
+	},
+}
+
+var serverTrafficResetCmd = &cobra.Command{
+	Use:   "traffic-reset id [ kind [ name ] ]",
+	Short: "reset the traffic counters of one anchorage core server. (kind must be user, service or node; reset all if empty)",
+	Args:  cobra.RangeArgs(1, 3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := getCmdContext(cmd)
+		data := command.IdSubData[string, string]{Id: args[0]}
+		if len(args) > 1 {
+			data.Sub = args[1]
+		}
+		if len(args) > 2 {
+			data.Data = args[2]
+		}
+		return command.CallAny(ctx, command.CmdResetServerTraffic, data, nil)
 	},
 }
 
@@ -161,3 +232,69 @@ var serverConfigCmd = &cobra.Command{
 		return nil
 	},
 }
+
+var serverSyncAddCmd = &cobra.Command{
+	Use:   "sync-add id",
+	Short: "add one sync node to one anchorage core server without reload. (requires vim, vi, nano, or emacs tool)",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := getCmdContext(cmd)
+		b, err := hyaml.MarshalWithCommentT(config.NodeConfig{
+			BaseNetwork: []config.BaseNetworkConfig{{}},
+			Auth:        &config.AuthInfo{},
+		})
+		if err != nil {
+			return err
+		}
+		tempFile, err := internal.EditTempFile(ctx, b)
+		if err != nil {
+			if errors.Is(err, internal.ErrNotFindEditor) {
+				err = ErrNotSupportCfg
+			}
+			if errors.Is(err, internal.ErrNoChanges) {
+				fmt.Println("cancel edit")
+				return nil
+			}
+			return err
+		}
+		var n config.NodeConfig
+		err = hyaml.Unmarshal(tempFile, &n)
+		if err != nil {
+			return err
+		}
+		return command.CallAny(ctx, command.CmdAddServerSync, command.IdData[*config.NodeConfig]{
+			Id:   args[0],
+			Data: &n,
+		}, nil)
+	},
+}
+
+var serverSyncDelCmd = &cobra.Command{
+	Use:   "sync-del id node",
+	Short: "del the sync nodes of the name from one anchorage core server without reload.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := getCmdContext(cmd)
+		return command.CallAny(ctx, command.CmdDelServerSync, command.IdData[string]{Id: args[0], Data: args[1]}, nil)
+	},
+}
+
+var serverSyncPauseCmd = &cobra.Command{
+	Use:   "sync-pause id node",
+	Short: "pause the sync with one node of one anchorage core server without reload.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := getCmdContext(cmd)
+		return command.CallAny(ctx, command.CmdPauseServerSync, command.IdData[string]{Id: args[0], Data: args[1]}, nil)
+	},
+}
+
+var serverSyncResumeCmd = &cobra.Command{
+	Use:   "sync-resume id node",
+	Short: "resume the sync with one node of one anchorage core server without reload.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := getCmdContext(cmd)
+		return command.CallAny(ctx, command.CmdResumeServerSync, command.IdData[string]{Id: args[0], Data: args[1]}, nil)
+	},
+}
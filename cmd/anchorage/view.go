@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
 	"github.com/peakedshout/anchorage-core/pkg/command"
 	"github.com/peakedshout/anchorage-core/pkg/sdk"
 	"github.com/spf13/cobra"
@@ -10,6 +11,16 @@ import (
 
 func init() {
 	viewCmd.AddCommand(viewServerCmd, viewClientCmd)
+	viewClientCmd.Flags().String("name", "", "route: service name (support glob pattern)")
+	viewClientCmd.Flags().String("node", "", "route: node of the service")
+	viewClientCmd.Flags().String("notes", "", "route: substring of the notes")
+	viewClientCmd.Flags().Bool("link", false, "route: only the services that can be linked")
+	viewClientCmd.Flags().Bool("up2p", false, "route: only the services that support udp p2p")
+	viewClientCmd.Flags().Bool("tp2p", false, "route: only the services that support tcp p2p")
+	viewClientCmd.Flags().String("sort", "", "route: sort by name, delay, hop or active")
+	viewClientCmd.Flags().Bool("desc", false, "route: sort in descending order")
+	viewClientCmd.Flags().Int("offset", 0, "route: skip the first units")
+	viewClientCmd.Flags().Int("limit", 0, "route: max units, 0 is no limit")
 }
 
 var viewCmd = &cobra.Command{
@@ -18,11 +29,11 @@ var viewCmd = &cobra.Command{
 	Args:  cobra.NoArgs,
 }
 
-var vsList = []string{"default", "session", "route", "link", "sync", "proxy"}
+var vsList = []string{"default", "session", "route", "link", "sync", "proxy", "traffic"}
 
 var viewServerCmd = &cobra.Command{
-	Use:   "server [ default { id } | session { id } | route { id } | link { id } | sync { id } | proxy { id } ]",
-	Short: "print anchorage core server runtime view information. ([default session route link sync proxy])",
+	Use:   "server [ default { id } | session { id } | route { id } | link { id } | sync { id } | proxy { id } | traffic { id } ]",
+	Short: "print anchorage core server runtime view information. ([default session route link sync proxy traffic])",
 	Args:  cobra.MaximumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var data any
@@ -34,7 +45,7 @@ var viewServerCmd = &cobra.Command{
 					call = command.CmdViewServerById
 					data = command.IdData[any]{Id: args[1]}
 				}
-			case vsList[1], vsList[2], vsList[3], vsList[4], vsList[5]:
+			case vsList[1], vsList[2], vsList[3], vsList[4], vsList[5], vsList[6]:
 				call += "_" + args[0]
 				if len(args) == 1 {
 					return fmt.Errorf("invaild args: num")
@@ -54,11 +65,11 @@ var viewServerCmd = &cobra.Command{
 	},
 }
 
-var vcList = []string{"default", "session", "proxyT"}
+var vcList = []string{"default", "session", "proxyT", "route"}
 
 var viewClientCmd = &cobra.Command{
-	Use:   "client [ default { id sub } | session { id } | proxyT { id } ]",
-	Short: "print anchorage core server runtime view information. ([default session proxyT])",
+	Use:   "client [ default { id sub } | session { id } | proxyT { id } | route { id } ]",
+	Short: "print anchorage core server runtime view information. ([default session proxyT route])",
 	Args:  cobra.MaximumNArgs(3),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var data any
@@ -90,6 +101,12 @@ var viewClientCmd = &cobra.Command{
 					return fmt.Errorf("invaild args: num")
 				}
 				data = command.IdData[any]{Id: args[1]}
+			case vcList[3]:
+				call += "_" + args[0]
+				if len(args) != 2 {
+					return fmt.Errorf("invaild args: num")
+				}
+				data = command.IdData[comm.ServiceRouteQuery]{Id: args[1], Data: getRouteQuery(cmd)}
 			default:
 				return fmt.Errorf("invaild arg: '%s' must be %v", args[0], vcList)
 			}
@@ -103,3 +120,18 @@ var viewClientCmd = &cobra.Command{
 		return nil
 	},
 }
+
+func getRouteQuery(cmd *cobra.Command) comm.ServiceRouteQuery {
+	var q comm.ServiceRouteQuery
+	q.Name, _ = cmd.Flags().GetString("name")
+	q.Node, _ = cmd.Flags().GetString("node")
+	q.Notes, _ = cmd.Flags().GetString("notes")
+	q.Link, _ = cmd.Flags().GetBool("link")
+	q.UP2P, _ = cmd.Flags().GetBool("up2p")
+	q.TP2P, _ = cmd.Flags().GetBool("tp2p")
+	q.Sort, _ = cmd.Flags().GetString("sort")
+	q.Desc, _ = cmd.Flags().GetBool("desc")
+	q.Offset, _ = cmd.Flags().GetInt("offset")
+	q.Limit, _ = cmd.Flags().GetInt("limit")
+	return q
+}
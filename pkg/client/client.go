@@ -4,10 +4,12 @@ import (
 	"context"
 	"github.com/peakedshout/anchorage-core/pkg/comm"
 	"github.com/peakedshout/anchorage-core/pkg/config"
+	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
 	"github.com/peakedshout/go-pandorasbox/logger"
 	"github.com/peakedshout/go-pandorasbox/tool/tmap"
 	"github.com/peakedshout/go-pandorasbox/xrpc"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -16,6 +18,8 @@ type Client struct {
 	cl       context.CancelFunc
 	launcher *launcher
 	proxy    tmap.SyncMap[any, *ProxyDialer]
+	failBack time.Duration
+	predict  int
 
 	logger logger.Logger
 }
@@ -38,11 +42,14 @@ func NewClientContext(ctx context.Context, config *config.ClientConfig) (*Client
 		return nil, err
 	}
 	c := &Client{
-		ctx:    nCtx,
-		cl:     cl,
-		logger: logger.MustLogger(ctx),
+		ctx:      nCtx,
+		cl:       cl,
+		failBack: time.Duration(config.FailBack) * time.Millisecond,
+		predict:  int(min(config.PortPredict, maxPortPredict)),
+		logger:   logger.MustLogger(ctx),
 	}
 	c.newLauncher(nm)
+	go c.launcher.natLoop(nCtx)
 	return c, nil
 }
 
@@ -55,88 +62,182 @@ func (c *Client) Serve(ctx context.Context, cfg comm.RegisterListenerInfo, fn fu
 	return c.serve(ctx, cfg, fn)
 }
 
+// ServeNodes keeps the listener registered on each of nodes at the same time, so that it is reachable through any of them.
+// comm.NodeAll is every configured node, and no node is the same as Serve.
+func (c *Client) ServeNodes(ctx context.Context, nodes []string, cfg comm.RegisterListenerInfo, fn func(conn net.Conn) error) error {
+	nodes, err := c.launcher.expandNodes(nodes)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return c.serve(ctx, cfg, fn)
+	}
+	tmpCtx, tmpCl := context.WithCancelCause(ctx)
+	defer tmpCl(context.Canceled)
+	for _, node := range nodes {
+		one := cfg
+		one.Node = node
+		go func() {
+			err := c.serve(tmpCtx, one, fn)
+			if err != nil {
+				tmpCl(err)
+			}
+		}()
+	}
+	return ctxtool.Wait(tmpCtx)
+}
+
 func (c *Client) serve(ctx context.Context, cfg comm.RegisterListenerInfo, fn func(conn net.Conn) error) error {
 	sctx := xrpc.SetClientShareStreamClass(ctx, xrpc.ClientNotShareStream)
+	var prev context.CancelFunc // the registration left behind when moving back, released once the new one holds
+	defer func() {
+		if prev != nil {
+			prev()
+		}
+	}()
 	return c.launcher.nodeCallBack(ctx, 1*time.Second, cfg.Node, func(ctx context.Context, nu *comm.NodeUnit) error {
-		c.logger.Info("client:", "start listener:", cfg.Name)
-		defer c.logger.Info("client:", "failed listener:", cfg.Name)
-		_ = nu.ReverseRpc(sctx, comm.CallRegister, cfg, map[string]xrpc.ClientReverseRpcHandler{
-			comm.CallLinkReq: func(rpcContext xrpc.ClientReverseRpcContext) (any, error) {
-				var info comm.LinkRequest
-				err := rpcContext.Bind(&info)
-				if err != nil {
-					return nil, err
+		c.logger.Info("client:", "start listener:", cfg.Name, nu.Node)
+		rctx, rcl := context.WithCancel(sctx)
+		drain := make(chan struct{})
+		var once sync.Once
+		done := make(chan struct{})
+		// the registration is kept until the draining node closes it, the links through it are not cut
+		go func() {
+			defer close(done)
+			defer rcl()
+			defer c.logger.Info("client:", "failed listener:", cfg.Name, nu.Node)
+			_ = nu.ReverseRpc(rctx, comm.CallRegister, cfg, c.listenerHandlers(ctx, nu, &cfg, fn, func() {
+				once.Do(func() { close(drain) })
+			}))
+		}()
+		hold := time.NewTimer(healthyHold)
+		defer hold.Stop()
+		var failBack <-chan time.Time
+		if c.failBack > 0 && cfg.Node == "" {
+			ticker := time.NewTicker(c.failBack)
+			defer ticker.Stop()
+			failBack = ticker.C
+		}
+		held := false
+		for {
+			select {
+			case <-done:
+				if !held {
+					c.launcher.health.report(nu, false)
 				}
-				if !cfg.Equal(&info) {
-					return nil, ErrLinkRefuse
+				return nil
+			case <-hold.C:
+				held = true
+				c.launcher.health.report(nu, true)
+				if prev != nil {
+					prev()
+					prev = nil
 				}
-				pinfo := &p2pInfo{isListener: true}
-				network := selectP2PNetwork(nu, &cfg, &info)
-				if info.ForceP2P && network == "" {
-					return nil, ErrLinkRefuse
+			case <-drain:
+				c.logger.Info("client:", "node draining, move listener:", cfg.Name, nu.Node)
+				return nil
+			case <-failBack:
+				if held && c.launcher.hasPreferred(nu) {
+					c.logger.Info("client:", "fail back listener:", cfg.Name, nu.Node)
+					if prev != nil {
+						prev()
+					}
+					prev = rcl
+					return nil
 				}
-				pinfo.network = network
+			}
+		}
+	})
+}
 
-				sCtx, err := xrpc.SetStreamAuthInfoT[uint64](xrpc.CloneSessionAuthInfo(rpcContext.Context(), ctx), comm.KeyLinkId, info.BoxId)
-				if err != nil {
-					return nil, err
+func (c *Client) listenerHandlers(ctx context.Context, nu *comm.NodeUnit, cfg *comm.RegisterListenerInfo, fn func(conn net.Conn) error, drain func()) map[string]xrpc.ClientReverseRpcHandler {
+	return map[string]xrpc.ClientReverseRpcHandler{
+		comm.CallDrain: func(_ xrpc.ClientReverseRpcContext) (any, error) {
+			c.launcher.markDrained(nu)
+			drain()
+			return nil, nil
+		},
+		comm.CallLinkReq: func(rpcContext xrpc.ClientReverseRpcContext) (any, error) {
+			var info comm.LinkRequest
+			err := rpcContext.Bind(&info)
+			if err != nil {
+				return nil, err
+			}
+			if !cfg.Equal(&info) {
+				return nil, ErrLinkRefuse
+			}
+			pinfo := &p2pInfo{isListener: true, upgrade: !info.ForceP2P, report: c.launcher.p2pReporter(nu, info.BoxId, info.BoxLId)}
+			nat := c.launcher.natType()
+			ipv6 := (info.SwitchUP2P || info.SwitchTP2P) && len(globalIPv6()) != 0
+			network := selectP2PNetwork(nu, cfg, &info, nat, ipv6)
+			if info.ForceP2P && network == "" {
+				if !p2pReachable(nat, info.Nat, ipv6, info.IPv6) {
+					return nil, ErrP2PNat.Errorf(info.Nat + " and " + nat)
 				}
-				sCtx, err = xrpc.SetStreamAuthInfoT[string](sCtx, comm.KeyLinkLId, info.BoxLId)
+				return nil, ErrLinkRefuse
+			}
+			pinfo.network = network
+
+			sCtx, err := xrpc.SetStreamAuthInfoT[uint64](xrpc.CloneSessionAuthInfo(rpcContext.Context(), ctx), comm.KeyLinkId, info.BoxId)
+			if err != nil {
+				return nil, err
+			}
+			sCtx, err = xrpc.SetStreamAuthInfoT[string](sCtx, comm.KeyLinkLId, info.BoxLId)
+			if err != nil {
+				return nil, err
+			}
+			stream, err := c.launcher.handleLink(sCtx, nu, pinfo)
+			if err != nil {
+				return nil, err
+			}
+			c.logger.Info("client:", "listener link req:", info.Link, "id", info.BoxLId)
+			go func() {
+				conn, err := c.launcher.handleConn(stream, pinfo)
 				if err != nil {
-					return nil, err
+					_ = stream.Close()
+					return
 				}
-				stream, err := c.launcher.handleLink(sCtx, nu, pinfo)
+				err = fn(conn)
 				if err != nil {
-					return nil, err
+					_ = conn.Close()
+					return
 				}
-				c.logger.Info("client:", "listener link req:", info.Link, "id", info.BoxLId)
-				go func() {
-					conn, err := c.launcher.handleConn(stream, pinfo)
-					if err != nil {
-						_ = stream.Close()
-						return
-					}
-					err = fn(conn)
-					if err != nil {
-						_ = conn.Close()
-						return
-					}
-				}()
-				return comm.LinkResponse{P2PNetwork: network}, nil
-			},
-		})
-		return nil
-	})
+			}()
+			return comm.LinkResponse{P2PNetwork: network}, nil
+		},
+	}
 }
 
 func (c *Client) Dial(ctx context.Context, cfg comm.LinkRequest) (x net.Conn, err error) {
+	cfg.Nat = c.launcher.natType()
+	cfg.IPv6 = (cfg.SwitchUP2P || cfg.SwitchTP2P) && len(globalIPv6()) != 0
 	units := c.launcher.selectNodeUnit(&cfg)
 	var recv comm.LinkResponse
 	nu, err := c.launcher.rpc(ctx, units, comm.CallLinkReq, cfg, &recv)
 	if err != nil {
-		return nil, err
+		return nil, newDialError(linkReqErrorClass(err), err)
 	}
 	if cfg.ForceP2P && recv.P2PNetwork == "" {
-		return nil, ErrLinkRefuse
+		return nil, newDialError(config.RetryErrorDenied, ErrLinkRefuse)
 	}
 
-	pinfo := &p2pInfo{isListener: false, network: recv.P2PNetwork}
+	pinfo := &p2pInfo{isListener: false, network: recv.P2PNetwork, upgrade: !cfg.ForceP2P, report: c.launcher.p2pReporter(nu, recv.BoxId, recv.BoxLId)}
 	sCtx, err := xrpc.SetStreamAuthInfoT[uint64](xrpc.CloneSessionAuthInfo(nu.Context(), ctx), comm.KeyLinkId, recv.BoxId)
 	if err != nil {
-		return nil, err
+		return nil, newDialError(config.RetryErrorStream, err)
 	}
 	sCtx, err = xrpc.SetStreamAuthInfoT[string](sCtx, comm.KeyLinkLId, recv.BoxLId)
 	if err != nil {
-		return nil, err
+		return nil, newDialError(config.RetryErrorStream, err)
 	}
 	stream, err := c.launcher.handleLink(sCtx, nu, pinfo)
 	if err != nil {
-		return nil, err
+		return nil, newDialError(config.RetryErrorStream, err)
 	}
 	conn, err := c.launcher.handleConn(stream, pinfo)
 	if err != nil {
 		_ = stream.Close()
-		return nil, err
+		return nil, newDialError(config.RetryErrorStream, err)
 	}
 	c.logger.Info("client:", "dialer link req:", cfg.Link, "id", recv.BoxLId)
 	return conn, nil
@@ -150,6 +251,21 @@ func (c *Client) Listen(ctx context.Context, cfg comm.RegisterListenerInfo) net.
 	return ln
 }
 
+// ListenNodes is Listen on each of nodes at the same time, see ServeNodes.
+func (c *Client) ListenNodes(ctx context.Context, nodes []string, cfg comm.RegisterListenerInfo) net.Listener {
+	ln := c.newListener(ctx, nil)
+	go func() {
+		err := c.ServeNodes(ln.ctx, nodes, cfg, func(conn net.Conn) error {
+			return ln.addConn(conn)
+		})
+		if err != nil && ln.ctx.Err() == nil {
+			c.logger.Warn("client:", "listener:", cfg.Name, "err:", err)
+			_ = ln.Close()
+		}
+	}()
+	return ln
+}
+
 func (c *Client) GetServiceRoute(ctx context.Context) (*comm.ServiceRouteView, error) {
 	var info comm.ServiceRouteView
 	_, err := c.launcher.rpcByNode(ctx, "", comm.CallRouteView, nil, &info)
@@ -159,6 +275,57 @@ func (c *Client) GetServiceRoute(ctx context.Context) (*comm.ServiceRouteView, e
 	return &info, nil
 }
 
+// QueryServiceRoute returns the service route units matched by query, sorted and paged on the server.
+func (c *Client) QueryServiceRoute(ctx context.Context, query comm.ServiceRouteQuery) (*comm.ServiceRouteQueryResult, error) {
+	err := query.Check()
+	if err != nil {
+		return nil, err
+	}
+	var info comm.ServiceRouteQueryResult
+	_, err = c.launcher.rpcByNode(ctx, "", comm.CallRouteQuery, query, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// WatchServiceRoute subscribes to the route events matched by query from node (empty is any node),
+// the channel is closed when ctx is done or the subscription breaks, and the caller may subscribe again.
+func (c *Client) WatchServiceRoute(ctx context.Context, node string, query comm.ServiceRouteQuery) (<-chan comm.RouteEvent, error) {
+	query.Offset, query.Limit = 0, 0
+	err := query.Check()
+	if err != nil {
+		return nil, err
+	}
+	_, stream, err := comm.NewStreamManager(c.launcher.nm).GetStream(ctx, node, comm.CallRouteEvent, query)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan comm.RouteEvent)
+	go func() {
+		defer close(ch)
+		defer stream.Close()
+		stop := context.AfterFunc(ctx, func() {
+			_ = stream.Close()
+		})
+		defer stop()
+		for {
+			var e comm.RouteEvent
+			err := stream.Recv(&e)
+			if err != nil {
+				c.logger.Debug("client:", "route event stream closed:", err)
+				return
+			}
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
 func (c *Client) Context() context.Context {
 	return c.ctx
 }
@@ -2,6 +2,8 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/peakedshout/anchorage-core/pkg/comm"
 	"github.com/peakedshout/anchorage-core/pkg/config"
@@ -9,9 +11,12 @@ import (
 	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
 	"github.com/peakedshout/go-pandorasbox/tool/uuid"
 	"github.com/peakedshout/go-pandorasbox/xnet/fasttool"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
 	"io"
 	"math/rand"
 	"net"
+	"os"
+	"slices"
 	"testing"
 	"time"
 )
@@ -397,6 +402,68 @@ func TestClient_DialP2PU(t *testing.T) {
 	}
 }
 
+func TestClient_DialP2PUIdle(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cl()
+	addr := newAddr()
+	s, err := server.NewServerContext(ctx, &config.ServerConfig{
+		NodeInfo: config.NodeConfig{
+			NodeName:    "node1",
+			BaseNetwork: []config.BaseNetworkConfig{{Network: "udp", Address: addr}},
+		},
+		IdleTimeout: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Close()
+	cfg := &config.ClientConfig{
+		Nodes: []config.NodeConfig{{
+			NodeName:    "node1",
+			BaseNetwork: []config.BaseNetworkConfig{{Network: "udp", Address: addr}},
+		}},
+	}
+	cc, err := NewClientContext(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	lc := comm.RegisterListenerInfo{
+		Name:     "tl",
+		Settings: comm.Settings{SwitchLink: true, SwitchUP2P: true},
+	}
+	go func() {
+		_ = cc.Serve(ctx, lc, func(conn net.Conn) error {
+			_, err := io.Copy(conn, conn)
+			return err
+		})
+	}()
+	time.Sleep(2 * time.Second)
+	conn, err := cc.Dial(ctx, comm.LinkRequest{Link: "tl", SwitchUP2P: true, ForceP2P: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the relay stream carries no data once the link is p2p, it must outlive the idle timeout
+	for i := 0; i < 4; i++ {
+		b := []byte(uuid.NewIdn(64))
+		_, err = conn.Write(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(b))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != string(buf) {
+			t.Fatal()
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
 func TestClient_Listen(t *testing.T) {
 	ctx, cl := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cl()
@@ -724,6 +791,53 @@ func testSyncServer(ctx context.Context, t *testing.T) ([]string, []string, func
 		[]string{scfg2.NodeInfo.BaseNetwork[0].Address, scfg2.NodeInfo.BaseNetwork[1].Address}, fn
 }
 
+// testSyncChain runs the servers node1, node2 and node3, only the neighbours sync with each other,
+// and returns the servers and their tcp addresses.
+func testSyncChain(ctx context.Context, t *testing.T) ([]*server.Server, []string, func()) {
+	names := []string{"node1", "node2", "node3"}
+	cfgs := make([]*config.ServerConfig, len(names))
+	for i, name := range names {
+		cfgs[i] = &config.ServerConfig{
+			NodeInfo: config.NodeConfig{
+				NodeName: name,
+				BaseNetwork: []config.BaseNetworkConfig{{
+					Network: "tcp",
+					Address: newAddr(),
+				}},
+			},
+			SyncTimeInterval: 500,
+		}
+	}
+	for i := range cfgs {
+		for _, j := range []int{i - 1, i + 1} {
+			if j >= 0 && j < len(cfgs) {
+				cfgs[i].SyncNodes = append(cfgs[i].SyncNodes, config.NodeConfig{
+					NodeName:    cfgs[j].NodeInfo.NodeName,
+					BaseNetwork: cfgs[j].NodeInfo.BaseNetwork,
+				})
+			}
+		}
+	}
+	var list []*server.Server
+	var addrs []string
+	fn := func() {
+		for _, one := range list {
+			_ = one.Close()
+		}
+	}
+	for _, cfg := range cfgs {
+		s, err := server.NewServerContext(ctx, cfg)
+		if err != nil {
+			fn()
+			t.Fatal(err)
+		}
+		go s.Serve()
+		list = append(list, s)
+		addrs = append(addrs, cfg.NodeInfo.BaseNetwork[0].Address)
+	}
+	return list, addrs, fn
+}
+
 func TestServerSync(t *testing.T) {
 	ctx, cl := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cl()
@@ -855,6 +969,86 @@ func TestClient_DialSync(t *testing.T) {
 	}
 }
 
+func TestClient_DialSyncChain(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cl()
+	servers, addrs, fn := testSyncChain(ctx, t)
+	defer fn()
+	newClient := func(node, addr string) *Client {
+		cc, err := NewClientContext(ctx, &config.ClientConfig{
+			Nodes: []config.NodeConfig{{
+				NodeName: node,
+				BaseNetwork: []config.BaseNetworkConfig{{
+					Network: "tcp",
+					Address: addr,
+				}},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cc
+	}
+	cc1 := newClient("node1", addrs[0])
+	defer cc1.Close()
+	cc3 := newClient("node3", addrs[2])
+	defer cc3.Close()
+	go func() {
+		_ = cc1.Serve(ctx, comm.RegisterListenerInfo{Name: "tl", Settings: comm.Settings{SwitchLink: true}}, func(conn net.Conn) error {
+			_, err := io.Copy(conn, conn)
+			return err
+		})
+	}()
+	// wait for the route to pass node2
+	for {
+		if len(servers[2].GetRouteView().ServiceView["tl"]) != 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("route not synced to node3")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	time.Sleep(1 * time.Second)
+	for _, unit := range servers[2].GetRouteView().ServiceView["tl"] {
+		if unit.Node != "node1" || unit.Hop != 2 || !slices.Equal(unit.Path, []string{"node1", "node2", "node3"}) {
+			t.Fatal("unexpected route on node3:", unit)
+		}
+	}
+	for _, unit := range servers[1].GetRouteView().ServiceView["tl"] {
+		if unit.Hop != 1 || !slices.Equal(unit.Path, []string{"node1", "node2"}) {
+			t.Fatal("unexpected route on node2:", unit)
+		}
+	}
+	// the route never loops back to its origin
+	for _, unit := range servers[0].GetRouteView().ServiceView["tl"] {
+		if unit.Hop != 0 {
+			t.Fatal("route looped back to node1:", unit)
+		}
+	}
+	conn, err := cc3.Dial(ctx, comm.LinkRequest{Link: "tl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 100; i++ {
+		b := []byte(uuid.NewIdn(1024))
+		_, err = conn.Write(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(b))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != string(buf) {
+			t.Fatal("unexpected echo")
+		}
+	}
+}
+
 func TestClient_DialP2PUSync(t *testing.T) {
 	ctx, cl := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cl()
@@ -1062,3 +1256,856 @@ func TestClient_ProxySync(t *testing.T) {
 		}
 	}
 }
+
+func TestClient_AuthUsers(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cl()
+	hash, err := server.HashPassword("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scfg := &config.ServerConfig{
+		NodeInfo: config.NodeConfig{
+			NodeName: "node1",
+			BaseNetwork: []config.BaseNetworkConfig{{
+				Network: "tcp",
+				Address: newAddr(),
+			}},
+			Auth: &config.AuthInfo{UserName: "admin", Password: "adminp"},
+		},
+		Users: []config.UserConfig{{UserName: "u1", Password: hash, Roles: []string{config.RoleView}}},
+	}
+	s, err := server.NewServerContext(ctx, scfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+	query := func(auth *config.AuthInfo, userAuth bool) error {
+		cc, err := NewClientContext(ctx, &config.ClientConfig{
+			Nodes: []config.NodeConfig{{
+				NodeName:    "node1",
+				BaseNetwork: scfg.NodeInfo.BaseNetwork,
+				Auth:        auth,
+				UserAuth:    userAuth,
+			}},
+		})
+		if err != nil {
+			return err
+		}
+		defer cc.Close()
+		_, err = cc.QueryServiceRoute(ctx, comm.ServiceRouteQuery{})
+		return err
+	}
+	// the legacy node auth still works with users
+	err = query(scfg.NodeInfo.Auth, false)
+	if err != nil {
+		t.Fatal("legacy auth failed:", err)
+	}
+	err = query(&config.AuthInfo{UserName: "u1", Password: "p1"}, true)
+	if err != nil {
+		t.Fatal("user auth failed:", err)
+	}
+	err = query(&config.AuthInfo{UserName: "u1", Password: "p2"}, true)
+	if err == nil {
+		t.Fatal("wrong password accepted")
+	}
+	// the plain password is not sent without user auth
+	err = query(&config.AuthInfo{UserName: "u1", Password: "p1"}, false)
+	if err == nil {
+		t.Fatal("user auth without the plain password")
+	}
+}
+
+func TestClient_QueryServiceRoute(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cl()
+	addr, _, sx := testServer(ctx, t)
+	defer sx()
+	cfg := &config.ClientConfig{
+		Nodes: []config.NodeConfig{{
+			NodeName: "node1",
+			BaseNetwork: []config.BaseNetworkConfig{{
+				Network: "tcp",
+				Address: addr,
+			}},
+		}},
+	}
+	cc, err := NewClientContext(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	for i, name := range []string{"web-a", "web-b", "web-c", "db"} {
+		lc := comm.RegisterListenerInfo{
+			Name:  name,
+			Notes: fmt.Sprintf("group %d", i%2),
+			Settings: comm.Settings{
+				SwitchLink: true,
+				SwitchUP2P: i != 0,
+			},
+		}
+		go func() {
+			ln := cc.Listen(ctx, lc)
+			defer ln.Close()
+			<-ctx.Done()
+		}()
+	}
+	time.Sleep(2 * time.Second)
+	res, err := cc.QueryServiceRoute(ctx, comm.ServiceRouteQuery{Name: "web-*", UP2P: true, Desc: true, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 2 || len(res.Units) != 1 || res.Units[0].Name != "web-c" {
+		t.Fatal("unexpected result:", res)
+	}
+	res, err = cc.QueryServiceRoute(ctx, comm.ServiceRouteQuery{Notes: "group 0", Offset: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 2 || len(res.Units) != 1 || res.Units[0].Name != "web-c" {
+		t.Fatal("unexpected result:", res)
+	}
+	_, err = cc.QueryServiceRoute(ctx, comm.ServiceRouteQuery{Sort: "none"})
+	if err == nil {
+		t.Fatal("invalid sort accepted")
+	}
+}
+
+func TestClient_WatchServiceRoute(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cl()
+	addr, _, sx := testServer(ctx, t)
+	defer sx()
+	cfg := &config.ClientConfig{
+		Nodes: []config.NodeConfig{{
+			NodeName: "node1",
+			BaseNetwork: []config.BaseNetworkConfig{{
+				Network: "tcp",
+				Address: addr,
+			}},
+		}},
+	}
+	cc, err := NewClientContext(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	time.Sleep(1 * time.Second)
+	ch, err := cc.WatchServiceRoute(ctx, "", comm.ServiceRouteQuery{Name: "watch-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	lctx, lcl := context.WithCancel(ctx)
+	for _, name := range []string{"other", "watch-a"} {
+		ln := cc.Listen(lctx, comm.RegisterListenerInfo{Name: name, Settings: comm.Settings{SwitchLink: true}})
+		defer ln.Close()
+	}
+	next := func() comm.RouteEvent {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				t.Fatal("event stream closed")
+			}
+			return e
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+		return comm.RouteEvent{}
+	}
+	e := next()
+	if e.Type != comm.RouteEventRegister || e.Unit == nil || e.Unit.Name != "watch-a" {
+		t.Fatal("unexpected event:", e)
+	}
+	lcl()
+	e = next()
+	if e.Type != comm.RouteEventUnregister || e.Unit == nil || e.Unit.Name != "watch-a" {
+		t.Fatal("unexpected event:", e)
+	}
+}
+
+func TestServer_SyncNodeRuntime(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cl()
+	newServer := func(name string) (*server.Server, config.NodeConfig) {
+		node := config.NodeConfig{
+			NodeName: name,
+			BaseNetwork: []config.BaseNetworkConfig{{
+				Network: "tcp",
+				Address: newAddr(),
+			}},
+		}
+		s, err := server.NewServerContext(ctx, &config.ServerConfig{NodeInfo: node, SyncTimeInterval: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve()
+		return s, node
+	}
+	s1, node1 := newServer("node1")
+	defer s1.Close()
+	s2, node2 := newServer("node2")
+	defer s2.Close()
+	cc, err := NewClientContext(ctx, &config.ClientConfig{Nodes: []config.NodeConfig{node1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	ln := cc.Listen(ctx, comm.RegisterListenerInfo{Name: "rt", Settings: comm.Settings{SwitchLink: true}})
+	defer ln.Close()
+	synced := func() bool {
+		return len(s2.GetRouteView().ServiceView["rt"]) != 0
+	}
+	wait := func(want bool) {
+		for i := 0; i < 50 && synced() != want; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if synced() != want {
+			t.Fatal("unexpected sync state, want", want)
+		}
+	}
+	err = s1.AddSyncNode(node2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(true)
+	if view := s1.GetSyncView()["node2"]; len(view) != 1 || view[0].State != server.SyncStateConnected || view[0].LastSuccess.IsZero() {
+		t.Fatal("unexpected sync view:", view)
+	}
+	err = s1.PauseSyncNode("node2", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(false)
+	if view := s1.GetSyncView()["node2"]; view[0].State != server.SyncStatePaused {
+		t.Fatal("unexpected sync view:", view)
+	}
+	err = s1.PauseSyncNode("node2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(true)
+	err = s1.DelSyncNode("node2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(false)
+	if s1.DelSyncNode("node2") == nil {
+		t.Fatal("del unknown sync node")
+	}
+}
+
+func TestServer_SyncBackoff(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cl()
+	down := config.NodeConfig{
+		NodeName:    "down",
+		BaseNetwork: []config.BaseNetworkConfig{{Network: "tcp", Address: newAddr()}},
+	}
+	s, err := server.NewServerContext(ctx, &config.ServerConfig{
+		NodeInfo: config.NodeConfig{
+			NodeName:    "node1",
+			BaseNetwork: []config.BaseNetworkConfig{{Network: "tcp", Address: newAddr()}},
+		},
+		SyncNodes:   []config.NodeConfig{down},
+		SyncBackoff: &config.SyncBackoffConfig{Min: 100, Max: 400},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+	var view []server.SyncUnitView
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		view = s.GetSyncView()["down"]
+		if len(view) == 1 && view[0].Failures >= 3 {
+			break
+		}
+	}
+	if len(view) != 1 || view[0].Failures < 3 || view[0].LastError == "" || !view[0].LastSuccess.IsZero() {
+		t.Fatal("unexpected sync view:", view)
+	}
+	if view[0].State == server.SyncStateBackoff && time.Until(view[0].NextRetry) > 500*time.Millisecond {
+		t.Fatal("retry beyond max:", view[0].NextRetry)
+	}
+}
+
+func TestServer_Drain(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cl()
+	newServer := func(name string) (*server.Server, config.NodeConfig) {
+		node := config.NodeConfig{
+			NodeName: name,
+			BaseNetwork: []config.BaseNetworkConfig{{
+				Network: "tcp",
+				Address: newAddr(),
+			}},
+		}
+		s, err := server.NewServerContext(ctx, &config.ServerConfig{NodeInfo: node})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve()
+		return s, node
+	}
+	s1, node1 := newServer("node1")
+	defer s1.Close()
+	s2, node2 := newServer("node2")
+	defer s2.Close()
+	cc, err := NewClientContext(ctx, &config.ClientConfig{Nodes: []config.NodeConfig{node1, node2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	ln := cc.Listen(ctx, comm.RegisterListenerInfo{Name: "dr", Settings: comm.Settings{SwitchLink: true}})
+	defer ln.Close()
+	registered := func(s *server.Server) bool {
+		return len(s.GetRouteView().ServiceView["dr"]) != 0
+	}
+	var from, to *server.Server
+	for i := 0; i < 50 && from == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if registered(s1) {
+			from, to = s1, s2
+		} else if registered(s2) {
+			from, to = s2, s1
+		}
+	}
+	if from == nil {
+		t.Fatal("listener not registered")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- from.Drain(3 * time.Second)
+	}()
+	for i := 0; i < 50 && !registered(to); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !registered(to) {
+		t.Fatal("listener not moved")
+	}
+	if !from.Draining() {
+		t.Fatal("not draining")
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal("drain not done")
+	}
+	if from.Context().Err() == nil {
+		t.Fatal("server not closed after drain")
+	}
+}
+
+func TestPickUnit(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	primary := &comm.NodeUnit{Node: "p", Priority: 0, Weight: 1}
+	slow := &comm.NodeUnit{Node: "s", Priority: 0, Weight: 1}
+	heavy := &comm.NodeUnit{Node: "h", Priority: 1, Weight: 9}
+	light := &comm.NodeUnit{Node: "l", Priority: 1, Weight: 1}
+	units := []*comm.NodeUnit{primary, slow, heavy, light}
+	down := map[*comm.NodeUnit]bool{}
+	healthy := func(nu *comm.NodeUnit) bool { return !down[nu] }
+	delay := func(nu *comm.NodeUnit) time.Duration {
+		if nu == slow {
+			return 100 * time.Millisecond
+		}
+		return 10 * time.Millisecond
+	}
+	for i := 0; i < 10; i++ {
+		if nu := pickUnit(r, units, healthy, delay); nu != primary {
+			t.Fatal("unexpected unit:", nu.Node)
+		}
+	}
+	down[primary] = true
+	down[slow] = true
+	count := map[*comm.NodeUnit]int{}
+	for i := 0; i < 1000; i++ {
+		count[pickUnit(r, units, healthy, delay)]++
+	}
+	if count[primary]+count[slow] != 0 || count[heavy] < 800 || count[light] == 0 {
+		t.Fatal("unexpected weight:", count[heavy], count[light])
+	}
+	down[heavy] = true
+	down[light] = true
+	if pickUnit(r, units, healthy, delay) != primary {
+		t.Fatal("all down but not the preferred")
+	}
+}
+
+func TestClient_DialRetry(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cl()
+	addr, _, sx := testServer(ctx, t)
+	defer sx()
+	cfg := &config.ClientConfig{
+		Nodes: []config.NodeConfig{{
+			NodeName: "node1",
+			BaseNetwork: []config.BaseNetworkConfig{{
+				Network: "tcp",
+				Address: addr,
+			}},
+		}},
+	}
+	cc, err := NewClientContext(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	lr := comm.LinkRequest{Link: "tl"}
+	_, err = cc.Dial(ctx, lr)
+	if DialErrorClass(err) != config.RetryErrorService {
+		t.Fatal("unexpected error class:", DialErrorClass(err), err)
+	}
+	_, err = cc.DialRetry(ctx, lr, &config.DialRetryConfig{Attempts: 3, Min: 50, Errors: []string{config.RetryErrorNode}}, func(int, error) {
+		t.Fatal("retry an error not retryable")
+	})
+	if err == nil {
+		t.Fatal("dial without listener")
+	}
+	go func() {
+		time.Sleep(1 * time.Second)
+		_ = cc.Serve(ctx, comm.RegisterListenerInfo{Name: "tl", Settings: comm.Settings{SwitchLink: true}}, func(conn net.Conn) error {
+			_, err := io.Copy(conn, conn)
+			return err
+		})
+	}()
+	retries := 0
+	conn, err := cc.DialRetry(ctx, lr, &config.DialRetryConfig{Attempts: 20, Timeout: 2000, Min: 100, Max: 300}, func(int, error) {
+		retries++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if retries == 0 {
+		t.Fatal("no retry")
+	}
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatal(err, string(buf))
+	}
+}
+
+func TestLinkReqErrorClass(t *testing.T) {
+	list := []struct {
+		err   error
+		class string
+	}{
+		{ErrLinkRefuse, config.RetryErrorDenied},
+		{ErrNilNodes, config.RetryErrorNode},
+		{context.DeadlineExceeded, config.RetryErrorNode},
+		// the messages of the errors that came over the wire
+		{errors.New(server.ErrPermissionDenied.Errorf("link").Error()), config.RetryErrorDenied},
+		{errors.New(server.ErrQuotaExceeded.Errorf("user", "u1").Error()), config.RetryErrorDenied},
+		{errors.New(server.ErrNotFoundService.Errorf("tl").Error()), config.RetryErrorService},
+		{errors.New(ErrLinkRefuse.Error()), config.RetryErrorDenied},
+		{errors.New("connection reset"), config.RetryErrorNode},
+	}
+	for _, one := range list {
+		if class := linkReqErrorClass(one.err); class != one.class {
+			t.Fatal("unexpected error class:", class, one.err)
+		}
+	}
+}
+
+func TestP2PIdentity(t *testing.T) {
+	a, err := newP2PIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newP2PIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newP2PIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(server, client *p2pIdentity, serverPeer, clientPeer string) (error, error) {
+		scfg, err := server.tlsConfig(serverPeer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ccfg, err := client.tlsConfig(clientPeer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		errCh := make(chan error, 1)
+		go func() {
+			sc, err := ln.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer sc.Close()
+			errCh <- tls.Server(sc, scfg).Handshake()
+		}()
+		cc, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		cerr := tls.Client(cc, ccfg).Handshake()
+		return <-errCh, cerr
+	}
+	serr, cerr := handshake(a, b, b.fingerprint, a.fingerprint)
+	if serr != nil || cerr != nil {
+		t.Fatal(serr, cerr)
+	}
+	// a man in the middle with its own cert
+	serr, cerr = handshake(c, b, b.fingerprint, a.fingerprint)
+	if cerr == nil {
+		t.Fatal("client accepted the wrong server")
+	}
+	serr, cerr = handshake(a, c, b.fingerprint, a.fingerprint)
+	if serr == nil {
+		t.Fatal("server accepted the wrong client")
+	}
+	_, err = a.tlsConfig("")
+	if err == nil {
+		t.Fatal("empty fingerprint")
+	}
+}
+
+func TestP2PPeerConfig(t *testing.T) {
+	a, err := newP2PIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newP2PIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var views []comm.LinkP2PView
+	pinfo := &p2pInfo{network: "udp", enable: true, upgrade: true, report: func(view comm.LinkP2PView) {
+		views = append(views, view)
+	}}
+	ok, err := pinfo.peerConfig(a, b.fingerprint)
+	if err != nil || !ok || pinfo.cfg == nil {
+		t.Fatal("p2p config failed:", ok, err)
+	}
+	// a peer of an old version sends no fingerprint, the link falls back to the relay
+	pinfo = &p2pInfo{network: "udp", enable: true, upgrade: true, report: pinfo.report}
+	ok, err = pinfo.peerConfig(a, "")
+	if err != nil || ok || pinfo.cfg != nil {
+		t.Fatal("empty fingerprint not fallen back:", ok, err)
+	}
+	if len(views) != 1 || views[0].Error == "" {
+		t.Fatal("p2p failure not reported:", views)
+	}
+	pinfo.release()
+	// forced p2p fails the link
+	pinfo = &p2pInfo{network: "udp", enable: true, upgrade: false}
+	_, err = pinfo.peerConfig(a, "")
+	if err == nil {
+		t.Fatal("empty fingerprint accepted with forced p2p")
+	}
+}
+
+func TestP2PCandidates(t *testing.T) {
+	list := gatherCandidates("127.0.0.1:5000", "1.2.3.4:6000", 2, nil)
+	if list[0] != (p2pCandidate{Type: comm.CandidateHost, Address: "127.0.0.1:5000"}) {
+		t.Fatal("unexpected first candidate:", list[0])
+	}
+	want := []p2pCandidate{
+		{Type: comm.CandidateSrflx, Address: "1.2.3.4:6000"},
+		{Type: comm.CandidatePrflx, Address: "1.2.3.4:6001"},
+		{Type: comm.CandidatePrflx, Address: "1.2.3.4:5999"},
+		{Type: comm.CandidatePrflx, Address: "1.2.3.4:6002"},
+		{Type: comm.CandidatePrflx, Address: "1.2.3.4:5998"},
+	}
+	if len(list) < len(want) || !slices.Equal(list[len(list)-len(want):], want) {
+		t.Fatal("unexpected candidates:", list)
+	}
+	remotes := remoteCandidates(&connInfo{Candidates: []p2pCandidate{{Type: comm.CandidateHost, Address: "example.com:80"}, want[0]}}, false)
+	if !slices.Equal(remotes, want[:1]) {
+		t.Fatal("unexpected remote candidates:", remotes)
+	}
+	remotes = remoteCandidates(&connInfo{PublicAddress: "1.2.3.4:6000"}, false)
+	if !slices.Equal(remotes, want[:1]) {
+		t.Fatal("unexpected remote candidates of an old peer:", remotes)
+	}
+}
+
+func TestP2PIPv6(t *testing.T) {
+	v6 := []net.IP{net.ParseIP("2001:db8::1")}
+	list := gatherCandidates("127.0.0.1:5000", "1.2.3.4:6000", 0, v6)
+	if list[0] != (p2pCandidate{Type: comm.CandidateHost, Address: "[2001:db8::1]:5000"}) {
+		t.Fatal("unexpected first candidate:", list[0])
+	}
+	if list[1] != (p2pCandidate{Type: comm.CandidateHost, Address: "127.0.0.1:5000"}) {
+		t.Fatal("unexpected second candidate:", list[1])
+	}
+	rinfo := &connInfo{Candidates: []p2pCandidate{
+		{Type: comm.CandidateHost, Address: "10.0.0.2:5000"},
+		{Type: comm.CandidateHost, Address: "[2001:db8::2]:5000"},
+		{Type: comm.CandidateSrflx, Address: "1.2.3.4:6000"},
+	}}
+	remotes := remoteCandidates(rinfo, true)
+	want := []p2pCandidate{rinfo.Candidates[1], rinfo.Candidates[0], rinfo.Candidates[2]}
+	if !slices.Equal(remotes, want) {
+		t.Fatal("unexpected remote candidates:", remotes)
+	}
+	remotes = remoteCandidates(rinfo, false)
+	if !slices.Equal(remotes, want[1:]) {
+		t.Fatal("unexpected remote candidates without ipv6:", remotes)
+	}
+	if addrFamily("[2001:db8::2]:5000") != comm.FamilyIPv6 || addrFamily("[::ffff:1.2.3.4]:6000") != comm.FamilyIPv4 || addrFamily("example.com:80") != "" {
+		t.Fatal("unexpected address family")
+	}
+	if tcpDialer6(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}, v6) != nil {
+		t.Fatal("unexpected ipv6 dialer of an ipv6 address")
+	}
+	if tcpDialer6(&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5000}, nil) != nil {
+		t.Fatal("unexpected ipv6 dialer without global ipv6")
+	}
+	if d := tcpDialer6(&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5000}, v6); d == nil || d.LocalAddr.String() != "[2001:db8::1]:5000" {
+		t.Fatal("unexpected ipv6 dialer:", d)
+	}
+	if a, b := globalIPv6(), globalIPv6(); len(a) != len(b) || len(a) != 0 && &a[0] != &b[0] {
+		t.Fatal("global ipv6 not cached")
+	}
+}
+
+func TestP2PNominate(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cl()
+	remotes := []p2pCandidate{{Address: "a"}, {Address: "b"}, {Address: "c"}}
+	ends := map[string][2]net.Conn{}
+	for _, one := range remotes[1:] {
+		c1, c2 := net.Pipe()
+		ends[one.Address] = [2]net.Conn{c1, c2}
+	}
+	check := func(side int) func(ctx context.Context, addr string) (net.Conn, error) {
+		return func(ctx context.Context, addr string) (net.Conn, error) {
+			if addr == "c" {
+				time.Sleep(50 * time.Millisecond)
+			}
+			if pair, ok := ends[addr]; ok {
+				return pair[side], nil
+			}
+			return nil, ErrP2PFailed
+		}
+	}
+	cctx, ccl := context.WithCancel(ctx)
+	defer ccl()
+	dPairs, lPairs := newP2PPairs(), newP2PPairs()
+	checkPairs(cctx, remotes, dPairs, check(0))
+	checkPairs(cctx, remotes, lPairs, check(1))
+	type result struct {
+		p       *p2pPair
+		working int
+		err     error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		p, working, err := awaitPair(ctx, lPairs)
+		ch <- result{p, working, err}
+	}()
+	p, working, err := nominatePair(ctx, dPairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.cand.Address != "b" || working != 2 {
+		t.Fatal("unexpected nominated pair:", p.cand.Address, working)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.p.cand.Address != "b" {
+		t.Fatal("unexpected awaited pair:", r.p.cand.Address)
+	}
+	ccl()
+	_, _, err = nominatePair(cctx, newP2PPairs())
+	if err == nil {
+		t.Fatal("nominate without pairs")
+	}
+}
+
+func TestNatSelectP2P(t *testing.T) {
+	pairs := []struct {
+		a, b string
+		ok   bool
+	}{
+		{comm.NatUnknown, comm.NatSymmetric, true},
+		{comm.NatFullCone, comm.NatSymmetric, true},
+		{comm.NatRestricted, comm.NatSymmetric, true},
+		{comm.NatPortRestricted, comm.NatSymmetric, false},
+		{comm.NatSymmetric, comm.NatPortRestricted, false},
+		{comm.NatSymmetric, comm.NatSymmetric, false},
+		{comm.NatPortRestricted, comm.NatPortRestricted, true},
+	}
+	for _, one := range pairs {
+		if natCompatible(one.a, one.b) != one.ok {
+			t.Fatal("unexpected compatibility:", one.a, one.b)
+		}
+	}
+	nu := &comm.NodeUnit{Addrs: []net.Addr{&net.UDPAddr{}, &net.TCPAddr{}}}
+	r := &comm.RegisterListenerInfo{Settings: comm.Settings{SwitchUP2P: true, SwitchTP2P: true}}
+	s := &comm.LinkRequest{SwitchUP2P: true, SwitchTP2P: true, Nat: comm.NatSymmetric}
+	if network := selectP2PNetwork(nu, r, s, comm.NatFullCone, false); network != "udp" {
+		t.Fatal("unexpected network:", network)
+	}
+	if network := selectP2PNetwork(nu, r, s, comm.NatPortRestricted, false); network != "tcp" {
+		t.Fatal("unexpected network:", network)
+	}
+	s.SwitchTP2P = false
+	if network := selectP2PNetwork(nu, r, s, comm.NatSymmetric, false); network != "" {
+		t.Fatal("unexpected network:", network)
+	}
+	if network := selectP2PNetwork(nu, r, s, comm.NatSymmetric, true); network != "" {
+		t.Fatal("unexpected network:", network)
+	}
+	s.IPv6 = true
+	if network := selectP2PNetwork(nu, r, s, comm.NatSymmetric, true); network != "udp" {
+		t.Fatal("unexpected network:", network)
+	}
+	if !natOpen("127.0.0.1:5000", &net.UDPAddr{Port: 5000}) || natOpen("127.0.0.1:5001", &net.UDPAddr{Port: 5000}) {
+		t.Fatal("unexpected open nat")
+	}
+}
+
+func TestClient_DialUpgradeP2PU(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cl()
+	_, addr, sx := testServer(ctx, t)
+	defer sx()
+	cfg := &config.ClientConfig{
+		Nodes: []config.NodeConfig{{
+			NodeName: "node1",
+			BaseNetwork: []config.BaseNetworkConfig{{
+				Network: "udp",
+				Address: addr,
+			}},
+		}},
+	}
+	cc, err := NewClientContext(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	lc := comm.RegisterListenerInfo{
+		Name:     "tl",
+		Settings: comm.Settings{SwitchLink: true, SwitchUP2P: true},
+	}
+	go func() {
+		_ = cc.Serve(ctx, lc, func(conn net.Conn) error {
+			_, err := io.Copy(conn, conn)
+			return err
+		})
+	}()
+	time.Sleep(2 * time.Second)
+	conn, err := cc.Dial(ctx, comm.LinkRequest{Link: "tl", SwitchUP2P: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	uc, ok := conn.(*upgradeConn)
+	if !ok {
+		t.Fatalf("unexpected conn %T", conn)
+	}
+	echo := func(count int) {
+		for i := 0; i < count; i++ {
+			b := []byte(uuid.NewIdn(4096))
+			_, err := conn.Write(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4096)
+			_, err = io.ReadFull(conn, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != string(buf) {
+				t.Fatal("unexpected echo")
+			}
+		}
+	}
+	// the link works over the relay before the p2p checks start
+	echo(100)
+	direct := func() net.Conn {
+		uc.dmux.Lock()
+		defer uc.dmux.Unlock()
+		return uc.direct
+	}
+	for direct() == nil {
+		if ctx.Err() != nil {
+			t.Fatal("no p2p upgrade")
+		}
+		echo(10)
+	}
+	echo(1000)
+	// the relay takes over when the direct path dies
+	_ = direct().Close()
+	echo(1000)
+	uc.wmux.Lock()
+	mode := uc.mode
+	uc.wmux.Unlock()
+	if mode != writeRelay {
+		t.Fatal("unexpected write mode:", mode)
+	}
+}
+
+type testBlockStream struct {
+	xrpc.Stream
+	done chan struct{}
+}
+
+func (tbs *testBlockStream) Recv(a any) error {
+	<-tbs.done
+	return io.EOF
+}
+
+func (tbs *testBlockStream) Send(a any) error {
+	return nil
+}
+
+func (tbs *testBlockStream) Close() error {
+	close(tbs.done)
+	return nil
+}
+
+func TestUpgradeConnDeadline(t *testing.T) {
+	uc := newUpgradeConn(&testBlockStream{done: make(chan struct{})}, nil, nil, func() {})
+	defer uc.Close()
+	_ = uc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := uc.Read(make([]byte, 10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("unexpected read err:", err)
+	}
+	// the writes waiting for the fallback of the direct path are woken at the deadline
+	uc.wmux.Lock()
+	uc.mode = writeWaiting
+	uc.wmux.Unlock()
+	_ = uc.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = uc.Write([]byte("hello"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("unexpected write err:", err)
+	}
+	uc.wmux.Lock()
+	uc.mode = writeRelay
+	uc.wmux.Unlock()
+	_ = uc.SetDeadline(time.Time{})
+	_, err = uc.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
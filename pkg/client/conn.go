@@ -12,8 +12,9 @@ type connInfo struct {
 	PublicNetwork string
 	PublicAddress string
 	TimeStamp     time.Time
-	Cert          []byte
-	Key           []byte
+	Fingerprint   string         // sha256 of the p2p tls cert of the sender
+	Candidates    []p2pCandidate // addresses of the p2p socket of the sender
+	Upgrade       bool           // the sender starts over the relay and moves to p2p once it works
 }
 
 func newConn(stream xrpc.Stream, laddr, raddr net.Addr, df func()) net.Conn {
@@ -34,6 +35,7 @@ type _conn struct {
 	laddr, raddr net.Addr
 	df           func()
 	closer       sync.Once
+	wmux         sync.Mutex
 }
 
 func (c *_conn) Read(b []byte) (n int, err error) {
@@ -46,7 +48,7 @@ func (c *_conn) Write(b []byte) (n int, err error) {
 		if j > len(b) {
 			j = len(b)
 		}
-		err = c.Stream.Send(b[i:j])
+		err = c.send(b[i:j])
 		if err != nil {
 			return i, err
 		}
@@ -79,8 +81,42 @@ func (c *_conn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+func (c *_conn) send(b []byte) error {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	return c.Stream.Send(b)
+}
+
+// ReadPacket skips the empty keepalive probes of the server and answers them.
 func (c *_conn) ReadPacket() ([]byte, error) {
 	var b []byte
-	err := c.Stream.Recv(&b)
-	return b, err
+	for {
+		err := c.Stream.Recv(&b)
+		if err != nil || len(b) != 0 {
+			return b, err
+		}
+		err = c.send(nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// keepAlive answers the keepalive probes on a stream that carries no data, such as the one kept by a p2p link.
+func keepAlive(stream xrpc.Stream) {
+	go func() {
+		var b []byte
+		for {
+			err := stream.Recv(&b)
+			if err != nil {
+				return
+			}
+			if len(b) == 0 {
+				err = stream.Send(nil)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
 }
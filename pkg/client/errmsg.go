@@ -7,4 +7,10 @@ var (
 	ErrNilNodes       = xerror.New("nil nodes")
 	ErrDialNodeFailed = xerror.New("dial node failed")
 	ErrLinkRefuse     = xerror.New("link refuse")
+	ErrP2PFingerprint = xerror.New("invalid p2p fingerprint: %s")
+	ErrP2PFailed      = xerror.New("no working p2p candidate pair")
+	ErrP2PFallback    = xerror.New("p2p fallback failed, offset %d is not retained")
+	ErrP2PNat         = xerror.New("link refuse, p2p impossible between nat: %s")
+	ErrNatTargets     = xerror.New("nat detection needs two udp node addresses, got %d")
+	ErrNatMap         = xerror.New("no mapped address from node: %s")
 )
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	healthyHold     = 3 * time.Second  // a registration broken sooner is a failed connect
+	failureCooldown = 5 * time.Second  // unhealthy time of each consecutive failure
+	maxCooldown     = 60 * time.Second // max unhealthy time
+)
+
+type nodeHealth struct {
+	failures int
+	lastFail time.Time
+}
+
+// healthManager scores the node units by the registrations through them, it is used to choose the node of listeners.
+type healthManager struct {
+	mux sync.Mutex
+	m   map[*comm.NodeUnit]*nodeHealth
+}
+
+func newHealthManager() *healthManager {
+	return &healthManager{m: make(map[*comm.NodeUnit]*nodeHealth)}
+}
+
+func (hm *healthManager) report(nu *comm.NodeUnit, ok bool) {
+	hm.mux.Lock()
+	defer hm.mux.Unlock()
+	h, exist := hm.m[nu]
+	if !exist {
+		h = &nodeHealth{}
+		hm.m[nu] = h
+	}
+	if ok {
+		h.failures = 0
+		return
+	}
+	h.failures++
+	h.lastFail = time.Now()
+}
+
+// healthy reports whether nu has no failure in its cooldown, a unit never tried is healthy.
+func (hm *healthManager) healthy(nu *comm.NodeUnit) bool {
+	hm.mux.Lock()
+	defer hm.mux.Unlock()
+	h, ok := hm.m[nu]
+	if !ok || h.failures == 0 {
+		return true
+	}
+	cooldown := min(time.Duration(h.failures)*failureCooldown, maxCooldown)
+	return time.Since(h.lastFail) >= cooldown
+}
+
+// unitDelay returns the least delay of the live sessions of nu, 0 is unknown.
+func unitDelay(nu *comm.NodeUnit) time.Duration {
+	var d time.Duration
+	for _, one := range nu.SessionView() {
+		if delay := one.MonitorInfo.Delay; delay > 0 && (d == 0 || delay < d) {
+			d = delay
+		}
+	}
+	return d
+}
+
+// pickUnit chooses among units: the healthy ones of the smallest priority are preferred,
+// those slower than twice the best known delay are skipped, and the rest are chosen by weight.
+func pickUnit(r *rand.Rand, units []*comm.NodeUnit, healthy func(nu *comm.NodeUnit) bool, delay func(nu *comm.NodeUnit) time.Duration) *comm.NodeUnit {
+	if len(units) == 0 {
+		return nil
+	}
+	list := make([]*comm.NodeUnit, 0, len(units))
+	for _, nu := range units {
+		if healthy(nu) {
+			list = append(list, nu)
+		}
+	}
+	if len(list) == 0 {
+		list = units
+	}
+	best := list[0].Priority
+	for _, nu := range list {
+		best = min(best, nu.Priority)
+	}
+	group := make([]*comm.NodeUnit, 0, len(list))
+	delays := make([]time.Duration, 0, len(list))
+	var fast time.Duration
+	for _, nu := range list {
+		if nu.Priority != best {
+			continue
+		}
+		d := delay(nu)
+		if d > 0 && (fast == 0 || d < fast) {
+			fast = d
+		}
+		group = append(group, nu)
+		delays = append(delays, d)
+	}
+	total := 0
+	candidates := group[:0:0]
+	for i, nu := range group {
+		if fast > 0 && delays[i] > 2*fast {
+			continue
+		}
+		candidates = append(candidates, nu)
+		total += max(nu.Weight, 1)
+	}
+	n := r.Intn(total)
+	for _, nu := range candidates {
+		n -= max(nu.Weight, 1)
+		if n < 0 {
+			return nu
+		}
+	}
+	return candidates[len(candidates)-1]
+}
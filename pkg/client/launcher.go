@@ -9,7 +9,6 @@ import (
 	"github.com/peakedshout/anchorage-core/pkg/comm"
 	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
 	"github.com/peakedshout/go-pandorasbox/control"
-	"github.com/peakedshout/go-pandorasbox/pcrypto"
 	"github.com/peakedshout/go-pandorasbox/tool/gpool"
 	"github.com/peakedshout/go-pandorasbox/tool/hjson"
 	"github.com/peakedshout/go-pandorasbox/tool/mslice"
@@ -23,7 +22,10 @@ import (
 	"math/rand"
 	"net"
 	"runtime"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,16 +35,44 @@ func (c *Client) newLauncher(nm map[string][]*comm.NodeUnit) {
 		list = append(list, units...)
 	}
 	c.launcher = &launcher{
-		c:    c,
-		nm:   nm,
-		list: list,
+		c:      c,
+		nm:     nm,
+		list:   list,
+		health: newHealthManager(),
 	}
 }
 
 type launcher struct {
-	c    *Client
-	nm   map[string][]*comm.NodeUnit
-	list []*comm.NodeUnit
+	c      *Client
+	nm     map[string][]*comm.NodeUnit
+	list   []*comm.NodeUnit
+	health *healthManager
+	nat    atomic.Pointer[comm.NatView]
+
+	dMux    sync.Mutex
+	drained map[*comm.NodeUnit]time.Time // draining node units avoided until the time
+}
+
+const drainAvoidTime = 1 * time.Minute
+
+func (l *launcher) markDrained(nu *comm.NodeUnit) {
+	l.dMux.Lock()
+	defer l.dMux.Unlock()
+	if l.drained == nil {
+		l.drained = make(map[*comm.NodeUnit]time.Time)
+	}
+	l.drained[nu] = time.Now().Add(drainAvoidTime)
+}
+
+func (l *launcher) isDrained(nu *comm.NodeUnit) bool {
+	l.dMux.Lock()
+	defer l.dMux.Unlock()
+	t, ok := l.drained[nu]
+	if ok && time.Now().After(t) {
+		delete(l.drained, nu)
+		return false
+	}
+	return ok
 }
 
 func (l *launcher) rpcByNode(ctx context.Context, node string, header string, send, recv any) (*comm.NodeUnit, error) {
@@ -137,17 +167,57 @@ func (l *launcher) selectNodeUnit(s *comm.LinkRequest) []*comm.NodeUnit {
 	return nl
 }
 
+// expandNodes checks the node names and expands comm.NodeAll to every node.
+func (l *launcher) expandNodes(nodes []string) ([]string, error) {
+	if slices.Contains(nodes, comm.NodeAll) {
+		all := make([]string, 0, len(l.nm))
+		for node := range l.nm {
+			all = append(all, node)
+		}
+		slices.Sort(all)
+		return all, nil
+	}
+	list := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if _, ok := l.nm[node]; !ok {
+			return nil, ErrNotFoundNode.Errorf(node)
+		}
+		if !slices.Contains(list, node) {
+			list = append(list, node)
+		}
+	}
+	return list, nil
+}
+
+// pickListenUnit chooses the node unit of a listener without node, the draining ones are left out if possible.
+func (l *launcher) pickListenUnit(r *rand.Rand) *comm.NodeUnit {
+	list := make([]*comm.NodeUnit, 0, len(l.list))
+	for _, nu := range l.list {
+		if !l.isDrained(nu) {
+			list = append(list, nu)
+		}
+	}
+	if len(list) == 0 {
+		list = l.list
+	}
+	return pickUnit(r, list, l.health.healthy, unitDelay)
+}
+
+// hasPreferred reports whether a healthy unit of smaller priority than nu is there to move back to.
+func (l *launcher) hasPreferred(nu *comm.NodeUnit) bool {
+	for _, one := range l.list {
+		if one.Priority < nu.Priority && l.health.healthy(one) && !l.isDrained(one) {
+			return true
+		}
+	}
+	return false
+}
+
 func (l *launcher) nodeCallBack(ctx context.Context, td time.Duration, node string, fn func(ctx context.Context, nu *comm.NodeUnit) error) error {
 	if node == "" {
 		r := rand.New(rand.NewSource(time.Now().UnixNano()))
 		return ctxtool.RunTimerFunc(ctx, td, func(ctx context.Context) error {
-			var units []*comm.NodeUnit
-			for _, one := range l.nm {
-				units = one
-				break
-			}
-			i := r.Intn(len(units))
-			return fn(ctx, units[i])
+			return fn(ctx, l.pickListenUnit(r))
 		})
 	} else {
 		units, ok := l.nm[node]
@@ -177,7 +247,7 @@ func (l *launcher) handleLink(ctx context.Context, nu *comm.NodeUnit, pinfo *p2p
 	}
 	addrs := make([]net.Addr, 0, len(nu.Addrs))
 	for _, addr := range nu.Addrs {
-		if addr.Network() == pinfo.network {
+		if xnet.GetStdBaseNetwork(addr.Network()) == pinfo.network {
 			addrs = append(addrs, addr)
 		}
 	}
@@ -201,13 +271,12 @@ func (l *launcher) handleLinkStream(ctx context.Context, nu *comm.NodeUnit) (xrp
 }
 
 func (l *launcher) handleP2PStream(ctx context.Context, nu *comm.NodeUnit, pinfo *p2pInfo, addrs []net.Addr) (xrpc.Stream, error) {
-	var x map[string]xnetutil.Dialer
+	var d xnetutil.Dialer
 	if pinfo.network == "tcp" {
 		pinfo.tr = &net.Dialer{Control: control.PortReuseControl}
-		x = map[string]xnetutil.Dialer{
-			"tcp": pinfo.tr,
-		}
+		d = pinfo.tr
 	} else {
+		// the unspecified address is dual-stack, the same socket punches both ipv4 and ipv6 candidates
 		udp, err := net.ListenUDP("udp", &net.UDPAddr{})
 		if err != nil {
 			return nil, err
@@ -219,9 +288,11 @@ func (l *launcher) handleP2PStream(ctx context.Context, nu *comm.NodeUnit, pinfo
 			}
 		}()
 		pinfo.ur = xquic.NewQuicTransportDialer(tr, nil)
-		x = map[string]xnetutil.Dialer{
-			"udp": pinfo.ur,
-		}
+		d = pinfo.ur
+	}
+	x := make(map[string]xnetutil.Dialer)
+	for _, addr := range addrs {
+		x[addr.Network()] = d // tcp4, udp6 and the like of the node config
 	}
 	dr := xmulti.NewMultiAddrDialer(xmulti.MultiAddrDialTypeGo, x)
 	conn, err := dr.MultiDialContext(ctx, addrs...)
@@ -244,8 +315,10 @@ func (l *launcher) handleP2PStream(ctx context.Context, nu *comm.NodeUnit, pinfo
 		_ = session.Close()
 		return nil, err
 	}
+	pinfo.v6 = globalIPv6()
 	if pinfo.network == "tcp" {
 		pinfo.tr.LocalAddr = conn.LocalAddr()
+		pinfo.tr6 = tcpDialer6(conn.LocalAddr(), pinfo.v6)
 	}
 	pinfo.enable = true
 	return &streamUnit{
@@ -283,24 +356,41 @@ func (l *launcher) handleConnListen(stream xrpc.Stream, pinfo *p2pInfo, publaddr
 	}
 	laddr := xnetutil.NewNetAddr(prilnk, priladdr)
 	raddr := xnetutil.NewNetAddr(rinfo.PublicNetwork, rinfo.PublicAddress)
+	remotes := remoteCandidates(&rinfo, pinfo.ipv6(priladdr))
 	rinfo.PublicNetwork = publnk
 	rinfo.PublicAddress = publaddr
-	if pinfo.enable {
-		cfg, cert, key, err := pcrypto.NewDefaultTlsConfigWithRaw()
+	rinfo.Candidates = nil
+	rinfo.Upgrade = rinfo.Upgrade && pinfo.enable && pinfo.upgrade
+	p2p := pinfo.enable
+	if p2p {
+		id, err := newP2PIdentity()
+		if err != nil {
+			return nil, err
+		}
+		p2p, err = pinfo.peerConfig(id, rinfo.Fingerprint)
 		if err != nil {
 			return nil, err
 		}
-		pinfo.cfg = cfg
-		rinfo.Cert = cert
-		rinfo.Key = key
+		if p2p {
+			rinfo.Fingerprint = id.fingerprint
+			rinfo.Candidates = gatherCandidates(priladdr, publaddr, l.c.predict, pinfo.v6)
+		}
+	}
+	if !p2p {
+		rinfo.Fingerprint = ""
+		rinfo.Upgrade = false
 	}
 	err = stream.Send(hjson.MustMarshal(rinfo))
 	if err != nil {
 		return nil, err
 	}
-	if pinfo.enable {
+	if pinfo.enable && !p2p {
+		return newConn(stream, laddr, raddr, pinfo.release), nil
+	} else if rinfo.Upgrade {
+		return l.handleConnUpgrade(stream, laddr, raddr, 1*time.Second, remotes, pinfo), nil
+	} else if pinfo.enable {
 		time.Sleep(1 * time.Second)
-		return l.handleConnP2P(stream, raddr.String(), pinfo)
+		return l.handleConnP2P(stream, remotes, pinfo)
 	} else {
 		return newConn(stream, laddr, raddr, func() {}), nil
 	}
@@ -312,6 +402,17 @@ func (l *launcher) handleConnDial(stream xrpc.Stream, pinfo *p2pInfo, publaddr,
 		PublicAddress: publaddr,
 		TimeStamp:     time.Now(),
 	}
+	var id *p2pIdentity
+	if pinfo.enable {
+		var err error
+		id, err = newP2PIdentity()
+		if err != nil {
+			return nil, err
+		}
+		rinfo.Fingerprint = id.fingerprint
+		rinfo.Candidates = gatherCandidates(priladdr, publaddr, l.c.predict, pinfo.v6)
+		rinfo.Upgrade = pinfo.upgrade
+	}
 	err := stream.Send(hjson.MustMarshal(rinfo))
 	if err != nil {
 		return nil, err
@@ -321,6 +422,9 @@ func (l *launcher) handleConnDial(stream xrpc.Stream, pinfo *p2pInfo, publaddr,
 	if err != nil {
 		return nil, err
 	}
+	rinfo.Fingerprint = "" // never trust our own fingerprint if the listener does not send one
+	rinfo.Candidates = nil
+	rinfo.Upgrade = false
 	err = json.Unmarshal(b, &rinfo)
 	if err != nil {
 		return nil, err
@@ -328,106 +432,173 @@ func (l *launcher) handleConnDial(stream xrpc.Stream, pinfo *p2pInfo, publaddr,
 	laddr := xnetutil.NewNetAddr(prilnk, priladdr)
 	raddr := xnetutil.NewNetAddr(rinfo.PublicNetwork, rinfo.PublicAddress)
 	if pinfo.enable {
-		cfg, err := pcrypto.MakeTlsConfig(rinfo.Cert, rinfo.Key)
+		p2p, err := pinfo.peerConfig(id, rinfo.Fingerprint)
 		if err != nil {
 			return nil, err
 		}
-		pinfo.cfg = cfg
+		if !p2p {
+			return newConn(stream, laddr, raddr, pinfo.release), nil
+		}
 		duration := 1*time.Second - (time.Now().Sub(rinfo.TimeStamp) / 2)
+		remotes := remoteCandidates(&rinfo, pinfo.ipv6(priladdr))
+		if rinfo.Upgrade {
+			return l.handleConnUpgrade(stream, laddr, raddr, duration, remotes, pinfo), nil
+		}
 		if duration > 0 {
 			time.Sleep(duration)
 		}
-		return l.handleConnP2P(stream, raddr.String(), pinfo)
+		return l.handleConnP2P(stream, remotes, pinfo)
 	} else {
 		// turn
 		return newConn(stream, laddr, raddr, func() {}), nil
 	}
 }
 
-func (l *launcher) handleConnP2P(stream xrpc.Stream, addr string, pinfo *p2pInfo) (conn net.Conn, err error) {
-	ctx := stream.Context()
-	defer func() {
-		if conn != nil {
-			ctxtool.GWaitFunc(ctx, func() {
-				_ = conn.Close()
-			})
+func (l *launcher) handleConnP2P(stream xrpc.Stream, remotes []p2pCandidate, pinfo *p2pInfo) (net.Conn, error) {
+	p, err := l.checkP2P(stream.Context(), remotes, pinfo)
+	closeFn := func() {
+		_ = stream.Close()
+	}
+	if pinfo.network != "tcp" {
+		if err != nil {
+			_ = pinfo.ur.Close()
+			return nil, err
 		}
-	}()
-	if pinfo.network == "tcp" {
-		for i := 0; i < 3; i++ {
-			conn, err = pinfo.tr.DialContext(ctx, pinfo.network, addr)
-			if err != nil {
-				time.Sleep(100 * time.Millisecond)
-			}
+		closeFn = func() {
+			_ = stream.Close()
+			_ = pinfo.ur.Close()
 		}
-		if conn == nil {
-			return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	conn := &p2pConn{Conn: p.conn, closeFn: closeFn}
+	ctxtool.GWaitFunc(stream.Context(), func() {
+		_ = conn.Close()
+	})
+	keepAlive(stream)
+	return conn, nil
+}
+
+// handleConnUpgrade returns the link over the relay at once, and moves it to the p2p pair once the checks started
+// after wait find one.
+func (l *launcher) handleConnUpgrade(stream xrpc.Stream, laddr, raddr net.Addr, wait time.Duration, remotes []p2pCandidate, pinfo *p2pInfo) net.Conn {
+	uc := newUpgradeConn(stream, laddr, raddr, pinfo.release)
+	go func() {
+		ctx := stream.Context()
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
 		}
-		u := xtls.TLSUpgrader(pinfo.cfg, !pinfo.isListener)
-		conn, err = u.UpgradeContext(ctx, conn)
+		p, err := l.checkP2P(ctx, remotes, pinfo)
 		if err != nil {
-			_ = conn.Close()
-			return nil, err
+			l.c.logger.Debug("client:", "p2p upgrade err:", err)
+			return
 		}
-		conn = &p2pConn{
-			Conn: conn,
-			closeFn: func() {
-				_ = stream.Close()
-			},
+		if uc.upgrade(p.conn) {
+			l.c.logger.Info("client:", "p2p upgrade to", p.cand.Address)
 		}
-		return conn, nil
+	}()
+	return uc
+}
+
+// checkP2P runs the connectivity checks of the remote candidates and returns the selected pair.
+func (l *launcher) checkP2P(ctx context.Context, remotes []p2pCandidate, pinfo *p2pInfo) (p *p2pPair, err error) {
+	timeout := p2pCheckTimeout
+	if pinfo.isListener {
+		timeout += p2pNominateWait + 1*time.Second // the nomination of the dialer may come at the end of its checks
+	}
+	cctx, cl := context.WithTimeout(ctx, timeout)
+	defer cl()
+	pairs := newP2PPairs()
+	if pinfo.network == "tcp" {
+		u := xtls.TLSUpgrader(pinfo.cfg, !pinfo.isListener)
+		checkPairs(cctx, remotes, pairs, func(ctx context.Context, addr string) (net.Conn, error) {
+			dr := pinfo.tr
+			if pinfo.tr6 != nil && addrFamily(addr) == comm.FamilyIPv6 {
+				dr = pinfo.tr6
+			}
+			conn, err := dr.DialContext(ctx, pinfo.network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tconn, err := u.UpgradeContext(ctx, conn)
+			if err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			return tconn, nil
+		})
 	} else {
+		tmpDr := xquic.NewQuicTransportDialer(pinfo.ur.Transport(), pinfo.cfg)
 		if pinfo.isListener {
 			tmpLn := xquic.NewQuicListenConfigWithTransport(pinfo.ur.Transport(), pinfo.cfg)
-			ctxx, cl := context.WithCancel(ctx)
-			defer cl()
-			ln, err := tmpLn.ListenContext(ctxx, "", "")
+			ln, err := tmpLn.ListenContext(cctx, "", "")
 			if err != nil {
-				_ = pinfo.ur.Close()
 				return nil, err
 			}
 			defer ln.Close()
-			go func() {
-				defer cl()
-				tmpDr := xquic.NewQuicTransportDialer(pinfo.ur.Transport(), pinfo.cfg)
-				for i := 0; i < 3; i++ {
-					xconn, _ := tmpDr.DialContext(ctxx, pinfo.network, addr)
-					if xconn != nil {
-						_ = xconn.Close()
-						return
-					}
-					time.Sleep(100 * time.Millisecond)
+			go acceptPairs(ln, remotes, pairs)
+			// the dials only punch the nat for the dialer, the dialer is not listening
+			checkPairs(cctx, remotes, pairs, func(ctx context.Context, addr string) (net.Conn, error) {
+				xconn, err := tmpDr.DialContext(ctx, pinfo.network, addr)
+				if err == nil {
+					_ = xconn.Close()
 				}
-			}()
-			accept, err := ln.Accept()
-			if err != nil {
-				_ = pinfo.ur.Close()
-				return nil, err
-			}
-			conn = accept
+				return nil, ErrP2PFailed
+			})
 		} else {
-			tmpDr := xquic.NewQuicTransportDialer(pinfo.ur.Transport(), pinfo.cfg)
-			for i := 0; i < 3; i++ {
-				conn, err = tmpDr.DialContext(ctx, pinfo.network, addr)
-				if err != nil {
-					time.Sleep(100 * time.Millisecond)
-				} else {
-					break
-				}
-			}
-			if conn == nil {
-				_ = pinfo.ur.Close()
-				return nil, err
+			checkPairs(cctx, remotes, pairs, func(ctx context.Context, addr string) (net.Conn, error) {
+				return tmpDr.DialContext(ctx, pinfo.network, addr)
+			})
+		}
+	}
+	var working int
+	if pinfo.isListener {
+		p, working, err = awaitPair(cctx, pairs)
+	} else {
+		p, working, err = nominatePair(cctx, pairs)
+	}
+	if pinfo.report != nil {
+		pinfo.report(p2pView(pinfo.network, remotes, working, p, err))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// p2pReporter returns the report function of the p2p result of a link side, the nodes of old versions just refuse it.
+func (l *launcher) p2pReporter(nu *comm.NodeUnit, boxId uint64, boxLId string) func(view comm.LinkP2PView) {
+	return func(view comm.LinkP2PView) {
+		go func() {
+			ctx, cl := context.WithTimeout(nu.Context(), 5*time.Second)
+			defer cl()
+			_, err := l.rpc(ctx, []*comm.NodeUnit{nu}, comm.CallLinkP2P, comm.LinkP2PReport{BoxId: boxId, BoxLId: boxLId, View: view}, nil)
+			if err != nil {
+				l.c.logger.Warn("client:", "p2p report id", boxLId, "err:", err)
 			}
+		}()
+	}
+}
+
+// acceptPairs adds the quic connections of the dialer, the address not in remotes is a peer reflexive candidate.
+func acceptPairs(ln net.Listener, remotes []p2pCandidate, pairs *p2pPairs) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
 		}
-		conn = &p2pConn{
-			Conn: conn,
-			closeFn: func() {
-				_ = stream.Close()
-				_ = pinfo.ur.Close()
-			},
+		p := &p2pPair{index: len(remotes), cand: p2pCandidate{Type: comm.CandidatePrflx, Address: conn.RemoteAddr().String()}, conn: conn}
+		for i, one := range remotes {
+			if one.Address == p.cand.Address {
+				p.index, p.cand = i, one
+				break
+			}
 		}
-		return conn, nil
+		pairs.add(p)
 	}
 }
 
@@ -457,15 +628,61 @@ type p2pInfo struct {
 	network    string
 	isListener bool
 	enable     bool
+	upgrade    bool // start over the relay and move to p2p in the background, see upgradeConn
 	tr         *net.Dialer
+	tr6        *net.Dialer // dialer of the ipv6 candidates if tr is bound to ipv4, nil without global ipv6
+	v6         []net.IP    // global ipv6 addresses of the host
 	ur         *xquic.QuicTransportDialer
 	cfg        *tls.Config
+	report     func(view comm.LinkP2PView) // p2p result to the node of the link
+}
+
+// ipv6 reports whether the ipv6 candidates of the peer may be reached from the local p2p socket.
+func (pi *p2pInfo) ipv6(priAddr string) bool {
+	return len(pi.v6) != 0 || addrFamily(priAddr) == comm.FamilyIPv6
+}
+
+// peerConfig sets the tls config of the p2p checks that only accepts the peer of fingerprint. A peer of an old version
+// sends no fingerprint, then the p2p is reported failed and false is returned to keep the link on the relay, unless
+// p2p is forced.
+func (pi *p2pInfo) peerConfig(id *p2pIdentity, fingerprint string) (bool, error) {
+	cfg, err := id.tlsConfig(fingerprint)
+	if err != nil {
+		if !pi.upgrade {
+			return false, err
+		}
+		if pi.report != nil {
+			pi.report(comm.LinkP2PView{Network: pi.network, Error: err.Error()})
+		}
+		return false, nil
+	}
+	pi.cfg = cfg
+	return true, nil
+}
+
+// release closes the udp socket of the p2p checks once the link over the relay is closed.
+func (pi *p2pInfo) release() {
+	if pi.network != "tcp" && pi.ur != nil {
+		_ = pi.ur.Close()
+	}
+}
+
+// tcpDialer6 returns the dialer of the ipv6 candidates on the port of the ipv4 laddr, nil if laddr is not ipv4 or there is no global ipv6 v6.
+func tcpDialer6(laddr net.Addr, v6 []net.IP) *net.Dialer {
+	if addrFamily(laddr.String()) != comm.FamilyIPv4 || len(v6) == 0 {
+		return nil
+	}
+	_, port, _ := net.SplitHostPort(laddr.String())
+	p, _ := strconv.Atoi(port)
+	return &net.Dialer{Control: control.PortReuseControl, LocalAddr: &net.TCPAddr{IP: v6[0], Port: p}}
 }
 
-func selectP2PNetwork(nu *comm.NodeUnit, r *comm.RegisterListenerInfo, s *comm.LinkRequest) string {
+// selectP2PNetwork chooses the p2p network of a link, udp is skipped if the nat types of both sides can not punch through
+// and not both sides have global ipv6.
+func selectP2PNetwork(nu *comm.NodeUnit, r *comm.RegisterListenerInfo, s *comm.LinkRequest, nat string, ipv6 bool) string {
 	u, t := false, false
 	for _, addr := range nu.Addrs {
-		switch addr.Network() {
+		switch xnet.GetStdBaseNetwork(addr.Network()) {
 		case "tcp":
 			t = true
 		case "udp":
@@ -473,7 +690,7 @@ func selectP2PNetwork(nu *comm.NodeUnit, r *comm.RegisterListenerInfo, s *comm.L
 		}
 	}
 	t = t && s.SwitchTP2P && r.Settings.SwitchTP2P
-	u = u && s.SwitchUP2P && r.Settings.SwitchUP2P
+	u = u && s.SwitchUP2P && r.Settings.SwitchUP2P && p2pReachable(nat, s.Nat, ipv6, s.IPv6)
 	if !t && !u {
 		return ""
 	}
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/go-pandorasbox/xnet"
+	"github.com/peakedshout/go-pandorasbox/xnet/xmulti"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"github.com/peakedshout/go-pandorasbox/xnet/xquic"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"github.com/quic-go/quic-go"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	natDetectInterval = 10 * time.Minute
+	natDetectTimeout  = 15 * time.Second
+	natProbeWait      = 1 * time.Second // wait for the token after the node has sent it
+	natTokenSize      = 16
+)
+
+// natTarget is a udp address of a node to probe.
+type natTarget struct {
+	nu   *comm.NodeUnit
+	addr net.Addr
+	ip   string
+}
+
+// natTargets returns the distinct udp node addresses.
+func (l *launcher) natTargets() []natTarget {
+	var list []natTarget
+	seen := make(map[string]bool)
+	for _, nu := range l.list {
+		for _, addr := range nu.Addrs {
+			if xnet.GetStdBaseNetwork(addr.Network()) != "udp" || seen[addr.String()] {
+				continue
+			}
+			seen[addr.String()] = true
+			ua, err := net.ResolveUDPAddr("udp", addr.String())
+			if err != nil {
+				continue
+			}
+			list = append(list, natTarget{nu: nu, addr: addr, ip: ua.IP.String()})
+		}
+	}
+	return list
+}
+
+// natCompatible reports whether udp hole punching may work between the nat types, unknown types are given a try.
+func natCompatible(a, b string) bool {
+	hard := func(x, y string) bool {
+		return x == comm.NatSymmetric && (y == comm.NatSymmetric || y == comm.NatPortRestricted)
+	}
+	return !hard(a, b) && !hard(b, a)
+}
+
+// p2pReachable reports whether udp p2p may work between two sides, the global ipv6 addresses need no punching through nat.
+func p2pReachable(nat, peerNat string, ipv6, peerIPv6 bool) bool {
+	return (ipv6 && peerIPv6) || natCompatible(nat, peerNat)
+}
+
+// natType returns the last detected nat type.
+func (l *launcher) natType() string {
+	view := l.nat.Load()
+	if view == nil {
+		return comm.NatUnknown
+	}
+	return view.Type
+}
+
+// natLoop detects the nat type now and then if any node is reachable over udp.
+func (l *launcher) natLoop(ctx context.Context) {
+	if len(l.natTargets()) == 0 {
+		return
+	}
+	for {
+		view := l.detectNat(ctx)
+		l.nat.Store(view)
+		if view.Error != "" {
+			l.c.logger.Debug("client:", "nat:", view.Type, "err:", view.Error)
+		} else {
+			l.c.logger.Info("client:", "nat:", view.Type)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(natDetectInterval):
+		}
+	}
+}
+
+// detectNat classifies the nat of a new udp socket:
+// the mapped address seen by a node equal to the local one is open, a token sent by another node ip before the socket
+// has sent to it is full-cone, a token sent by the first node from a new port is restricted, otherwise port-restricted,
+// and a different mapped address seen by a second node address is symmetric.
+func (l *launcher) detectNat(ctx context.Context) *comm.NatView {
+	view := &comm.NatView{Type: comm.NatUnknown, Time: time.Now()}
+	fail := func(err error) *comm.NatView {
+		view.Error = err.Error()
+		return view
+	}
+	targets := l.natTargets()
+	for _, one := range targets {
+		view.Targets = append(view.Targets, one.addr.String())
+	}
+	if len(targets) < 2 {
+		return fail(ErrNatTargets.Errorf(len(targets)))
+	}
+	ctx, cl := context.WithTimeout(ctx, natDetectTimeout)
+	defer cl()
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return fail(err)
+	}
+	ur := xquic.NewQuicTransportDialer(&quic.Transport{Conn: udp}, nil)
+	defer ur.Close()
+	tokens := make(chan []byte, 8)
+	go func() {
+		b := make([]byte, 2*natTokenSize)
+		for {
+			n, _, err := ur.Transport().ReadNonQUICPacket(ctx, b)
+			if err != nil {
+				return
+			}
+			select {
+			case tokens <- bytes.Clone(b[:n]):
+			default:
+			}
+		}
+	}()
+	view.Local = udp.LocalAddr().String()
+
+	a := targets[0]
+	mapA, err := natMap(ctx, a, ur)
+	if err != nil {
+		return fail(err)
+	}
+	view.Mapped = append(view.Mapped, mapA)
+	if natOpen(mapA, udp.LocalAddr().(*net.UDPAddr)) {
+		view.Type = comm.NatOpen
+		return view
+	}
+	b := targets[1]
+	for _, one := range targets[1:] {
+		if one.ip != a.ip {
+			b = one
+			break
+		}
+	}
+	if b.ip != a.ip {
+		ok, err := l.natProbe(ctx, b.nu, mapA, tokens)
+		if err != nil {
+			return fail(err)
+		}
+		if ok {
+			view.Type = comm.NatFullCone
+		}
+	}
+	if view.Type == comm.NatUnknown {
+		ok, err := l.natProbe(ctx, a.nu, mapA, tokens)
+		if err != nil {
+			return fail(err)
+		}
+		if ok {
+			view.Type = comm.NatRestricted
+		} else {
+			view.Type = comm.NatPortRestricted
+		}
+	}
+	mapB, err := natMap(ctx, b, ur)
+	if err != nil {
+		view.Error = err.Error()
+		return view
+	}
+	view.Mapped = append(view.Mapped, mapB)
+	if mapB != mapA {
+		view.Type = comm.NatSymmetric
+	}
+	return view
+}
+
+// natMap returns the public address of the socket of ur seen by the node address.
+func natMap(ctx context.Context, t natTarget, ur *xquic.QuicTransportDialer) (string, error) {
+	dr := xmulti.NewMultiAddrDialer(xmulti.MultiAddrDialTypeGo, map[string]xnetutil.Dialer{t.addr.Network(): ur})
+	conn, err := dr.MultiDialContext(ctx, t.addr)
+	if err != nil {
+		return "", err
+	}
+	session, err := t.nu.WithConn(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		return "", err
+	}
+	defer session.Close()
+	stream, err := session.Stream(ctx, comm.CallNatMap)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+	err = stream.Send(nil)
+	if err != nil {
+		return "", err
+	}
+	err = stream.Recv(nil)
+	if err != nil {
+		return "", err
+	}
+	addr, _ := xrpc.GetSessionAuthInfoT[string](stream.Context(), xrpc.LocalPubAddress)
+	if addr == "" {
+		return "", ErrNatMap.Errorf(t.addr.String())
+	}
+	return addr, nil
+}
+
+// natOpen reports whether the mapped address is the local socket itself.
+func natOpen(mapped string, local *net.UDPAddr) bool {
+	host, port, err := net.SplitHostPort(mapped)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || port != strconv.Itoa(local.Port) {
+		return false
+	}
+	for _, one := range interfaceIPs(ip) {
+		if one.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// natProbe asks the node to send a token to the mapped address and reports whether it comes.
+func (l *launcher) natProbe(ctx context.Context, nu *comm.NodeUnit, mapped string, tokens <-chan []byte) (bool, error) {
+	token := make([]byte, natTokenSize)
+	_, err := rand.Read(token)
+	if err != nil {
+		return false, err
+	}
+	token[0] = 0 // never taken for a quic packet
+	_, err = l.rpc(ctx, []*comm.NodeUnit{nu}, comm.CallNatProbe, comm.NatProbeRequest{Address: mapped, Token: token}, nil)
+	if err != nil {
+		return false, err
+	}
+	timer := time.NewTimer(natProbeWait)
+	defer timer.Stop()
+	for {
+		select {
+		case b := <-tokens:
+			if bytes.Equal(b, token) {
+				return true, nil
+			}
+		case <-timer.C:
+			return false, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// DetectNat probes the nodes for the udp nat type now, the result is used by the following p2p links.
+func (c *Client) DetectNat(ctx context.Context) *comm.NatView {
+	view := c.launcher.detectNat(ctx)
+	c.launcher.nat.Store(view)
+	return view
+}
+
+// GetNatView returns the last detected nat type, nil if it is not detected yet.
+func (c *Client) GetNatView() *comm.NatView {
+	return c.launcher.nat.Load()
+}
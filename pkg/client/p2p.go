@@ -0,0 +1,339 @@
+package client
+
+import (
+	"cmp"
+	"context"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	p2pCheckTimeout  = 5 * time.Second        // time of the connectivity checks of all pairs
+	p2pCheckInterval = 100 * time.Millisecond // wait between the attempts of one pair
+	p2pNominateWait  = 200 * time.Millisecond // wait for better pairs after the first working one
+	maxP2PCandidates = 16
+	maxPortPredict   = 4
+	ipv6CacheTTL     = 10 * time.Second // the interfaces are listed again for the links after it
+)
+
+// p2pCandidate is an address the peer may reach the local p2p socket at.
+type p2pCandidate struct {
+	Type    string
+	Address string
+}
+
+// gatherCandidates returns the candidates of the local p2p socket ordered by priority:
+// the global ipv6 addresses v6, the interface addresses, the public address seen by the node, then the predicted ports around it.
+func gatherCandidates(priAddr, pubAddr string, predict int, v6 []net.IP) []p2pCandidate {
+	var list []p2pCandidate
+	add := func(typ, addr string) {
+		if len(list) >= maxP2PCandidates {
+			return
+		}
+		for _, one := range list {
+			if one.Address == addr {
+				return
+			}
+		}
+		list = append(list, p2pCandidate{Type: typ, Address: addr})
+	}
+	if host, port, err := net.SplitHostPort(priAddr); err == nil {
+		for _, one := range v6 {
+			add(comm.CandidateHost, net.JoinHostPort(one.String(), port))
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsUnspecified() {
+				add(comm.CandidateHost, priAddr)
+			}
+			for _, one := range interfaceIPs(ip) {
+				add(comm.CandidateHost, net.JoinHostPort(one.String(), port))
+			}
+		}
+	}
+	host, port, err := net.SplitHostPort(pubAddr)
+	if err != nil {
+		return list
+	}
+	add(comm.CandidateSrflx, pubAddr)
+	p, _ := strconv.Atoi(port)
+	for i := 1; i <= predict; i++ {
+		for _, one := range []int{p + i, p - i} {
+			if one > 0 && one <= 65535 {
+				add(comm.CandidatePrflx, net.JoinHostPort(host, strconv.Itoa(one)))
+			}
+		}
+	}
+	return list
+}
+
+// interfaceIPs returns the interface addresses of the same family as ip, the loopback ones only if ip is loopback.
+func interfaceIPs(ip net.IP) []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	v4 := ip.To4() != nil
+	var list []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() != nil) != v4 || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.IsLoopback() && !ip.IsLoopback() {
+			continue
+		}
+		list = append(list, ipNet.IP)
+	}
+	return list
+}
+
+var ipv6Cache struct {
+	mux  sync.Mutex
+	at   time.Time
+	list []net.IP
+}
+
+// globalIPv6 returns the global unicast ipv6 addresses of the interfaces, the unique local and link-local ones are left out.
+// The addresses are cached for ipv6CacheTTL, so the link requests do not list the interfaces each time.
+func globalIPv6() []net.IP {
+	ipv6Cache.mux.Lock()
+	defer ipv6Cache.mux.Unlock()
+	if !ipv6Cache.at.IsZero() && time.Since(ipv6Cache.at) < ipv6CacheTTL {
+		return ipv6Cache.list
+	}
+	ipv6Cache.list = listGlobalIPv6()
+	ipv6Cache.at = time.Now()
+	return ipv6Cache.list
+}
+
+func listGlobalIPv6() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var list []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() {
+			continue
+		}
+		list = append(list, ipNet.IP)
+	}
+	return list
+}
+
+// addrFamily returns ipv4 or ipv6 of the ip address, empty if it is not one.
+func addrFamily(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return comm.FamilyIPv4
+	default:
+		return comm.FamilyIPv6
+	}
+}
+
+// remoteCandidates keeps the valid ip candidates sent by the peer, the peers without candidates have the public address only.
+// The ipv6 candidates come first if v6 is set, and are left out otherwise.
+func remoteCandidates(rinfo *connInfo, v6 bool) []p2pCandidate {
+	if len(rinfo.Candidates) == 0 {
+		return []p2pCandidate{{Type: comm.CandidateSrflx, Address: rinfo.PublicAddress}}
+	}
+	list := make([]p2pCandidate, 0, min(len(rinfo.Candidates), maxP2PCandidates))
+	for _, one := range rinfo.Candidates {
+		family := addrFamily(one.Address)
+		if family == "" || (family == comm.FamilyIPv6 && !v6) {
+			continue
+		}
+		list = append(list, one)
+		if len(list) >= maxP2PCandidates {
+			break
+		}
+	}
+	slices.SortStableFunc(list, func(a, b p2pCandidate) int {
+		return cmp.Compare(familyOrder(a.Address), familyOrder(b.Address))
+	})
+	return list
+}
+
+func familyOrder(addr string) int {
+	if addrFamily(addr) == comm.FamilyIPv6 {
+		return 0
+	}
+	return 1
+}
+
+// p2pPair is a working candidate pair.
+type p2pPair struct {
+	index int // of the remote candidate, smaller is better
+	cand  p2pCandidate
+	conn  net.Conn
+	delay time.Duration
+}
+
+// p2pPairs collects the working pairs of the connectivity checks until one is selected.
+type p2pPairs struct {
+	start    time.Time
+	mux      sync.Mutex
+	finished bool
+	list     []*p2pPair
+	ch       chan *p2pPair
+}
+
+func newP2PPairs() *p2pPairs {
+	return &p2pPairs{start: time.Now(), ch: make(chan *p2pPair, 2*maxP2PCandidates)}
+}
+
+// add offers a working pair, it is closed if a pair has been selected.
+func (pp *p2pPairs) add(p *p2pPair) {
+	pp.mux.Lock()
+	defer pp.mux.Unlock()
+	if pp.finished {
+		_ = p.conn.Close()
+		return
+	}
+	p.delay = time.Since(pp.start)
+	select {
+	case pp.ch <- p:
+		pp.list = append(pp.list, p)
+	default:
+		_ = p.conn.Close()
+	}
+}
+
+// finish closes every pair except sel and returns the count of the working pairs.
+func (pp *p2pPairs) finish(sel *p2pPair) int {
+	pp.mux.Lock()
+	defer pp.mux.Unlock()
+	pp.finished = true
+	for _, p := range pp.list {
+		if p != sel {
+			_ = p.conn.Close()
+		}
+	}
+	return len(pp.list)
+}
+
+// checkPairs runs the check of every remote candidate in parallel, each one is tried again until it works or ctx is done.
+// The pairs channel is closed when all checks end.
+func checkPairs(ctx context.Context, remotes []p2pCandidate, pairs *p2pPairs, check func(ctx context.Context, addr string) (net.Conn, error)) {
+	var wg sync.WaitGroup
+	for i, cand := range remotes {
+		wg.Add(1)
+		go func(i int, cand p2pCandidate) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				conn, err := check(ctx, cand.Address)
+				if err == nil {
+					pairs.add(&p2pPair{index: i, cand: cand, conn: conn})
+					return
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(p2pCheckInterval):
+				}
+			}
+		}(i, cand)
+	}
+	go func() {
+		wg.Wait()
+		pairs.mux.Lock()
+		defer pairs.mux.Unlock()
+		pairs.finished = true
+		close(pairs.ch)
+	}()
+}
+
+// nominatePair is the controlling side, it selects the best pair working soon after the first one and tells the peer.
+func nominatePair(ctx context.Context, pairs *p2pPairs) (*p2pPair, int, error) {
+	var best *p2pPair
+	var wait <-chan time.Time
+loop:
+	for {
+		select {
+		case p, ok := <-pairs.ch:
+			if !ok {
+				break loop
+			}
+			if best == nil || p.index < best.index {
+				best = p
+			}
+			if wait == nil {
+				wait = time.After(p2pNominateWait)
+			}
+		case <-wait:
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	working := pairs.finish(best)
+	if best == nil {
+		return nil, working, ErrP2PFailed
+	}
+	_, err := best.conn.Write([]byte{1})
+	if err != nil {
+		_ = best.conn.Close()
+		return nil, working, err
+	}
+	return best, working, nil
+}
+
+// awaitPair is the controlled side, it takes the pair the peer nominates.
+func awaitPair(ctx context.Context, pairs *p2pPairs) (*p2pPair, int, error) {
+	nominated := make(chan *p2pPair, 1)
+	ch := pairs.ch
+	for {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				ch = nil
+				continue
+			}
+			go func() {
+				b := make([]byte, 1)
+				_, err := io.ReadFull(p.conn, b)
+				if err == nil && b[0] == 1 {
+					select {
+					case nominated <- p:
+					default:
+					}
+				}
+			}()
+		case p := <-nominated:
+			return p, pairs.finish(p), nil
+		case <-ctx.Done():
+			return nil, pairs.finish(nil), ErrP2PFailed
+		}
+	}
+}
+
+// p2pView is the report of the selected pair.
+func p2pView(network string, remotes []p2pCandidate, working int, p *p2pPair, err error) comm.LinkP2PView {
+	view := comm.LinkP2PView{
+		Network: network,
+		Checks:  len(remotes),
+		Working: working,
+	}
+	if err != nil {
+		view.Error = err.Error()
+		return view
+	}
+	view.Local = p.conn.LocalAddr().String()
+	view.Remote = p.cand.Address
+	view.Type = p.cand.Type
+	view.Family = addrFamily(p.cand.Address)
+	view.Delay = p.delay
+	return view
+}
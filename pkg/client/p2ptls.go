@@ -0,0 +1,81 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"time"
+)
+
+const p2pALPN = "anchorage-p2p"
+
+// p2pIdentity is the ephemeral tls identity of one side of a p2p link, only its fingerprint goes through the relay.
+// It keeps a passive relay out, a relay that swaps the fingerprints can still sit in the middle.
+type p2pIdentity struct {
+	cert        tls.Certificate
+	fingerprint string
+}
+
+func newP2PIdentity() (*p2pIdentity, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: p2pALPN},
+		NotBefore:    now.Add(-1 * time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &p2pIdentity{
+		cert:        tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		fingerprint: certFingerprint(der),
+	}, nil
+}
+
+// tlsConfig returns the config of either tls role that only accepts the peer of the fingerprint, both sides present a cert.
+func (pi *p2pIdentity) tlsConfig(peer string) (*tls.Config, error) {
+	if peer == "" {
+		return nil, ErrP2PFingerprint.Errorf("empty")
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{pi.cert},
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true, // the chain is self-signed, the peer is verified by VerifyPeerCertificate
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrP2PFingerprint.Errorf("no peer cert")
+			}
+			if subtle.ConstantTimeCompare([]byte(certFingerprint(rawCerts[0])), []byte(peer)) != 1 {
+				return ErrP2PFingerprint.Errorf("mismatch")
+			}
+			return nil
+		},
+		SessionTicketsDisabled: true, // a resumed session skips VerifyPeerCertificate
+		NextProtos:             []string{p2pALPN},
+		MinVersion:             tls.VersionTLS13,
+	}, nil
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"math"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// dialError is a Dial error with its retry class, see config.RetryErrorService etc.
+type dialError struct {
+	class string
+	err   error
+}
+
+func newDialError(class string, err error) error {
+	return &dialError{class: class, err: err}
+}
+
+func (de *dialError) Error() string {
+	return de.err.Error()
+}
+
+func (de *dialError) Unwrap() error {
+	return de.err
+}
+
+// DialErrorClass returns the retry class of a Dial error, empty is unknown.
+func DialErrorClass(err error) string {
+	var de *dialError
+	if errors.As(err, &de) {
+		return de.class
+	}
+	return ""
+}
+
+// linkReqErrorClass classifies a failed link request, the local errors by their sentinels and the errors of the
+// nodes by their messages.
+func linkReqErrorClass(err error) string {
+	switch {
+	case errors.Is(err, ErrLinkRefuse), errors.Is(err, ErrP2PNat):
+		return config.RetryErrorDenied
+	case errors.Is(err, ErrNilNodes), errors.Is(err, ErrNotFoundNode), errors.Is(err, ErrDialNodeFailed),
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return config.RetryErrorNode
+	}
+	return wireErrorClass(err.Error())
+}
+
+// Fallback for the errors that came over the wire: the rpc keeps only their messages, so they are matched by the
+// messages of the server errors (ErrPermissionDenied, ErrQuotaExceeded and ErrNotFoundService) and ErrLinkRefuse
+// of the listener.
+var (
+	wireDeniedErrors  = []string{"permission denied", "quota exceeded", ErrLinkRefuse.Error()}
+	wireServiceErrors = []string{"not found service"}
+)
+
+func wireErrorClass(msg string) string {
+	contains := func(list []string) bool {
+		return slices.ContainsFunc(list, func(s string) bool {
+			return strings.Contains(msg, s)
+		})
+	}
+	switch {
+	case contains(wireDeniedErrors):
+		return config.RetryErrorDenied
+	case contains(wireServiceErrors):
+		return config.RetryErrorService
+	default:
+		return config.RetryErrorNode
+	}
+}
+
+// dialRetry is the parsed config.DialRetryConfig.
+type dialRetry struct {
+	attempts   int
+	timeout    time.Duration
+	min        time.Duration
+	max        time.Duration
+	multiplier float64
+	errors     []string
+}
+
+func newDialRetry(cfg *config.DialRetryConfig) *dialRetry {
+	dr := &dialRetry{attempts: 1, min: 200 * time.Millisecond, max: 5 * time.Second, multiplier: 2, errors: config.DefaultRetryErrors}
+	if cfg == nil {
+		return dr
+	}
+	dr.attempts = max(int(cfg.Attempts), 1)
+	dr.timeout = time.Duration(cfg.Timeout) * time.Millisecond
+	if cfg.Min > 0 {
+		dr.min = time.Duration(cfg.Min) * time.Millisecond
+	}
+	if cfg.Max > 0 {
+		dr.max = time.Duration(cfg.Max) * time.Millisecond
+	}
+	dr.max = max(dr.max, dr.min)
+	if cfg.Multiplier >= 1 {
+		dr.multiplier = cfg.Multiplier
+	}
+	if len(cfg.Errors) != 0 {
+		dr.errors = cfg.Errors
+	}
+	return dr
+}
+
+// delay returns the wait before the retry after the attempt.
+func (dr *dialRetry) delay(attempt int) time.Duration {
+	d := float64(dr.min) * math.Pow(dr.multiplier, float64(max(attempt-1, 0)))
+	return time.Duration(min(d, float64(dr.max)))
+}
+
+func (dr *dialRetry) retryable(err error) bool {
+	return slices.Contains(dr.errors, DialErrorClass(err))
+}
+
+// DialRetry is Dial with the retry policy, onRetry is called with the failed attempt before each retry.
+// A nil retry is a single Dial.
+func (c *Client) DialRetry(ctx context.Context, cfg comm.LinkRequest, retry *config.DialRetryConfig, onRetry func(attempt int, err error)) (net.Conn, error) {
+	dr := newDialRetry(retry)
+	for attempt := 1; ; attempt++ {
+		conn, err := c.dialAttempt(ctx, cfg, dr.timeout)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt >= dr.attempts || ctx.Err() != nil || !dr.retryable(err) {
+			return nil, err
+		}
+		if onRetry != nil {
+			onRetry(attempt, err)
+		}
+		c.logger.Warn("client:", "dialer link req:", cfg.Link, "attempt", attempt, "err:", err, "retry")
+		timer := time.NewTimer(dr.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// dialAttempt is Dial that gives up setting up the link after timeout, 0 is no limit.
+// The link of a successful attempt is not bound to the timeout.
+func (c *Client) dialAttempt(ctx context.Context, cfg comm.LinkRequest, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return c.Dial(ctx, cfg)
+	}
+	actx, cl := context.WithCancel(ctx)
+	timer := time.AfterFunc(timeout, cl)
+	conn, err := c.Dial(actx, cfg)
+	if !timer.Stop() && ctx.Err() == nil {
+		if err == nil {
+			_ = conn.Close()
+			err = newDialError(config.RetryErrorStream, context.DeadlineExceeded)
+		} else {
+			err = newDialError(DialErrorClass(err), errors.Join(context.DeadlineExceeded, err))
+		}
+	}
+	if err != nil {
+		cl()
+		return nil, err
+	}
+	return &attemptConn{Conn: conn, cl: cl}, nil
+}
+
+// attemptConn releases the attempt context of the link on close.
+type attemptConn struct {
+	net.Conn
+	cl context.CancelFunc
+}
+
+func (ac *attemptConn) Close() error {
+	defer ac.cl()
+	return ac.Conn.Close()
+}
@@ -0,0 +1,458 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	frameData     = 0 // [type][seq][data], seq is the offset of data in the written bytes
+	frameFallback = 1 // [type][seq], the direct path is gone and the sender has received seq bytes
+
+	upgradeChunk     = 32 * 1024
+	upgradeQueue     = 64              // queued chunks of each path
+	upgradeRetain    = 4 * 1024 * 1024 // bytes kept for the retransmission after the direct path is gone
+	directHeaderSize = 12              // [seq 8][length 4]
+)
+
+const (
+	writeRelay = iota
+	writeDirect
+	writeWaiting // the direct path is gone, waiting for the received offset of the peer
+)
+
+var errUpgradeClosed = errors.New("upgrade conn closed")
+
+type upgradeChunkData struct {
+	seq  uint64
+	data []byte
+}
+
+// upgradeConn is a link that starts over the relay stream and moves to a direct p2p connection once one is set up.
+// Every chunk is numbered by its offset in the written bytes, so the reader takes them in order from either path,
+// and the chunks lost with a broken direct path are sent again over the relay, which stays as the fallback.
+type upgradeConn struct {
+	stream       xrpc.Stream
+	laddr, raddr net.Addr
+	df           func()
+	closer       sync.Once
+
+	smux sync.Mutex // sends of the relay stream
+
+	dmux     sync.Mutex
+	direct   net.Conn
+	fellBack bool // the direct path is given up, it is never taken again
+
+	wmux        sync.Mutex
+	wcond       *sync.Cond
+	mode        int
+	sent        uint64
+	directStart uint64 // sent when the writes moved to the direct path
+	retain      []byte // last bytes written to the direct path, ending at sent
+	wclosed     bool
+	wdeadline   time.Time
+	wtimer      *time.Timer // wakes the waiting writes at wdeadline
+
+	rmux       sync.Mutex
+	rcond      *sync.Cond
+	recv       uint64
+	rq, dq     []upgradeChunkData
+	dgot       uint64 // end of the last chunk from the direct path
+	relayDone  bool
+	hasDirect  bool
+	directDone bool
+	rclosed    bool
+	rerr       error
+	rdeadline  time.Time
+	rtimer     *time.Timer // wakes the waiting reads at rdeadline
+}
+
+func newUpgradeConn(stream xrpc.Stream, laddr, raddr net.Addr, df func()) *upgradeConn {
+	uc := &upgradeConn{stream: stream, laddr: laddr, raddr: raddr, df: df}
+	uc.wcond = sync.NewCond(&uc.wmux)
+	uc.rcond = sync.NewCond(&uc.rmux)
+	go uc.relayLoop()
+	return uc
+}
+
+// upgrade moves the writes to the direct connection, it is closed if the link has fallen back or closed.
+func (uc *upgradeConn) upgrade(conn net.Conn) bool {
+	uc.wmux.Lock()
+	uc.dmux.Lock()
+	if uc.fellBack || uc.wclosed {
+		uc.dmux.Unlock()
+		uc.wmux.Unlock()
+		_ = conn.Close()
+		return false
+	}
+	uc.direct = conn
+	uc.dmux.Unlock()
+	_ = conn.SetWriteDeadline(uc.wdeadline)
+	uc.directStart = uc.sent
+	uc.mode = writeDirect
+	uc.wmux.Unlock()
+	uc.rmux.Lock()
+	uc.hasDirect = true
+	uc.rmux.Unlock()
+	go uc.directLoop(conn)
+	return true
+}
+
+func (uc *upgradeConn) Read(b []byte) (int, error) {
+	uc.rmux.Lock()
+	defer uc.rmux.Unlock()
+	for {
+		if uc.rclosed {
+			return 0, errUpgradeClosed
+		}
+		n := uc.take(&uc.rq, b)
+		if n == 0 {
+			n = uc.take(&uc.dq, b)
+		}
+		uc.rcond.Broadcast() // the taken or dropped chunks make room for the paths
+		if n > 0 {
+			return n, nil
+		}
+		if uc.rerr != nil {
+			return 0, uc.rerr
+		}
+		if uc.relayDone && (!uc.hasDirect || uc.directDone) {
+			return 0, io.EOF
+		}
+		if deadlineExpired(uc.rdeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		uc.rcond.Wait()
+	}
+}
+
+// take copies the bytes at recv from the head of q, the chunks already taken from the other path are dropped.
+func (uc *upgradeConn) take(q *[]upgradeChunkData, b []byte) int {
+	for len(*q) != 0 {
+		head := &(*q)[0]
+		end := head.seq + uint64(len(head.data))
+		if end <= uc.recv {
+			*q = (*q)[1:]
+			continue
+		}
+		if head.seq > uc.recv || len(b) == 0 {
+			return 0
+		}
+		n := copy(b, head.data[uc.recv-head.seq:])
+		uc.recv += uint64(n)
+		return n
+	}
+	return 0
+}
+
+// push queues a chunk of one path, waiting while the queue is full.
+func (uc *upgradeConn) push(direct bool, c upgradeChunkData) bool {
+	uc.rmux.Lock()
+	defer uc.rmux.Unlock()
+	q := &uc.rq
+	if direct {
+		q = &uc.dq
+	}
+	for len(*q) >= upgradeQueue && !uc.rclosed && (!direct || !uc.directDone) {
+		uc.rcond.Wait()
+	}
+	if uc.rclosed || (direct && uc.directDone) {
+		return false
+	}
+	*q = append(*q, c)
+	if direct {
+		uc.dgot = c.seq + uint64(len(c.data))
+	}
+	uc.rcond.Broadcast()
+	return true
+}
+
+func (uc *upgradeConn) relayLoop() {
+	defer func() {
+		uc.rmux.Lock()
+		uc.relayDone = true
+		uc.rcond.Broadcast()
+		uc.rmux.Unlock()
+		uc.wmux.Lock()
+		uc.wcond.Broadcast()
+		uc.wmux.Unlock()
+	}()
+	for {
+		var b []byte
+		err := uc.stream.Recv(&b)
+		if err != nil {
+			return
+		}
+		if len(b) == 0 {
+			// keepalive probe of the server
+			err = uc.sendRelay(nil)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if len(b) < 9 {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(b[1:9])
+		switch b[0] {
+		case frameData:
+			if !uc.push(false, upgradeChunkData{seq: seq, data: b[9:]}) {
+				return
+			}
+		case frameFallback:
+			uc.lostDirect()
+			go uc.resend(seq)
+		}
+	}
+}
+
+func (uc *upgradeConn) directLoop(conn net.Conn) {
+	defer uc.lostDirect()
+	header := make([]byte, directHeaderSize)
+	for {
+		_, err := io.ReadFull(conn, header)
+		if err != nil {
+			return
+		}
+		seq := binary.BigEndian.Uint64(header[:8])
+		size := binary.BigEndian.Uint32(header[8:])
+		if size == 0 || size > upgradeChunk {
+			return
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(conn, data)
+		if err != nil {
+			return
+		}
+		if !uc.push(true, upgradeChunkData{seq: seq, data: data}) {
+			return
+		}
+	}
+}
+
+// lostDirect gives up the direct path once and tells the peer the received offset, the peer sends the rest again.
+// The writes to the direct path fail once it is closed, and wait for the offset of the peer.
+func (uc *upgradeConn) lostDirect() {
+	uc.dmux.Lock()
+	if uc.fellBack {
+		uc.dmux.Unlock()
+		return
+	}
+	uc.fellBack = true
+	direct := uc.direct
+	uc.dmux.Unlock()
+	if direct != nil {
+		_ = direct.Close()
+	}
+	uc.rmux.Lock()
+	uc.directDone = true
+	got := max(uc.recv, uc.dgot)
+	uc.rcond.Broadcast()
+	uc.rmux.Unlock()
+	b := make([]byte, 9)
+	b[0] = frameFallback
+	binary.BigEndian.PutUint64(b[1:], got)
+	_ = uc.sendRelay(b)
+}
+
+// resend sends the bytes from the received offset of the peer over the relay, and the writes go on over the relay.
+func (uc *upgradeConn) resend(from uint64) {
+	uc.wmux.Lock()
+	defer uc.wmux.Unlock()
+	defer uc.wcond.Broadcast()
+	if uc.mode == writeRelay {
+		return
+	}
+	from = max(from, uc.directStart)
+	start := uc.sent - uint64(len(uc.retain))
+	if from < start || from > uc.sent {
+		uc.fail(ErrP2PFallback.Errorf(from))
+		return
+	}
+	data := uc.retain[from-start:]
+	for len(data) != 0 {
+		n := min(len(data), upgradeChunk)
+		err := uc.sendRelay(dataFrame(from, data[:n]))
+		if err != nil {
+			uc.fail(err)
+			return
+		}
+		from += uint64(n)
+		data = data[n:]
+	}
+	uc.retain = nil
+	uc.mode = writeRelay
+}
+
+// fail ends the reads with err and closes the link, the caller holds wmux.
+func (uc *upgradeConn) fail(err error) {
+	uc.wclosed = true
+	uc.rmux.Lock()
+	uc.rerr = err
+	uc.rcond.Broadcast()
+	uc.rmux.Unlock()
+	go uc.Close()
+}
+
+func dataFrame(seq uint64, data []byte) []byte {
+	b := make([]byte, 9+len(data))
+	b[0] = frameData
+	binary.BigEndian.PutUint64(b[1:9], seq)
+	copy(b[9:], data)
+	return b
+}
+
+func (uc *upgradeConn) sendRelay(b []byte) error {
+	uc.smux.Lock()
+	defer uc.smux.Unlock()
+	return uc.stream.Send(b)
+}
+
+func (uc *upgradeConn) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		m := min(len(b)-n, upgradeChunk)
+		err = uc.write(b[n : n+m])
+		if err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+func (uc *upgradeConn) write(b []byte) error {
+	uc.wmux.Lock()
+	defer uc.wmux.Unlock()
+	for {
+		if uc.wclosed {
+			return errUpgradeClosed
+		}
+		if deadlineExpired(uc.wdeadline) {
+			return os.ErrDeadlineExceeded
+		}
+		switch uc.mode {
+		case writeRelay:
+			err := uc.sendRelay(dataFrame(uc.sent, b))
+			if err != nil {
+				return err
+			}
+			uc.sent += uint64(len(b))
+			return nil
+		case writeDirect:
+			frame := make([]byte, directHeaderSize+len(b))
+			binary.BigEndian.PutUint64(frame[:8], uc.sent)
+			binary.BigEndian.PutUint32(frame[8:12], uint32(len(b)))
+			copy(frame[directHeaderSize:], b)
+			_, err := uc.direct.Write(frame)
+			if err == nil {
+				uc.sent += uint64(len(b))
+				uc.retain = append(uc.retain, b...)
+				if len(uc.retain) > 2*upgradeRetain {
+					uc.retain = append([]byte(nil), uc.retain[len(uc.retain)-upgradeRetain:]...)
+				}
+				return nil
+			}
+			// the frame may be cut by the deadline too, so the direct path is given up like on any other error
+			uc.mode = writeWaiting
+			go uc.lostDirect()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return err
+			}
+		case writeWaiting:
+			uc.rmux.Lock()
+			relayDone := uc.relayDone
+			uc.rmux.Unlock()
+			if relayDone {
+				return io.ErrClosedPipe
+			}
+			uc.wcond.Wait()
+		}
+	}
+}
+
+func (uc *upgradeConn) Close() error {
+	uc.wmux.Lock()
+	uc.wclosed = true
+	uc.wcond.Broadcast()
+	uc.wmux.Unlock()
+	uc.dmux.Lock()
+	uc.fellBack = true
+	direct := uc.direct
+	uc.dmux.Unlock()
+	uc.rmux.Lock()
+	uc.rclosed = true
+	uc.rcond.Broadcast()
+	uc.rmux.Unlock()
+	if direct != nil {
+		_ = direct.Close()
+	}
+	defer uc.closer.Do(uc.df)
+	return uc.stream.Close()
+}
+
+func (uc *upgradeConn) LocalAddr() net.Addr {
+	return uc.laddr
+}
+
+func (uc *upgradeConn) RemoteAddr() net.Addr {
+	return uc.raddr
+}
+
+func (uc *upgradeConn) SetDeadline(t time.Time) error {
+	_ = uc.SetReadDeadline(t)
+	return uc.SetWriteDeadline(t)
+}
+
+// SetReadDeadline ends the waiting reads at t, the chunks queued by the paths are still read after it.
+func (uc *upgradeConn) SetReadDeadline(t time.Time) error {
+	uc.rmux.Lock()
+	defer uc.rmux.Unlock()
+	uc.rdeadline = t
+	uc.rtimer = resetDeadlineTimer(uc.rtimer, t, func() {
+		uc.rmux.Lock()
+		uc.rcond.Broadcast()
+		uc.rmux.Unlock()
+	})
+	uc.rcond.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline ends the writes waiting for the fallback at t and applies t to the direct path.
+// The sends over the relay stream are not cut by it.
+func (uc *upgradeConn) SetWriteDeadline(t time.Time) error {
+	uc.wmux.Lock()
+	defer uc.wmux.Unlock()
+	uc.wdeadline = t
+	uc.wtimer = resetDeadlineTimer(uc.wtimer, t, func() {
+		uc.wmux.Lock()
+		uc.wcond.Broadcast()
+		uc.wmux.Unlock()
+	})
+	if uc.mode == writeDirect {
+		_ = uc.direct.SetWriteDeadline(t)
+	}
+	uc.wcond.Broadcast()
+	return nil
+}
+
+// resetDeadlineTimer stops timer and returns a new one calling wake at t, nil for the zero time.
+func resetDeadlineTimer(timer *time.Timer, t time.Time, wake func()) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), wake)
+}
+
+func deadlineExpired(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
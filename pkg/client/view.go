@@ -1,15 +1,29 @@
 package client
 
 import (
+	"github.com/peakedshout/go-pandorasbox/xnet"
 	"github.com/peakedshout/go-pandorasbox/xrpc"
 	"sort"
 )
 
-func (c *Client) GetClientSessionView() map[string][]xrpc.SessionView {
-	m := make(map[string][]xrpc.SessionView)
+// SessionUnitView is a node session with the detected nat type of the client, only set for the udp sessions.
+type SessionUnitView struct {
+	xrpc.SessionView
+	Nat string
+}
+
+func (c *Client) GetClientSessionView() map[string][]SessionUnitView {
+	m := make(map[string][]SessionUnitView)
+	nat := c.launcher.natType()
 	for node, units := range c.launcher.nm {
 		for _, unit := range units {
-			m[node] = append(m[node], unit.SessionView()...)
+			for _, one := range unit.SessionView() {
+				view := SessionUnitView{SessionView: one}
+				if xnet.GetStdBaseNetwork(one.ConnInfo.LocalPubNetwork) == "udp" {
+					view.Nat = nat
+				}
+				m[node] = append(m[node], view)
+			}
 		}
 	}
 	for _, list := range m {
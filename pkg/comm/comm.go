@@ -119,8 +119,10 @@ func MakeBaseAddress(list []config.BaseNetworkConfig) []net.Addr {
 type NodeUnit struct {
 	Node string
 	*xrpc.Client
-	Dr    *xmulti.MultiAddrDialer
-	Addrs []net.Addr
+	Dr       *xmulti.MultiAddrDialer
+	Addrs    []net.Addr
+	Priority int
+	Weight   int
 }
 
 func MakeNodeUnit(ctx context.Context, nodes []config.NodeConfig) (map[string][]*NodeUnit, error) {
@@ -136,6 +138,13 @@ func MakeNodeUnit(ctx context.Context, nodes []config.NodeConfig) (map[string][]
 		}
 		addr := MakeBaseAddress(node.BaseNetwork)
 		nCtx, _ := xrpc.SetSessionAuthInfoT[string](ctx, NodeName, node.NodeName)
+		if node.Auth != nil {
+			nCtx, _ = xrpc.SetSessionAuthInfoT[string](nCtx, UserName, node.Auth.UserName)
+			if node.UserAuth {
+				// the stored hashes need the plain password, the server checks it in the auth callback and drops it
+				nCtx, _ = xrpc.SetSessionAuthInfoT[string](nCtx, Password, node.Auth.Password)
+			}
+		}
 		cfg := &xrpc.ClientConfig{
 			Ctx:                      nCtx,
 			CryptoList:               crypto,
@@ -150,10 +159,12 @@ func MakeNodeUnit(ctx context.Context, nodes []config.NodeConfig) (map[string][]
 			cfg.SessionAuthInfo = xrpc.BuildUPAuth(node.Auth.UserName, node.Auth.Password)
 		}
 		unit := &NodeUnit{
-			Node:   node.NodeName,
-			Client: xrpc.NewClient(cfg),
-			Dr:     xmulti.DefaultMultiAddrDialer,
-			Addrs:  addr,
+			Node:     node.NodeName,
+			Client:   xrpc.NewClient(cfg),
+			Dr:       xmulti.DefaultMultiAddrDialer,
+			Addrs:    addr,
+			Priority: node.Priority,
+			Weight:   max(node.Weight, 1),
 		}
 		nm[node.NodeName] = append(nm[node.NodeName], unit)
 	}
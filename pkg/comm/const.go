@@ -4,20 +4,32 @@ import "github.com/peakedshout/anchorage-core/pkg/config"
 
 const (
 	CallRegister = "CallRegister"
+	CallDrain    = "CallDrain"
 
 	CallLink    = "CallLink"
 	CallLinkReq = "CallLinkReq"
+	CallLinkP2P = "CallLinkP2P"
+
+	CallNatMap   = "CallNatMap"
+	CallNatProbe = "CallNatProbe"
 
 	CallSync    = "CallSync"
 	CallSyncMap = "CallSyncMap"
 
-	CallRouteView = "CallRouteView"
+	CallRouteView  = "CallRouteView"
+	CallRouteQuery = "CallRouteQuery"
+	CallRouteEvent = "CallRouteEvent"
 
 	CallProxy = "CallProxy"
 )
 
+// NodeAll stands for every configured node in a node list.
+const NodeAll = "all"
+
 const (
 	NodeName   = "nodeName"
+	UserName   = "userName"
+	Password   = "password"
 	KeyLinkId  = "linkId"
 	KeyLinkLId = "linkLId"
 	ProxyInfo  = "proxyInfo"
@@ -29,6 +41,7 @@ type RegisterListenerInfo struct {
 	Notes    string
 	Auth     *config.AuthInfo
 	Settings Settings
+	Grants   []string
 }
 
 func (rli *RegisterListenerInfo) Equal(info *LinkRequest) bool {
@@ -57,10 +70,30 @@ func (rli *RegisterListenerInfo) P2PCheck(info *LinkRequest) (enable bool) {
 }
 
 type Settings struct {
-	SwitchHide bool
-	SwitchLink bool
-	SwitchUP2P bool
-	SwitchTP2P bool
+	SwitchHide  bool
+	SwitchLink  bool
+	SwitchUP2P  bool
+	SwitchTP2P  bool
+	Balance     string
+	Weight      int
+	IdleTimeout int // ms, 0 follows the server and negative is never
+}
+
+const (
+	BalanceRandom      = "random"
+	BalanceRoundRobin  = "roundRobin"
+	BalanceWeighted    = "weighted"
+	BalanceLeastLink   = "leastLink"
+	BalanceLowestDelay = "lowestDelay"
+)
+
+func CheckBalance(balance string) bool {
+	switch balance {
+	case "", BalanceRandom, BalanceRoundRobin, BalanceWeighted, BalanceLeastLink, BalanceLowestDelay:
+		return true
+	default:
+		return false
+	}
 }
 
 type LinkRequest struct {
@@ -72,6 +105,8 @@ type LinkRequest struct {
 	SwitchTP2P  bool
 	ForceP2P    bool
 	Auth        *config.AuthInfo
+	Nat         string // nat type of the dialer, see NatFullCone etc.
+	IPv6        bool   // the dialer has global ipv6
 
 	BoxId  uint64
 	BoxLId string
@@ -95,3 +130,16 @@ type LinkResponse struct {
 	BoxId      uint64
 	BoxLId     string
 }
+
+// LinkP2PReport is the p2p result of one side of a link, sent to the node of the side.
+type LinkP2PReport struct {
+	BoxId  uint64
+	BoxLId string
+	View   LinkP2PView
+}
+
+// NatProbeRequest asks the node to send Token to Address from a new udp port, the address must be of the client.
+type NatProbeRequest struct {
+	Address string
+	Token   []byte
+}
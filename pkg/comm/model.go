@@ -1,7 +1,11 @@
 package comm
 
 import (
+	"errors"
+	"fmt"
 	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"path"
+	"strings"
 	"time"
 )
 
@@ -12,6 +16,11 @@ const (
 	LinkStatusDead = "dead"
 )
 
+const (
+	CloseReasonIdle      = "idle timeout"
+	CloseReasonKeepAlive = "keepalive timeout"
+)
+
 type LinkView struct {
 	Id                uint64                  `json:"id"`
 	Link              string                  `json:"link"`
@@ -23,6 +32,54 @@ type LinkView struct {
 	LinkId            string                  `json:"linkId"` // identification bit instead of reliable uuid
 	LinkList          []string                `json:"linkList"`
 	NodeList          []string                `json:"nodeList"`
+	User              string                  `json:"user"`
+	Rate              [2]int64                `json:"rate"`      // byte/s of source->target and target->source
+	RateLimit         [2]int64                `json:"rateLimit"` // 0 is unlimited
+	CloseReason       string                  `json:"closeReason"`
+	P2P               [2]*LinkP2PView         `json:"p2p"` // reported by source and target, nil is not p2p
+}
+
+const (
+	CandidateHost  = "host"  // local interface address
+	CandidateSrflx = "srflx" // public address seen by the node
+	CandidatePrflx = "prflx" // predicted port of the public address, or an address only learned from the peer
+)
+
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// LinkP2PView is the result of the p2p connectivity checks of one side.
+type LinkP2PView struct {
+	Network string        `json:"network"`
+	Local   string        `json:"local"`   // local address of the selected pair
+	Remote  string        `json:"remote"`  // remote address of the selected pair
+	Type    string        `json:"type"`    // candidate type of the remote address
+	Family  string        `json:"family"`  // ip family of the remote address, FamilyIPv4 or FamilyIPv6
+	Checks  int           `json:"checks"`  // remote candidates checked
+	Working int           `json:"working"` // pairs that connected before the selection
+	Delay   time.Duration `json:"delay"`   // from the start of the checks to the selected pair
+	Error   string        `json:"error"`   // empty if the p2p connection is set up
+}
+
+const (
+	NatUnknown        = ""
+	NatOpen           = "open"            // no nat, the udp socket is reachable at its own address
+	NatFullCone       = "full-cone"       // any host can reach the mapped address
+	NatRestricted     = "restricted"      // only the ips the socket has sent to can reach the mapped address
+	NatPortRestricted = "port-restricted" // only the ip:ports the socket has sent to can reach the mapped address
+	NatSymmetric      = "symmetric"       // each destination gets a new mapped address
+)
+
+// NatView is the udp nat type detected by probing the nodes.
+type NatView struct {
+	Type    string    `json:"type"`
+	Local   string    `json:"local"`   // local address of the probe socket
+	Mapped  []string  `json:"mapped"`  // mapped addresses seen by the probed nodes
+	Targets []string  `json:"targets"` // probed node addresses
+	Error   string    `json:"error"`   // why the type is unknown or not exact
+	Time    time.Time `json:"time"`
 }
 
 type ServiceRouteView struct {
@@ -37,6 +94,83 @@ type ServiceRouteViewUnit struct {
 	Auth     bool          `json:"auth"`
 	Settings Settings      `json:"settings"`
 	Delay    time.Duration `json:"delay"`
+	Active   int64         `json:"active"`
+	Hop      int           `json:"hop"`
+	Path     []string      `json:"path"`
+}
+
+const (
+	RouteSortName   = "name"
+	RouteSortDelay  = "delay"
+	RouteSortHop    = "hop"
+	RouteSortActive = "active"
+)
+
+// ServiceRouteQuery filters, sorts and pages the service route units, the zero fields match all.
+type ServiceRouteQuery struct {
+	Name   string `json:"name"`  // service name (support glob pattern)
+	Node   string `json:"node"`  // node of the service
+	Notes  string `json:"notes"` // substring of the notes
+	Link   bool   `json:"link"`  // only the services that can be linked
+	UP2P   bool   `json:"up2p"`  // only the services that support udp p2p
+	TP2P   bool   `json:"tp2p"`  // only the services that support tcp p2p
+	Sort   string `json:"sort"`  // name, delay, hop or active, empty is name
+	Desc   bool   `json:"desc"`
+	Offset int    `json:"offset"`
+	Limit  int    `json:"limit"` // 0 is no limit
+}
+
+func (q *ServiceRouteQuery) Check() error {
+	if _, err := path.Match(q.Name, ""); err != nil {
+		return fmt.Errorf("invalid name pattern: %s", q.Name)
+	}
+	switch q.Sort {
+	case "", RouteSortName, RouteSortDelay, RouteSortHop, RouteSortActive:
+	default:
+		return fmt.Errorf("invalid sort: %s", q.Sort)
+	}
+	if q.Offset < 0 || q.Limit < 0 {
+		return errors.New("invalid offset or limit")
+	}
+	return nil
+}
+
+func (q *ServiceRouteQuery) Match(unit *ServiceRouteViewUnit) bool {
+	if q.Name != "" {
+		if ok, _ := path.Match(q.Name, unit.Name); !ok {
+			return false
+		}
+	}
+	if q.Node != "" && q.Node != unit.Node {
+		return false
+	}
+	if q.Notes != "" && !strings.Contains(unit.Notes, q.Notes) {
+		return false
+	}
+	return (!q.Link || unit.Settings.SwitchLink) &&
+		(!q.UP2P || unit.Settings.SwitchUP2P) &&
+		(!q.TP2P || unit.Settings.SwitchTP2P)
+}
+
+type ServiceRouteQueryResult struct {
+	Total int                    `json:"total"` // matched units before paging
+	Units []ServiceRouteViewUnit `json:"units"`
+}
+
+const (
+	RouteEventRegister   = "register"
+	RouteEventUnregister = "unregister"
+	RouteEventDelay      = "delay"
+	RouteEventNodeUp     = "nodeUp"
+	RouteEventNodeDown   = "nodeDown"
+)
+
+// RouteEvent is a change of the service routes, the service events carry Unit and the node events carry Node.
+type RouteEvent struct {
+	Type string                `json:"type"`
+	Time time.Time             `json:"time"`
+	Node string                `json:"node,omitempty"` // sync node of nodeUp and nodeDown
+	Unit *ServiceRouteViewUnit `json:"unit,omitempty"`
 }
 
 type ProxyRequest struct {
@@ -56,3 +190,24 @@ func (pr *ProxyRequest) GetNode(localNode string) (string, []string) {
 	}
 	return "", nil
 }
+
+const (
+	TrafficUser    = "user"
+	TrafficService = "service"
+	TrafficNode    = "node"
+)
+
+type TrafficView struct {
+	User    map[string]*TrafficStat `json:"user"`
+	Service map[string]*TrafficStat `json:"service"`
+	Node    map[string]*TrafficStat `json:"node"`
+}
+
+type TrafficStat struct {
+	Bytes      [2]int64 `json:"bytes"` // total bytes of upload and download
+	Links      int64    `json:"links"` // total links and proxy streams
+	Day        string   `json:"day"`
+	DayBytes   int64    `json:"dayBytes"`
+	Month      string   `json:"month"`
+	MonthBytes int64    `json:"monthBytes"`
+}
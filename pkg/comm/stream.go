@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/peakedshout/go-pandorasbox/tool/mslice"
 	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"sync"
 )
 
 func NewStreamManager(nm map[string][]*NodeUnit) *StreamManager {
@@ -20,10 +21,23 @@ func NewStreamManager(nm map[string][]*NodeUnit) *StreamManager {
 }
 
 type StreamManager struct {
+	mux  sync.RWMutex
 	nm   map[string][]*NodeUnit
 	list []*NodeUnit
 }
 
+// Set replaces the node units, the streams already got are not affected.
+func (sm *StreamManager) Set(nm map[string][]*NodeUnit) {
+	var list []*NodeUnit
+	for _, units := range nm {
+		list = append(list, units...)
+	}
+	sm.mux.Lock()
+	defer sm.mux.Unlock()
+	sm.nm = nm
+	sm.list = list
+}
+
 func (sm *StreamManager) GetStream(ctx context.Context, node string, header string, data any) (*NodeUnit, xrpc.Stream, error) {
 	units, err := sm.getNodeUnit(node)
 	if err != nil {
@@ -50,6 +64,8 @@ func (sm *StreamManager) GetStream(ctx context.Context, node string, header stri
 }
 
 func (sm *StreamManager) getNodeUnit(node string) ([]*NodeUnit, error) {
+	sm.mux.RLock()
+	defer sm.mux.RUnlock()
 	if node == "" {
 		return sm.list, nil
 	}
@@ -210,3 +210,16 @@ func (c *Cmd) configClient2(ctx *xhttp.Context) error {
 	}
 	return ctx.WriteAny(cfg)
 }
+
+func (c *Cmd) detectClientNat(ctx *xhttp.Context) error {
+	var info IdData[any]
+	err := ctx.Bind(&info)
+	if err != nil {
+		return err
+	}
+	view, err := c._sdk.DetectClientNat(info.Id)
+	if err != nil {
+		return err
+	}
+	return ctx.WriteAny(view)
+}
@@ -256,6 +256,7 @@ func (c *Cmd) setHandler() {
 	c.XCmd.Set(CmdViewServerLink, c.stateHandler, c.serverLinkView)
 	c.XCmd.Set(CmdViewServerSync, c.stateHandler, c.serverSyncView)
 	c.XCmd.Set(CmdViewServerProxy, c.stateHandler, c.serverProxyView)
+	c.XCmd.Set(CmdViewServerTraffic, c.stateHandler, c.serverTrafficView)
 	c.XCmd.Set(CmdViewClient, c.stateHandler, c.clientView)
 	c.XCmd.Set(CmdViewClientUnit, c.stateHandler, c.clientView2)
 	c.XCmd.Set(CmdViewClientById, c.stateHandler, c.clientViewById)
@@ -266,14 +267,22 @@ func (c *Cmd) setHandler() {
 	c.XCmd.Set(CmdViewClientSession, c.stateHandler, c.clientSessionView)
 	c.XCmd.Set(CmdViewClientProxyT, c.stateHandler, c.clientProxyView)
 	c.XCmd.Set(CmdViewClientProxyTUnit, c.stateHandler, c.clientProxyUnitView)
+	c.XCmd.Set(CmdViewClientRoute, c.stateHandler, c.clientRouteView)
 
 	c.XCmd.Set(CmdAddServer, c.stateHandler, c.addServer)
 	c.XCmd.Set(CmdDelServer, c.stateHandler, c.delServer)
 	c.XCmd.Set(CmdStartServer, c.stateHandler, c.startServer)
 	c.XCmd.Set(CmdStopServer, c.stateHandler, c.stopServer)
+	c.XCmd.Set(CmdDrainServer, c.stateHandler, c.drainServer)
 	c.XCmd.Set(CmdReloadServer, c.stateHandler, c.reloadServer)
+	c.XCmd.Set(CmdReloadServerUsers, c.stateHandler, c.reloadServerUsers)
+	c.XCmd.Set(CmdResetServerTraffic, c.stateHandler, c.resetServerTraffic)
 	c.XCmd.Set(CmdUpdateServer, c.stateHandler, c.updateServer)
 	c.XCmd.Set(CmdConfigServer, c.stateHandler, c.configServer)
+	c.XCmd.Set(CmdAddServerSync, c.stateHandler, c.addServerSync)
+	c.XCmd.Set(CmdDelServerSync, c.stateHandler, c.delServerSync)
+	c.XCmd.Set(CmdPauseServerSync, c.stateHandler, c.pauseServerSync)
+	c.XCmd.Set(CmdResumeServerSync, c.stateHandler, c.resumeServerSync)
 
 	c.XCmd.Set(CmdAddClient, c.stateHandler, c.addClient)
 	c.XCmd.Set(CmdAddClientUnit, c.stateHandler, c.addClient2)
@@ -287,6 +296,7 @@ func (c *Cmd) setHandler() {
 	c.XCmd.Set(CmdUpdateClientUnit, c.stateHandler, c.updateClient2)
 	c.XCmd.Set(CmdConfigClient, c.stateHandler, c.configClient)
 	c.XCmd.Set(CmdConfigClientUnit, c.stateHandler, c.configClient2)
+	c.XCmd.Set(CmdDetectClientNat, c.stateHandler, c.detectClientNat)
 
 	c.XCmd.Set(CmdAddProxy, c.stateHandler, c.addProxy)
 	c.XCmd.Set(CmdDelProxy, c.stateHandler, c.delProxy)
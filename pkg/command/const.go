@@ -28,6 +28,7 @@ const (
 	CmdViewServerLink       = "view_server_link"
 	CmdViewServerSync       = "view_server_sync"
 	CmdViewServerProxy      = "view_server_proxy"
+	CmdViewServerTraffic    = "view_server_traffic"
 	CmdViewClient           = "view_client"
 	CmdViewClientUnit       = "view_client_unit"
 	CmdViewClientById       = "view_client_id"
@@ -38,14 +39,22 @@ const (
 	CmdViewClientSession    = "view_client_session"
 	CmdViewClientProxyT     = "view_client_proxyT"
 	CmdViewClientProxyTUnit = "view_client_proxyT_unit"
+	CmdViewClientRoute      = "view_client_route"
 
-	CmdAddServer    = "add_server"
-	CmdDelServer    = "del_server"
-	CmdStartServer  = "start_server"
-	CmdStopServer   = "stop_server"
-	CmdReloadServer = "reload_server"
-	CmdUpdateServer = "update_server"
-	CmdConfigServer = "config_server"
+	CmdAddServer          = "add_server"
+	CmdDelServer          = "del_server"
+	CmdStartServer        = "start_server"
+	CmdStopServer         = "stop_server"
+	CmdDrainServer        = "drain_server"
+	CmdReloadServer       = "reload_server"
+	CmdReloadServerUsers  = "reload_server_users"
+	CmdResetServerTraffic = "reset_server_traffic"
+	CmdUpdateServer       = "update_server"
+	CmdConfigServer       = "config_server"
+	CmdAddServerSync      = "add_server_sync"
+	CmdDelServerSync      = "del_server_sync"
+	CmdPauseServerSync    = "pause_server_sync"
+	CmdResumeServerSync   = "resume_server_sync"
 
 	CmdAddClient        = "add_client"
 	CmdAddClientUnit    = "add_client_unit"
@@ -59,6 +68,7 @@ const (
 	CmdUpdateClientUnit = "update_client_unit"
 	CmdConfigClient     = "config_client"
 	CmdConfigClientUnit = "config_client_unit"
+	CmdDetectClientNat  = "detect_client_nat"
 
 	CmdAddProxy    = "add_proxy"
 	CmdDelProxy    = "del_proxy"
@@ -97,10 +107,10 @@ const (
 var FlagList = []string{
 	CmdPing, CmdInfo,
 	CmdStop, CmdReload, CmdConfig, CmdUpdate,
-	CmdViewServer, CmdViewServerById, CmdViewServerSession, CmdViewServerRoute, CmdViewServerLink, CmdViewServerSync, CmdViewServerProxy,
-	CmdViewClient, CmdViewClientUnit, CmdViewClientById, CmdViewClientUnitById, CmdViewClientListenById, CmdViewClientDialById, CmdViewClientProxyById, CmdViewClientSession, CmdViewClientProxyT, CmdViewClientProxyTUnit,
-	CmdAddServer, CmdDelServer, CmdStartServer, CmdStopServer, CmdReloadServer, CmdUpdateServer, CmdConfigServer,
-	CmdAddClient, CmdAddClientUnit, CmdDelClient, CmdStartClient, CmdStartClientUnit, CmdStopClient, CmdReloadClient, CmdReloadClientUnit, CmdUpdateClient, CmdUpdateClientUnit, CmdConfigClient, CmdConfigClientUnit,
+	CmdViewServer, CmdViewServerById, CmdViewServerSession, CmdViewServerRoute, CmdViewServerLink, CmdViewServerSync, CmdViewServerProxy, CmdViewServerTraffic,
+	CmdViewClient, CmdViewClientUnit, CmdViewClientById, CmdViewClientUnitById, CmdViewClientListenById, CmdViewClientDialById, CmdViewClientProxyById, CmdViewClientSession, CmdViewClientProxyT, CmdViewClientProxyTUnit, CmdViewClientRoute,
+	CmdAddServer, CmdDelServer, CmdStartServer, CmdStopServer, CmdDrainServer, CmdReloadServer, CmdReloadServerUsers, CmdResetServerTraffic, CmdUpdateServer, CmdConfigServer, CmdAddServerSync, CmdDelServerSync, CmdPauseServerSync, CmdResumeServerSync,
+	CmdAddClient, CmdAddClientUnit, CmdDelClient, CmdStartClient, CmdStartClientUnit, CmdStopClient, CmdReloadClient, CmdReloadClientUnit, CmdUpdateClient, CmdUpdateClientUnit, CmdConfigClient, CmdConfigClientUnit, CmdDetectClientNat,
 	CmdAddProxy, CmdDelProxy, CmdStartProxy, CmdStopProxy, CmdReloadProxy, CmdUpdateProxy, CmdConfigProxy,
 	CmdAddListen, CmdDelListen, CmdStartListen, CmdStopListen, CmdReloadListen, CmdUpdateListen, CmdConfigListen,
 	CmdAddDial, CmdDelDial, CmdStartDial, CmdStopDial, CmdReloadDial, CmdUpdateDial, CmdConfigDial,
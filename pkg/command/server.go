@@ -2,9 +2,11 @@ package command
 
 import (
 	"errors"
+	"github.com/peakedshout/anchorage-core/pkg/config"
 	"github.com/peakedshout/anchorage-core/pkg/sdk"
 	"github.com/peakedshout/go-pandorasbox/tool/dcopy"
 	"github.com/peakedshout/go-pandorasbox/xnet/xtool/xhttp"
+	"time"
 )
 
 func (c *Cmd) addServer(ctx *xhttp.Context) error {
@@ -54,15 +56,45 @@ func (c *Cmd) stopServer(ctx *xhttp.Context) error {
 	return c._sdk.StopServer(info.Id)
 }
 
+func (c *Cmd) drainServer(ctx *xhttp.Context) error {
+	var info IdData[uint]
+	err := ctx.Bind(&info)
+	if err != nil {
+		return err
+	}
+	return c._sdk.DrainServer(info.Id, time.Duration(info.Data)*time.Millisecond)
+}
+
 func (c *Cmd) reloadServer(ctx *xhttp.Context) error {
-	var info IdData[any]
+	var info IdData[uint]
 	err := ctx.Bind(&info)
 	if err != nil {
 		return err
 	}
+	if info.Data != 0 {
+		return c._sdk.DrainReloadServer(info.Id, time.Duration(info.Data)*time.Millisecond)
+	}
 	return c._sdk.ReloadServer(info.Id)
 }
 
+func (c *Cmd) reloadServerUsers(ctx *xhttp.Context) error {
+	var info IdData[any]
+	err := ctx.Bind(&info)
+	if err != nil {
+		return err
+	}
+	return c._sdk.ReloadServerUsers(info.Id)
+}
+
+func (c *Cmd) resetServerTraffic(ctx *xhttp.Context) error {
+	var info IdSubData[string, string]
+	err := ctx.Bind(&info)
+	if err != nil {
+		return err
+	}
+	return c._sdk.ResetServerTraffic(info.Id, info.Sub, info.Data)
+}
+
 func (c *Cmd) updateServer(ctx *xhttp.Context) error {
 	var info IdData[*sdk.ServerConfig]
 	err := ctx.Bind(&info)
@@ -93,3 +125,42 @@ func (c *Cmd) configServer(ctx *xhttp.Context) error {
 	}
 	return ctx.WriteAny(cfg)
 }
+
+func (c *Cmd) addServerSync(ctx *xhttp.Context) error {
+	var info IdData[*config.NodeConfig]
+	err := ctx.Bind(&info)
+	if err != nil {
+		return err
+	}
+	if info.Data == nil {
+		return errors.New("nil data")
+	}
+	return c._sdk.AddServerSyncNode(info.Id, *info.Data)
+}
+
+func (c *Cmd) delServerSync(ctx *xhttp.Context) error {
+	var info IdData[string]
+	err := ctx.Bind(&info)
+	if err != nil {
+		return err
+	}
+	return c._sdk.DelServerSyncNode(info.Id, info.Data)
+}
+
+func (c *Cmd) pauseServerSync(ctx *xhttp.Context) error {
+	var info IdData[string]
+	err := ctx.Bind(&info)
+	if err != nil {
+		return err
+	}
+	return c._sdk.PauseServerSyncNode(info.Id, info.Data, true)
+}
+
+func (c *Cmd) resumeServerSync(ctx *xhttp.Context) error {
+	var info IdData[string]
+	err := ctx.Bind(&info)
+	if err != nil {
+		return err
+	}
+	return c._sdk.PauseServerSyncNode(info.Id, info.Data, false)
+}
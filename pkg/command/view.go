@@ -1,6 +1,9 @@
 package command
 
-import "github.com/peakedshout/go-pandorasbox/xnet/xtool/xhttp"
+import (
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/go-pandorasbox/xnet/xtool/xhttp"
+)
 
 func (c *Cmd) serverView(ctx *xhttp.Context) error {
 	view := c._sdk.GetServerView()
@@ -65,7 +68,7 @@ func (c *Cmd) serverSyncView(ctx *xhttp.Context) error {
 	if err != nil {
 		return err
 	}
-	view, err := c._sdk.GetServerSyncView(info.Id)
+	view, err := c._sdk.GetServerSyncView2(info.Id)
 	if err != nil {
 		return err
 	}
@@ -78,7 +81,20 @@ func (c *Cmd) serverProxyView(ctx *xhttp.Context) error {
 	if err != nil {
 		return err
 	}
-	view, err := c._sdk.GetServerProxyView(info.Id)
+	view, err := c._sdk.GetServerProxyView2(info.Id)
+	if err != nil {
+		return err
+	}
+	return ctx.WriteAny(view)
+}
+
+func (c *Cmd) serverTrafficView(ctx *xhttp.Context) error {
+	var info IdData[any]
+	err := ctx.Bind(&info)
+	if err != nil {
+		return err
+	}
+	view, err := c._sdk.GetServerTrafficView(info.Id)
 	if err != nil {
 		return err
 	}
@@ -166,7 +182,7 @@ func (c *Cmd) clientSessionView(ctx *xhttp.Context) error {
 	if err != nil {
 		return err
 	}
-	view, err := c._sdk.GetClientSessionView(info.Id)
+	view, err := c._sdk.GetClientSessionView2(info.Id)
 	if err != nil {
 		return err
 	}
@@ -198,3 +214,16 @@ func (c *Cmd) clientProxyUnitView(ctx *xhttp.Context) error {
 	}
 	return ctx.WriteAny(view)
 }
+
+func (c *Cmd) clientRouteView(ctx *xhttp.Context) error {
+	var info IdData[comm.ServiceRouteQuery]
+	err := ctx.Bind(&info)
+	if err != nil {
+		return err
+	}
+	view, err := c._sdk.QueryClientRoute(info.Id, info.Data)
+	if err != nil {
+		return err
+	}
+	return ctx.WriteAny(view)
+}
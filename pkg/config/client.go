@@ -1,9 +1,15 @@
 package config
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
 
 type ClientConfig struct {
-	Nodes []NodeConfig `json:"nodes" yaml:"nodes" comment:"dial to server node list"`
+	Nodes       []NodeConfig `json:"nodes" yaml:"nodes" comment:"dial to server node list"`
+	FailBack    uint         `json:"failBack" yaml:"failBack" comment:"interval of moving listeners back to a healthy node of smaller priority (unit ms), 0 is never"`
+	PortPredict uint         `json:"portPredict" yaml:"portPredict" comment:"count of the predicted ports on each side of the public port added to the p2p candidates, 0 is off"`
 }
 
 func (cc *ClientConfig) Check() error {
@@ -16,3 +22,41 @@ func (cc *ClientConfig) Check() error {
 	}
 	return errors.Join(errs...)
 }
+
+const (
+	RetryErrorService = "service" // the service is not found, e.g. its listener is registering again
+	RetryErrorNode    = "node"    // no node accepted the link request
+	RetryErrorStream  = "stream"  // the link stream or the p2p connection failed to set up
+	RetryErrorDenied  = "denied"  // the link is refused, e.g. permission denied or quota exceeded
+)
+
+// DefaultRetryErrors are the retryable error classes when none is configured.
+var DefaultRetryErrors = []string{RetryErrorService, RetryErrorNode, RetryErrorStream}
+
+type DialRetryConfig struct {
+	Attempts   uint     `json:"attempts" yaml:"attempts" comment:"max attempts of a link, 0 or 1 is no retry"`
+	Timeout    uint     `json:"timeout" yaml:"timeout" comment:"time out of each attempt (unit ms), 0 is none"`
+	Min        uint     `json:"min" yaml:"min" comment:"first retry delay (unit ms), 0 is 200"`
+	Max        uint     `json:"max" yaml:"max" comment:"max retry delay (unit ms), 0 is 5000"`
+	Multiplier float64  `json:"multiplier" yaml:"multiplier" comment:"delay growth of each retry, 0 is 2"`
+	Errors     []string `json:"errors" yaml:"errors" comment:"retryable error classes (service,node,stream,denied), empty is service,node,stream"`
+}
+
+func (drc *DialRetryConfig) Check() error {
+	if drc == nil {
+		return errors.New("nil dial retry config")
+	}
+	var errs []error
+	if drc.Max != 0 && drc.Max < drc.Min {
+		errs = append(errs, fmt.Errorf("dial retry max less than min: %d < %d", drc.Max, drc.Min))
+	}
+	if drc.Multiplier != 0 && drc.Multiplier < 1 {
+		errs = append(errs, fmt.Errorf("invalid dial retry multiplier: %v", drc.Multiplier))
+	}
+	for _, one := range drc.Errors {
+		if !slices.Contains(DefaultRetryErrors, one) && one != RetryErrorDenied {
+			errs = append(errs, fmt.Errorf("invalid dial retry error: %s", one))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -6,14 +6,38 @@ import (
 	"github.com/peakedshout/go-pandorasbox/pcrypto"
 	"github.com/peakedshout/go-pandorasbox/xnet"
 	"net"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ServerConfig struct {
-	NodeInfo         NodeConfig   `json:"nodeInfo" yaml:"nodeInfo" comment:"current server node config"`
-	SyncNodes        []NodeConfig `json:"syncNodes" yaml:"syncNodes" comment:"sync server node config"`
-	SyncTimeInterval uint         `json:"syncTimeInterval" yaml:"syncTimeInterval" comment:"sync server time interval (unit ms)"` // ms
-	LinkTimeout      uint         `json:"linkTimeout" yaml:"linkTimeout" comment:"link time out (unit ms)"`                       // ms
-	ProxyMulti       int          `json:"proxyMulti" yaml:"proxyMulti" comment:"whether support proxy multi io count to link"`
+	NodeInfo           NodeConfig            `json:"nodeInfo" yaml:"nodeInfo" comment:"current server node config"`
+	SyncNodes          []NodeConfig          `json:"syncNodes" yaml:"syncNodes" comment:"sync server node config"`
+	SyncTimeInterval   uint                  `json:"syncTimeInterval" yaml:"syncTimeInterval" comment:"sync server time interval (unit ms)"` // ms
+	SyncMaxHop         uint                  `json:"syncMaxHop" yaml:"syncMaxHop" comment:"max hop count of the routes propagated between sync servers (default 8)"`
+	SyncPaused         []string              `json:"syncPaused" yaml:"syncPaused" comment:"names of the sync nodes not synced for now"`
+	SyncBackoff        *SyncBackoffConfig    `json:"syncBackoff" yaml:"syncBackoff" comment:"retry backoff of the broken sync connections"`
+	LinkTimeout        uint                  `json:"linkTimeout" yaml:"linkTimeout" comment:"link time out (unit ms)"` // ms
+	IdleTimeout        uint                  `json:"idleTimeout" yaml:"idleTimeout" comment:"close links and proxies without data for the time (unit ms), 0 is never"`
+	KeepAlive          uint                  `json:"keepAlive" yaml:"keepAlive" comment:"keepalive probe interval of links and proxies (unit ms, min 5000), 0 is off"`
+	ProxyMulti         int                   `json:"proxyMulti" yaml:"proxyMulti" comment:"whether support proxy multi io count to link"`
+	ServiceOwners      []ServiceOwnerConfig  `json:"serviceOwners" yaml:"serviceOwners" comment:"service name owner list; unlisted names are owned by the first registrant"`
+	Users              []UserConfig          `json:"users" yaml:"users" comment:"node auth user list, works together with nodeInfo.auth"`
+	UsersFile          string                `json:"usersFile" yaml:"usersFile" comment:"node auth user list file (yaml or json), merged with users"`
+	DefaultRoles       []string              `json:"defaultRoles" yaml:"defaultRoles" comment:"roles of nodeInfo.auth user and sessions without auth (register,link,proxy,sync,view or * for all), empty is all"`
+	DisableProxy       bool                  `json:"disableProxy" yaml:"disableProxy" comment:"turn off the proxy for everyone"`
+	DisableRouteView   bool                  `json:"disableRouteView" yaml:"disableRouteView" comment:"turn off the route view for everyone"`
+	ProxyPolicy        []ProxyPolicyConfig   `json:"proxyPolicy" yaml:"proxyPolicy" comment:"ordered egress rules of the proxy, the first matched rule wins"`
+	ProxyPolicyDefault string                `json:"proxyPolicyDefault" yaml:"proxyPolicyDefault" comment:"action when no rule matched (allow,deny), empty is allow"`
+	ProxyUpstreams     []ProxyUpstreamConfig `json:"proxyUpstreams" yaml:"proxyUpstreams" comment:"upstream proxies the proxy may dial through"`
+	ProxyRoutes        []ProxyRouteConfig    `json:"proxyRoutes" yaml:"proxyRoutes" comment:"ordered rules choosing the upstream chain of the proxy, no matched rule is direct"`
+	RateLimit          *RateLimitConfig      `json:"rateLimit" yaml:"rateLimit" comment:"bandwidth limit of links and proxies, each direction is limited separately"`
+	Traffic            *TrafficConfig        `json:"traffic" yaml:"traffic" comment:"traffic accounting and quotas"`
+	Resolver           *ResolverConfig       `json:"resolver" yaml:"resolver" comment:"dns resolver of the proxy"`
 }
 
 func (sc *ServerConfig) Check() error {
@@ -25,9 +49,398 @@ func (sc *ServerConfig) Check() error {
 	for _, node := range sc.SyncNodes {
 		errs = append(errs, node.Check())
 	}
+	for _, name := range sc.SyncPaused {
+		if !slices.ContainsFunc(sc.SyncNodes, func(node NodeConfig) bool { return node.NodeName == name }) {
+			errs = append(errs, fmt.Errorf("not found paused sync node: %s", name))
+		}
+	}
+	if sc.SyncBackoff != nil {
+		errs = append(errs, sc.SyncBackoff.Check())
+	}
+	for _, one := range sc.ServiceOwners {
+		errs = append(errs, one.Check())
+	}
+	for _, one := range sc.Users {
+		errs = append(errs, one.Check())
+	}
+	errs = append(errs, CheckRoles(sc.DefaultRoles))
+	for _, one := range sc.ProxyPolicy {
+		errs = append(errs, one.Check())
+	}
+	for _, one := range sc.ProxyUpstreams {
+		errs = append(errs, one.Check())
+	}
+	for _, one := range sc.ProxyRoutes {
+		errs = append(errs, one.Check())
+	}
+	if sc.RateLimit != nil {
+		errs = append(errs, sc.RateLimit.Check())
+	}
+	if sc.Traffic != nil {
+		errs = append(errs, sc.Traffic.Check())
+	}
+	if sc.Resolver != nil {
+		errs = append(errs, sc.Resolver.Check())
+	}
+	switch sc.ProxyPolicyDefault {
+	case "", PolicyAllow, PolicyDeny:
+	default:
+		errs = append(errs, fmt.Errorf("invalid proxy policy default: %s", sc.ProxyPolicyDefault))
+	}
 	return errors.Join(errs...)
 }
 
+type SyncBackoffConfig struct {
+	Min        uint    `json:"min" yaml:"min" comment:"first retry delay (unit ms), 0 is 1000"`
+	Max        uint    `json:"max" yaml:"max" comment:"max retry delay (unit ms), 0 is 60000"`
+	Multiplier float64 `json:"multiplier" yaml:"multiplier" comment:"delay growth of each failure, 0 is 2"`
+	Jitter     float64 `json:"jitter" yaml:"jitter" comment:"random part of the delay (0-1), 0 is none"`
+}
+
+func (sbc *SyncBackoffConfig) Check() error {
+	if sbc == nil {
+		return errors.New("nil sync backoff config")
+	}
+	var errs []error
+	if sbc.Max != 0 && sbc.Max < sbc.Min {
+		errs = append(errs, fmt.Errorf("sync backoff max less than min: %d < %d", sbc.Max, sbc.Min))
+	}
+	if sbc.Multiplier != 0 && sbc.Multiplier < 1 {
+		errs = append(errs, fmt.Errorf("invalid sync backoff multiplier: %v", sbc.Multiplier))
+	}
+	if sbc.Jitter < 0 || sbc.Jitter > 1 {
+		errs = append(errs, fmt.Errorf("invalid sync backoff jitter: %v", sbc.Jitter))
+	}
+	return errors.Join(errs...)
+}
+
+type ServiceOwnerConfig struct {
+	Name   string   `json:"name" yaml:"name" comment:"service name (support glob pattern)"`
+	Owners []string `json:"owners" yaml:"owners" comment:"usernames that own the service name"`
+}
+
+func (soc *ServiceOwnerConfig) Check() error {
+	if soc == nil {
+		return errors.New("nil service owner config")
+	}
+	var errs []error
+	if soc.Name == "" {
+		errs = append(errs, errors.New("nil service name"))
+	} else if _, err := path.Match(soc.Name, ""); err != nil {
+		errs = append(errs, fmt.Errorf("invalid service name pattern: %s", soc.Name))
+	}
+	if len(soc.Owners) == 0 {
+		errs = append(errs, errors.New("nil service owners"))
+	}
+	return errors.Join(errs...)
+}
+
+type RateLimitConfig struct {
+	Server   int64            `json:"server" yaml:"server" comment:"total rate of the server (unit byte/s), 0 is unlimited"`
+	User     int64            `json:"user" yaml:"user" comment:"rate of each user (unit byte/s), 0 is unlimited"`
+	Service  int64            `json:"service" yaml:"service" comment:"rate of each service name (unit byte/s), 0 is unlimited"`
+	Link     int64            `json:"link" yaml:"link" comment:"rate of each link or proxy stream (unit byte/s), 0 is unlimited"`
+	Users    map[string]int64 `json:"users" yaml:"users" comment:"rate of the specified users, overrides user"`
+	Services map[string]int64 `json:"services" yaml:"services" comment:"rate of the specified service names, overrides service"`
+}
+
+func (rlc *RateLimitConfig) Check() error {
+	if rlc == nil {
+		return errors.New("nil rate limit config")
+	}
+	if rlc.Server < 0 || rlc.User < 0 || rlc.Service < 0 || rlc.Link < 0 {
+		return errors.New("negative rate limit")
+	}
+	for _, m := range []map[string]int64{rlc.Users, rlc.Services} {
+		for k, v := range m {
+			if v < 0 {
+				return fmt.Errorf("negative rate limit: %s", k)
+			}
+		}
+	}
+	return nil
+}
+
+type TrafficConfig struct {
+	File         string               `json:"file" yaml:"file" comment:"file to save the counters, empty only keeps them in memory"`
+	SaveInterval uint                 `json:"saveInterval" yaml:"saveInterval" comment:"save interval (unit ms), default 60000"` // ms
+	Quotas       []TrafficQuotaConfig `json:"quotas" yaml:"quotas" comment:"traffic quota list, new links are refused once exceeded"`
+}
+
+func (tc *TrafficConfig) Check() error {
+	if tc == nil {
+		return errors.New("nil traffic config")
+	}
+	var errs []error
+	for _, one := range tc.Quotas {
+		errs = append(errs, one.Check())
+	}
+	return errors.Join(errs...)
+}
+
+type TrafficQuotaConfig struct {
+	Kind    string `json:"kind" yaml:"kind" comment:"must be user, service or node"`
+	Name    string `json:"name" yaml:"name" comment:"name of the kind (support glob pattern, empty is all), each matched name has its own quota"`
+	Daily   int64  `json:"daily" yaml:"daily" comment:"bytes of upload and download per day, 0 is unlimited"`
+	Monthly int64  `json:"monthly" yaml:"monthly" comment:"bytes of upload and download per month, 0 is unlimited"`
+}
+
+func (tqc *TrafficQuotaConfig) Check() error {
+	if tqc == nil {
+		return errors.New("nil traffic quota config")
+	}
+	var errs []error
+	switch tqc.Kind {
+	case "user", "service", "node":
+	default:
+		errs = append(errs, fmt.Errorf("invalid traffic quota kind: %s", tqc.Kind))
+	}
+	if _, err := path.Match(tqc.Name, ""); err != nil {
+		errs = append(errs, fmt.Errorf("invalid traffic quota name pattern: %s", tqc.Name))
+	}
+	if tqc.Daily < 0 || tqc.Monthly < 0 {
+		errs = append(errs, errors.New("negative traffic quota"))
+	}
+	return errors.Join(errs...)
+}
+
+const (
+	ResolverUdp   = "udp"
+	ResolverTcp   = "tcp"
+	ResolverTls   = "tls"
+	ResolverHttps = "https"
+)
+
+type ResolverConfig struct {
+	Upstreams  []ResolverUpstreamConfig `json:"upstreams" yaml:"upstreams" comment:"dns servers tried in order, empty is the system resolver"`
+	PreferIPv4 bool                     `json:"preferIPv4" yaml:"preferIPv4" comment:"try ipv4 addresses first, default is ipv6 first"`
+	MaxTTL     uint                     `json:"maxTTL" yaml:"maxTTL" comment:"max cache time of an answer (unit s), 0 follows the record ttl"`
+}
+
+func (rc *ResolverConfig) Check() error {
+	if rc == nil {
+		return errors.New("nil resolver config")
+	}
+	var errs []error
+	for _, one := range rc.Upstreams {
+		errs = append(errs, one.Check())
+	}
+	return errors.Join(errs...)
+}
+
+type ResolverUpstreamConfig struct {
+	Network     string `json:"network" yaml:"network" comment:"must be udp, tcp, tls or https"`
+	Address     string `json:"address" yaml:"address" comment:"dns server address (host:port), or the url of https"`
+	InsecureTls bool   `json:"insecureTls" yaml:"insecureTls" comment:"skip the certificate verify of tls and https"`
+}
+
+func (ruc *ResolverUpstreamConfig) Check() error {
+	if ruc == nil {
+		return errors.New("nil resolver upstream config")
+	}
+	switch ruc.Network {
+	case ResolverUdp, ResolverTcp, ResolverTls:
+		if _, _, err := net.SplitHostPort(ruc.Address); err != nil {
+			return fmt.Errorf("invalid resolver address: %s", ruc.Address)
+		}
+	case ResolverHttps:
+		u, err := url.Parse(ruc.Address)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid resolver url: %s", ruc.Address)
+		}
+	default:
+		return fmt.Errorf("invalid resolver network: %s", ruc.Network)
+	}
+	return nil
+}
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+type ProxyPolicyConfig struct {
+	Action  string   `json:"action" yaml:"action" comment:"must be allow or deny"`
+	Users   []string `json:"users" yaml:"users" comment:"usernames of the rule, empty is all"`
+	Network []string `json:"network" yaml:"network" comment:"tcp,udp,quic, empty is all"`
+	CIDR    []string `json:"cidr" yaml:"cidr" comment:"target ip or ip range after dns resolution, empty is all"`
+	Ports   []string `json:"ports" yaml:"ports" comment:"target port or port range (80, 8000-9000), empty is all"`
+	Domains []string `json:"domains" yaml:"domains" comment:"target domain suffix, empty is all"`
+}
+
+func (ppc *ProxyPolicyConfig) Check() error {
+	if ppc == nil {
+		return errors.New("nil proxy policy config")
+	}
+	var errs []error
+	if ppc.Action != PolicyAllow && ppc.Action != PolicyDeny {
+		errs = append(errs, fmt.Errorf("invalid proxy policy action: %s", ppc.Action))
+	}
+	errs = append(errs, checkProxyMatch(ppc.Network, ppc.CIDR, ppc.Ports)...)
+	return errors.Join(errs...)
+}
+
+func checkProxyMatch(network, cidr, ports []string) []error {
+	var errs []error
+	for _, one := range network {
+		switch one {
+		case "tcp", "udp", "quic":
+		default:
+			errs = append(errs, fmt.Errorf("not support network: %s", one))
+		}
+	}
+	for _, one := range cidr {
+		_, err := ParseCIDR(one)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, one := range ports {
+		_, _, err := ParsePortRange(one)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+const (
+	UpstreamSocks5 = "socks5"
+	UpstreamHttp   = "http"
+)
+
+type ProxyUpstreamConfig struct {
+	Name    string    `json:"name" yaml:"name" comment:"upstream name used by proxyRoutes"`
+	Type    string    `json:"type" yaml:"type" comment:"must be socks5 or http (http connect)"`
+	Address string    `json:"address" yaml:"address" comment:"upstream proxy address (host:port)"`
+	Auth    *AuthInfo `json:"auth" yaml:"auth" comment:"upstream proxy auth ( username  password )"`
+}
+
+func (puc *ProxyUpstreamConfig) Check() error {
+	if puc == nil {
+		return errors.New("nil proxy upstream config")
+	}
+	var errs []error
+	if puc.Name == "" {
+		errs = append(errs, errors.New("nil proxy upstream name"))
+	}
+	if puc.Type != UpstreamSocks5 && puc.Type != UpstreamHttp {
+		errs = append(errs, fmt.Errorf("invalid proxy upstream type: %s", puc.Type))
+	}
+	if _, _, err := net.SplitHostPort(puc.Address); err != nil {
+		errs = append(errs, fmt.Errorf("invalid proxy upstream address: %s", puc.Address))
+	}
+	return errors.Join(errs...)
+}
+
+type ProxyRouteConfig struct {
+	Chain   []string `json:"chain" yaml:"chain" comment:"upstream names dialed in order, empty is direct"`
+	Users   []string `json:"users" yaml:"users" comment:"usernames of the rule, empty is all"`
+	Network []string `json:"network" yaml:"network" comment:"tcp,udp,quic, empty is all"`
+	CIDR    []string `json:"cidr" yaml:"cidr" comment:"target ip or ip range after dns resolution, empty is all"`
+	Ports   []string `json:"ports" yaml:"ports" comment:"target port or port range (80, 8000-9000), empty is all"`
+	Domains []string `json:"domains" yaml:"domains" comment:"target domain suffix, empty is all"`
+}
+
+func (prc *ProxyRouteConfig) Check() error {
+	if prc == nil {
+		return errors.New("nil proxy route config")
+	}
+	return errors.Join(checkProxyMatch(prc.Network, prc.CIDR, prc.Ports)...)
+}
+
+// ParseCIDR parses an ip range, a single ip is taken as a full length mask.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid cidr: %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr: %s", s)
+	}
+	return ipNet, nil
+}
+
+// ParsePortRange parses a port (80) or a port range (8000-9000).
+func ParsePortRange(s string) (uint16, uint16, error) {
+	ls, rs, ok := strings.Cut(s, "-")
+	if !ok {
+		rs = ls
+	}
+	l, err1 := strconv.ParseUint(strings.TrimSpace(ls), 10, 16)
+	r, err2 := strconv.ParseUint(strings.TrimSpace(rs), 10, 16)
+	if err1 != nil || err2 != nil || l > r {
+		return 0, 0, fmt.Errorf("invalid port range: %s", s)
+	}
+	return uint16(l), uint16(r), nil
+}
+
+const (
+	RoleRegister = "register"
+	RoleLink     = "link"
+	RoleProxy    = "proxy"
+	RoleSync     = "sync"
+	RoleView     = "view"
+	RoleAll      = "*"
+)
+
+func CheckRoles(roles []string) error {
+	for _, role := range roles {
+		switch role {
+		case RoleRegister, RoleLink, RoleProxy, RoleSync, RoleView, RoleAll:
+		default:
+			return fmt.Errorf("invalid role: %s", role)
+		}
+	}
+	return nil
+}
+
+type UserConfig struct {
+	UserName string   `json:"username" yaml:"username" comment:"must be"`
+	Password string   `json:"password" yaml:"password" comment:"password hash, must be bcrypt ($2a$...) or argon2id ($argon2id$...)"`
+	Disable  bool     `json:"disable" yaml:"disable" comment:"refuse the user to auth"`
+	ExpireAt string   `json:"expireAt" yaml:"expireAt" comment:"expire time (RFC3339), empty is never"`
+	Roles    []string `json:"roles" yaml:"roles" comment:"allowed calls of the user (register,link,proxy,sync,view or * for all), empty is none"`
+}
+
+func (uc *UserConfig) Check() error {
+	if uc == nil {
+		return errors.New("nil user config")
+	}
+	var errs []error
+	if uc.UserName == "" {
+		errs = append(errs, errors.New("nil username"))
+	}
+	if !strings.HasPrefix(uc.Password, "$2a$") && !strings.HasPrefix(uc.Password, "$2b$") &&
+		!strings.HasPrefix(uc.Password, "$2y$") && !strings.HasPrefix(uc.Password, "$argon2id$") {
+		errs = append(errs, fmt.Errorf("invalid password hash of user: %s", uc.UserName))
+	}
+	if uc.ExpireAt != "" {
+		_, err := time.Parse(time.RFC3339, uc.ExpireAt)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid expire time of user: %s", uc.UserName))
+		}
+	}
+	errs = append(errs, CheckRoles(uc.Roles))
+	return errors.Join(errs...)
+}
+
+// Expired reports whether the user is expired at t.
+func (uc *UserConfig) Expired(t time.Time) bool {
+	if uc.ExpireAt == "" {
+		return false
+	}
+	et, err := time.Parse(time.RFC3339, uc.ExpireAt)
+	return err != nil || !t.Before(et)
+}
+
 type NodeConfig struct {
 	NodeName         string              `json:"nodeName" yaml:"nodeName" comment:"must be"`
 	BaseNetwork      []BaseNetworkConfig `json:"baseNetwork" yaml:"baseNetwork"  comment:"base network list"`
@@ -35,7 +448,10 @@ type NodeConfig struct {
 	Crypto           []CryptoConfig      `json:"crypto" yaml:"crypto" comment:"crypto config"`
 	HandshakeTimeout uint                `json:"handshakeTimeout" yaml:"handshakeTimeout" comment:"handshake timeout (unit ms)"` // ms
 	HandleTimeout    uint                `json:"handleTimeout" yaml:"handleTimeout" comment:"handle timeout (unit ms)"`          // ms
+	Priority         int                 `json:"priority" yaml:"priority" comment:"listener registration priority of the client, smaller is preferred"`
+	Weight           int                 `json:"weight" yaml:"weight" comment:"listener registration weight of the client among the same priority, 0 is 1"`
 	Auth             *AuthInfo           `json:"auth" yaml:"auth" comment:"node auth ( username  password )"`
+	UserAuth         bool                `json:"userAuth" yaml:"userAuth" comment:"the node checks auth by its users (password hashes), the password is sent in the handshake then"`
 }
 
 func (nc *NodeConfig) Check() error {
@@ -55,6 +471,9 @@ func (nc *NodeConfig) Check() error {
 	for _, one := range nc.Crypto {
 		errs = append(errs, one.Check())
 	}
+	if nc.Weight < 0 {
+		errs = append(errs, fmt.Errorf("invalid node weight: %d", nc.Weight))
+	}
 	return errors.Join(errs...)
 }
 
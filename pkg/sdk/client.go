@@ -1,13 +1,16 @@
 package sdk
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/peakedshout/anchorage-core/pkg/client"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
 	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
 	"github.com/peakedshout/go-pandorasbox/tool/dcopy"
 	"github.com/peakedshout/go-pandorasbox/xrpc"
 	"sync"
+	"time"
 )
 
 func (sm *sdkManager) handleClient() error {
@@ -379,7 +382,22 @@ func (sm *sdkManager) GetConfigClient2(id string) (*ClientConfigUnit, error) {
 	return cfg, nil
 }
 
-func (sm *sdkManager) GetClientSessionView(id string) (view map[string][]xrpc.SessionView, err error) {
+func (sm *sdkManager) GetClientSessionView(id string) (map[string][]xrpc.SessionView, error) {
+	view, err := sm.GetClientSessionView2(id)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][]xrpc.SessionView, len(view))
+	for node, list := range view {
+		for _, one := range list {
+			m[node] = append(m[node], one.SessionView)
+		}
+	}
+	return m, nil
+}
+
+// GetClientSessionView2 is GetClientSessionView with the nat type of the udp sessions.
+func (sm *sdkManager) GetClientSessionView2(id string) (view map[string][]client.SessionUnitView, err error) {
 	err = sm.getClient(id, func(sdk *clientSdk) error {
 		view, err = sdk.getSessionView()
 		return err
@@ -401,6 +419,35 @@ func (sm *sdkManager) GetClientProxyView(id string) (view map[string][]client.Pr
 	return view, nil
 }
 
+// DetectClientNat probes the nodes of the client for its udp nat type now.
+func (sm *sdkManager) DetectClientNat(id string) (*comm.NatView, error) {
+	var c *client.Client
+	err := sm.getClient(id, func(sdk *clientSdk) (err error) {
+		c, err = sdk.getClient()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cl := context.WithTimeout(sm.context(), 30*time.Second)
+	defer cl()
+	return c.DetectNat(ctx), nil
+}
+
+func (sm *sdkManager) QueryClientRoute(id string, query comm.ServiceRouteQuery) (*comm.ServiceRouteQueryResult, error) {
+	var c *client.Client
+	err := sm.getClient(id, func(sdk *clientSdk) (err error) {
+		c, err = sdk.getClient()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cl := context.WithTimeout(sm.context(), 10*time.Second)
+	defer cl()
+	return c.QueryServiceRoute(ctx, query)
+}
+
 func (sm *sdkManager) getClient(id string, fn func(sdk *clientSdk) error) error {
 	defer sm.Lock().Unlock()
 	index := findIndex(sm.cList, id)
@@ -545,7 +592,7 @@ func (cs *clientSdk) getConfig2() *ClientConfigUnit {
 	return dcopy.CopyT(cs.config.ClientConfigUnit)
 }
 
-func (cs *clientSdk) getSessionView() (map[string][]xrpc.SessionView, error) {
+func (cs *clientSdk) getSessionView() (map[string][]client.SessionUnitView, error) {
 	cs.mux.Lock()
 	defer cs.mux.Unlock()
 	if !cs.status {
@@ -554,6 +601,15 @@ func (cs *clientSdk) getSessionView() (map[string][]xrpc.SessionView, error) {
 	return cs.client.GetClientSessionView(), nil
 }
 
+func (cs *clientSdk) getClient() (*client.Client, error) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	if !cs.status {
+		return nil, errors.New("no running")
+	}
+	return cs.client, nil
+}
+
 func (cs *clientSdk) getProxyView() (map[string][]client.ProxyUnitView, error) {
 	cs.mux.Lock()
 	defer cs.mux.Unlock()
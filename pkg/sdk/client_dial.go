@@ -15,6 +15,8 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func (sm *sdkManager) AddDial(id string, cfg *DialConfig) (string, error) {
@@ -171,9 +173,12 @@ type dialSdk struct {
 	id     string
 	cs     *clientSdk
 	mux    sync.Mutex
-	ln     net.Listener
+	ln     io.Closer
 	config *DialConfig
 	status bool
+
+	retries  atomic.Uint64 // retried attempts of the links
+	failures atomic.Uint64 // links failed after all attempts
 }
 
 func (ds *dialSdk) GetId() string {
@@ -204,16 +209,29 @@ func (ds *dialSdk) run(lock, reload bool) (err error) {
 	if ds.config.InNetwork == nil {
 		return errors.New("nil in network")
 	}
-	lc, err := xnet.GetBaseStreamListenerConfig(ds.config.InNetwork.Network)
-	if err != nil {
-		return err
-	}
-	ln, err := lc.ListenContext(ctx, ds.config.InNetwork.Network, ds.config.InNetwork.Address)
-	if err != nil {
-		return err
+	packet := isPacketNetwork(ds.config.InNetwork.Network)
+	var ln net.Listener
+	var pc net.PacketConn
+	var closer io.Closer
+	if packet {
+		pc, err = new(net.ListenConfig).ListenPacket(ctx, ds.config.InNetwork.Network, ds.config.InNetwork.Address)
+		if err != nil {
+			return err
+		}
+		closer = pc
+	} else {
+		lc, err := xnet.GetBaseStreamListenerConfig(ds.config.InNetwork.Network)
+		if err != nil {
+			return err
+		}
+		ln, err = lc.ListenContext(ctx, ds.config.InNetwork.Network, ds.config.InNetwork.Address)
+		if err != nil {
+			return err
+		}
+		closer = ln
 	}
 	ctxtool.GWaitFunc(ctx, func() {
-		_ = ln.Close()
+		_ = closer.Close()
 	})
 
 	// plugin
@@ -240,6 +258,9 @@ func (ds *dialSdk) run(lock, reload bool) (err error) {
 	if len(plugins) == 0 && out == nil {
 		return errors.New("nil dst network and address")
 	}
+	if packet && (len(plugins) != 0 || !isPacketNetwork(out.Network)) {
+		return errors.New("udp in network needs an udp out network and no plugin")
+	}
 
 	linkReq := comm.LinkRequest{
 		Node:        dcopy.CopyT(ds.config.Node),
@@ -251,17 +272,26 @@ func (ds *dialSdk) run(lock, reload bool) (err error) {
 		Auth:        dcopy.CopyT(ds.config.Auth),
 	}
 
+	retry := dcopy.CopyT(ds.config.Retry)
+	dial := func(ctx context.Context) (net.Conn, error) {
+		conn, err := ds.cs.client.DialRetry(ctx, linkReq, retry, func(int, error) {
+			ds.retries.Add(1)
+		})
+		if err != nil {
+			ds.failures.Add(1)
+		}
+		return conn, err
+	}
+
 	//multi
 	var toDialer func(ctx context.Context) (net.Conn, error)
 	var fn func()
 	if ds.config.Multi < 0 {
-		toDialer = func(ctx context.Context) (net.Conn, error) {
-			return ds.cs.client.Dial(ctx, linkReq)
-		}
+		toDialer = dial
 		fn = func() {}
 	} else {
 		dFunc := func(nctx context.Context) (io.ReadWriteCloser, error) {
-			return ds.cs.client.Dial(ctx, linkReq)
+			return dial(ctx)
 		}
 		multi := multiplex.NewMultiplex(ctx, 0, 0, 0)
 		m := ds.config.Multi
@@ -282,24 +312,36 @@ func (ds *dialSdk) run(lock, reload bool) (err error) {
 		defer func() {
 			fn()
 			cl()
-			_ = ln.Close()
+			_ = closer.Close()
 			ds.mux.Lock()
 			defer ds.mux.Unlock()
-			if ds.ln == ln {
+			if ds.ln == closer {
 				ds.ln = nil
 				ds.status = false
 			}
 		}()
-		ds.handle(ctx, ln, out, toDialer, plugins)
+		if packet {
+			idle := defaultUDPIdle
+			if ds.config.UDPIdle > 0 {
+				idle = time.Duration(ds.config.UDPIdle) * time.Millisecond
+			}
+			serveUDP(ctx, pc, idle, func(ctx context.Context) (net.Conn, error) {
+				return linkDial(toDialer)(ctx, out.Network, out.Address)
+			}, func(err error) {
+				ds.cs.sm.logger.Warn("clientSdk-dialSdk:", "udp link", ds.cs.id, ds.id, "err:", err.Error())
+			})
+		} else {
+			ds.handle(ctx, ln, out, toDialer, plugins)
+		}
 	}()
-	ds.ln = ln
+	ds.ln = closer
 	ds.status = true
 	return nil
 }
 
-func (ds *dialSdk) handle(ctx context.Context, ln net.Listener, out *NetworkConfig, toDialer func(ctx context.Context) (net.Conn, error), plugins []plugin.DialPlugin) {
-	defer ln.Close()
-	tdFunc := func(ctx context.Context, network string, address string) (net.Conn, error) {
+// linkDial returns the dial function that tells the listen side the target of each link.
+func linkDial(toDialer func(ctx context.Context) (net.Conn, error)) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
 		conn, err := toDialer(ctx)
 		if err != nil {
 			return nil, err
@@ -311,6 +353,11 @@ func (ds *dialSdk) handle(ctx context.Context, ln net.Listener, out *NetworkConf
 		}
 		return conn, nil
 	}
+}
+
+func (ds *dialSdk) handle(ctx context.Context, ln net.Listener, out *NetworkConfig, toDialer func(ctx context.Context) (net.Conn, error), plugins []plugin.DialPlugin) {
+	defer ln.Close()
+	tdFunc := linkDial(toDialer)
 	var p plugin.DialPlugin
 	if len(plugins) != 0 {
 		var err error
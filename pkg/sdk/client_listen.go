@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"regexp"
+	"slices"
 	"sync"
 )
 
@@ -193,15 +194,19 @@ func (ls *listenSdk) run(lock, reload bool) error {
 		return errors.New("client not running")
 	}
 	ctx, cl := context.WithCancel(ls.cs.client.Context())
-	rln := ls.cs.client.Listen(ctx, comm.RegisterListenerInfo{
-		Name:  ls.config.Name,
-		Notes: ls.config.Notes,
-		Auth:  dcopy.CopyT[*config.AuthInfo](ls.config.Auth),
+	rln := ls.cs.client.ListenNodes(ctx, ls.config.Node, comm.RegisterListenerInfo{
+		Name:   ls.config.Name,
+		Notes:  ls.config.Notes,
+		Auth:   dcopy.CopyT[*config.AuthInfo](ls.config.Auth),
+		Grants: slices.Clone(ls.config.Grants),
 		Settings: comm.Settings{
-			SwitchHide: ls.config.SwitchHide,
-			SwitchLink: ls.config.SwitchLink,
-			SwitchUP2P: ls.config.SwitchUP2P,
-			SwitchTP2P: ls.config.SwitchTP2P,
+			SwitchHide:  ls.config.SwitchHide,
+			SwitchLink:  ls.config.SwitchLink,
+			SwitchUP2P:  ls.config.SwitchUP2P,
+			SwitchTP2P:  ls.config.SwitchTP2P,
+			Balance:     ls.config.Balance,
+			Weight:      ls.config.Weight,
+			IdleTimeout: ls.config.IdleTimeout,
 		},
 	})
 	var afn func() (io.ReadWriteCloser, error)
@@ -271,6 +276,10 @@ func (ls *listenSdk) handle(ctx context.Context, rwc io.ReadWriteCloser, out *Ne
 		return
 	}
 	defer conn.Close()
+	if isPacketNetwork(sl[0]) {
+		copyDatagram(conn, rwc)
+		return
+	}
 	go io.Copy(conn, rwc)
 	_, _ = io.Copy(rwc, conn)
 }
@@ -1,8 +1,13 @@
 package sdk
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
 	"github.com/peakedshout/anchorage-core/pkg/config"
+	"gopkg.in/yaml.v3"
+	"slices"
 )
 
 type Config struct {
@@ -29,16 +34,52 @@ type ClientConfigUnit struct {
 	*config.ClientConfig `json:"config" yaml:"config" comment:"client config"`
 }
 
+// NodeList is a list of node names, a single name is accepted too.
+type NodeList []string
+
+func (nl *NodeList) UnmarshalJSON(b []byte) error {
+	var name string
+	if json.Unmarshal(b, &name) == nil {
+		*nl = toNodeList(name)
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(nl))
+}
+
+func (nl *NodeList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var name string
+		err := value.Decode(&name)
+		if err != nil {
+			return err
+		}
+		*nl = toNodeList(name)
+		return nil
+	}
+	return value.Decode((*[]string)(nl))
+}
+
+func toNodeList(name string) NodeList {
+	if name == "" {
+		return nil
+	}
+	return NodeList{name}
+}
+
 type ListenConfig struct {
-	Enable     bool             `json:"enable" yaml:"enable" comment:"loaded then to work"`
-	Node       string           `json:"node" yaml:"node" comment:"register a specified node"`
-	Name       string           `json:"name" yaml:"name" comment:"service name"`
-	Notes      string           `json:"notes" yaml:"notes" comment:"service notes"`
-	Auth       *config.AuthInfo `json:"auth" yaml:"auth" comment:"service auth ( username  password )"`
-	SwitchHide bool             `json:"switchHide" yaml:"switchHide" comment:"not to be discovered by others"`
-	SwitchLink bool             `json:"switchLink" yaml:"switchLink" comment:"whether or not to allow the link"`
-	SwitchUP2P bool             `json:"switchUP2P" yaml:"switchUP2P" comment:"whether support udp p2p to link"`
-	SwitchTP2P bool             `json:"switchTP2P" yaml:"switchTP2P" comment:"whether support tcp p2p to link"`
+	Enable      bool             `json:"enable" yaml:"enable" comment:"loaded then to work"`
+	Node        NodeList         `json:"node" yaml:"node" comment:"register on every node of the list at the same time, all is every node, empty is one healthy node"`
+	Name        string           `json:"name" yaml:"name" comment:"service name"`
+	Notes       string           `json:"notes" yaml:"notes" comment:"service notes"`
+	Auth        *config.AuthInfo `json:"auth" yaml:"auth" comment:"service auth ( username  password )"`
+	SwitchHide  bool             `json:"switchHide" yaml:"switchHide" comment:"not to be discovered by others"`
+	SwitchLink  bool             `json:"switchLink" yaml:"switchLink" comment:"whether or not to allow the link"`
+	SwitchUP2P  bool             `json:"switchUP2P" yaml:"switchUP2P" comment:"whether support udp p2p to link"`
+	SwitchTP2P  bool             `json:"switchTP2P" yaml:"switchTP2P" comment:"whether support tcp p2p to link"`
+	Balance     string           `json:"balance" yaml:"balance" comment:"load balance strategy of the service (random,roundRobin,weighted,leastLink,lowestDelay)"`
+	Weight      int              `json:"weight" yaml:"weight" comment:"weight of this listener in weighted balance"`
+	IdleTimeout int              `json:"idleTimeout" yaml:"idleTimeout" comment:"close links without data for the time (unit ms), 0 follows the server and negative is never"`
+	Grants      []string         `json:"grants" yaml:"grants" comment:"usernames granted to co-register this service name (only effective for the owner)"`
 
 	OutNetwork *NetworkConfig `json:"outNetwork" yaml:"outNetwork" comment:"out network config"`
 	Multi      bool           `json:"multi" yaml:"multi" comment:"whether support multi io to link"`
@@ -52,23 +93,31 @@ func (lc *ListenConfig) Check() error {
 	if lc.Name == "" {
 		return errors.New("nil name")
 	}
+	if !comm.CheckBalance(lc.Balance) {
+		return fmt.Errorf("invalid balance: %s", lc.Balance)
+	}
+	if slices.Contains(lc.Node, "") {
+		return errors.New("nil node name")
+	}
 	return nil
 }
 
 type DialConfig struct {
-	Enable      bool             `json:"enable" yaml:"enable" comment:"loaded then to work"`
-	Node        []string         `json:"node" yaml:"node" comment:"node links"`
-	Link        string           `json:"link" yaml:"link"  comment:"link service name"`
-	PP2PNetwork string           `json:"PP2PNetwork" yaml:"PP2PNetwork" comment:"specify the p2p network type"`
-	SwitchUP2P  bool             `json:"switchUP2P" yaml:"switchUP2P" comment:"whether support udp p2p to link"`
-	SwitchTP2P  bool             `json:"switchTP2P" yaml:"switchTP2P" comment:"whether support tcp p2p to link"`
-	ForceP2P    bool             `json:"forceP2P" yaml:"forceP2P" comment:"whether force p2p to link"`
-	Auth        *config.AuthInfo `json:"auth" yaml:"auth" comment:"service auth ( username  password )"`
+	Enable      bool                    `json:"enable" yaml:"enable" comment:"loaded then to work"`
+	Node        []string                `json:"node" yaml:"node" comment:"node links"`
+	Link        string                  `json:"link" yaml:"link"  comment:"link service name"`
+	PP2PNetwork string                  `json:"PP2PNetwork" yaml:"PP2PNetwork" comment:"specify the p2p network type"`
+	SwitchUP2P  bool                    `json:"switchUP2P" yaml:"switchUP2P" comment:"whether support udp p2p to link"`
+	SwitchTP2P  bool                    `json:"switchTP2P" yaml:"switchTP2P" comment:"whether support tcp p2p to link"`
+	ForceP2P    bool                    `json:"forceP2P" yaml:"forceP2P" comment:"whether force p2p to link"`
+	Auth        *config.AuthInfo        `json:"auth" yaml:"auth" comment:"service auth ( username  password )"`
+	Retry       *config.DialRetryConfig `json:"retry" yaml:"retry" comment:"retry policy of a failed link"`
 
 	InNetwork  *NetworkConfig `json:"inNetwork" yaml:"inNetwork" comment:"in network config"`
 	OutNetwork *NetworkConfig `json:"outNetwork" yaml:"outNetwork" comment:"out network config"`
 	Multi      int            `json:"multi" yaml:"multi" comment:"whether support multi io count to link (set -1 to close)"`
 	MultiIdle  int            `json:"multiIdle" yaml:"multiIdle" comment:"whether support multi io idle count to link"`
+	UDPIdle    uint           `json:"udpIdle" yaml:"udpIdle" comment:"close the link of an udp source address without datagrams for the time (unit ms, default 60000)"`
 	Plugin     string         `json:"plugin" yaml:"plugin" comment:"plugin name"`
 }
 
@@ -82,6 +131,17 @@ func (dc *DialConfig) Check() error {
 	if dc.InNetwork == nil {
 		return errors.New("nil in network")
 	}
+	if isPacketNetwork(dc.InNetwork.Network) {
+		if dc.Plugin != "" {
+			return errors.New("udp in network not support plugin")
+		}
+		if dc.OutNetwork == nil || !isPacketNetwork(dc.OutNetwork.Network) {
+			return errors.New("udp in network needs an udp out network")
+		}
+	}
+	if dc.Retry != nil {
+		return dc.Retry.Check()
+	}
 	return nil
 }
 
@@ -144,6 +144,8 @@ func (sm *sdkManager) GetClientView() []*ClientView {
 			v.Dial = append(v.Dial, &DialView{
 				Id:         d.GetId(),
 				Status:     d.status,
+				Retries:    d.retries.Load(),
+				Failures:   d.failures.Load(),
 				DialConfig: dcopy.CopyT(d.config),
 			})
 			d.mux.Unlock()
@@ -230,6 +232,8 @@ func (sm *sdkManager) GetClientViewById(id string) (*ClientView, error) {
 			v.Dial = append(v.Dial, &DialView{
 				Id:         d.GetId(),
 				Status:     d.status,
+				Retries:    d.retries.Load(),
+				Failures:   d.failures.Load(),
 				DialConfig: dcopy.CopyT(d.config),
 			})
 			d.mux.Unlock()
@@ -289,6 +293,8 @@ func (sm *sdkManager) GetDialViewById(id string, sid string) (*DialView, error)
 		v = &DialView{
 			Id:         sdk.GetId(),
 			Status:     sdk.status,
+			Retries:    sdk.retries.Load(),
+			Failures:   sdk.failures.Load(),
 			DialConfig: dcopy.CopyT(sdk.config),
 		}
 		sdk.mux.Unlock()
@@ -2,6 +2,7 @@ package sdk
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/peakedshout/anchorage-core/pkg/config"
 	"github.com/peakedshout/anchorage-core/pkg/sdk/plugin"
@@ -10,11 +11,13 @@ import (
 	"github.com/peakedshout/go-pandorasbox/tool/uuid"
 	"github.com/peakedshout/go-pandorasbox/xnet/fasttool"
 	"github.com/peakedshout/go-pandorasbox/xnet/proxy/socks"
+	"gopkg.in/yaml.v3"
 	"io"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"testing"
 	"time"
 )
@@ -562,3 +565,29 @@ func TestSdkManagerServer(t *testing.T) {
 	}
 	fmt.Println(sdk.GetServerView()[0].Status)
 }
+
+func TestNodeList(t *testing.T) {
+	var list []NodeList
+	for _, s := range []string{`""`, `"n1"`, `["n1","n2"]`} {
+		var nl NodeList
+		err := json.Unmarshal([]byte(s), &nl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, nl)
+	}
+	for _, s := range []string{`""`, `n1`, `[n1, n2]`} {
+		var nl NodeList
+		err := yaml.Unmarshal([]byte(s), &nl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, nl)
+	}
+	for i, nl := range list {
+		want := [][]string{nil, {"n1"}, {"n1", "n2"}}[i%3]
+		if !slices.Equal(nl, want) {
+			t.Fatal("unexpected node list:", i, nl)
+		}
+	}
+}
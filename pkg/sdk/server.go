@@ -3,10 +3,13 @@ package sdk
 import (
 	"errors"
 	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/anchorage-core/pkg/config"
 	"github.com/peakedshout/anchorage-core/pkg/server"
 	"github.com/peakedshout/go-pandorasbox/tool/dcopy"
 	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"slices"
 	"sync"
+	"time"
 )
 
 func (sm *sdkManager) handleServer() error {
@@ -151,6 +154,50 @@ func (sm *sdkManager) ReloadServer(id string) error {
 	})
 }
 
+// DrainReloadServer drains the server like DrainServer, then starts it again with its config.
+// The new server takes new links once the old one has released its addresses, it is not started if the server was
+// deleted meanwhile.
+func (sm *sdkManager) DrainReloadServer(id string, timeout time.Duration) (err error) {
+	defer func() {
+		if err == nil {
+			sm.logger.Info("serverSdk:", "drain reload server", id)
+		} else {
+			sm.logger.Warn("serverSdk:", "drain reload server", id, "err:", err.Error())
+		}
+	}()
+	var target *serverSdk
+	err = sm.getServer(id, func(sdk *serverSdk) error {
+		target = sdk
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = target.drain(timeout)
+	if err != nil {
+		return err
+	}
+	return sm.getServer(id, func(sdk *serverSdk) error {
+		if sdk != target {
+			return errors.New("server changed while draining")
+		}
+		return sdk.start()
+	})
+}
+
+func (sm *sdkManager) ReloadServerUsers(id string) error {
+	return sm.getServer(id, func(sdk *serverSdk) (err error) {
+		defer func() {
+			if err == nil {
+				sm.logger.Info("serverSdk:", "reload server users", id)
+			} else {
+				sm.logger.Warn("serverSdk:", "reload server users", id, "err:", err.Error())
+			}
+		}()
+		return sdk.reloadUsers()
+	})
+}
+
 func (sm *sdkManager) StopServer(id string) error {
 	return sm.getServer(id, func(sdk *serverSdk) (err error) {
 		defer func() {
@@ -164,6 +211,27 @@ func (sm *sdkManager) StopServer(id string) error {
 	})
 }
 
+// DrainServer stops the server taking new links, proxies and listeners, waits for the active ones until timeout and stops it.
+// The manager lock is only held to find the server, the other calls go on while it waits.
+func (sm *sdkManager) DrainServer(id string, timeout time.Duration) (err error) {
+	defer func() {
+		if err == nil {
+			sm.logger.Info("serverSdk:", "drain server", id)
+		} else {
+			sm.logger.Warn("serverSdk:", "drain server", id, "err:", err.Error())
+		}
+	}()
+	var target *serverSdk
+	err = sm.getServer(id, func(sdk *serverSdk) error {
+		target = sdk
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return target.drain(timeout)
+}
+
 func (sm *sdkManager) UpdateServer(id string, fn func(cfg *ServerConfig)) error {
 	return sm.getServer(id, func(sdk *serverSdk) (err error) {
 		defer func() {
@@ -223,7 +291,27 @@ func (sm *sdkManager) GetServerLinkView(id string) (view []comm.LinkView, err er
 	return view, nil
 }
 
-func (sm *sdkManager) GetServerSyncView(id string) (view map[string][]xrpc.SessionView, err error) {
+func (sm *sdkManager) GetServerSyncView(id string) (map[string][]xrpc.SessionView, error) {
+	view, err := sm.GetServerSyncView2(id)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][]xrpc.SessionView, len(view))
+	for node, units := range view {
+		list := make([]xrpc.SessionView, 0, len(units))
+		for _, unit := range units {
+			list = append(list, unit.Sessions...)
+		}
+		slices.SortStableFunc(list, func(a, b xrpc.SessionView) int {
+			return a.MonitorInfo.CreateTime.Compare(b.MonitorInfo.CreateTime)
+		})
+		m[node] = list
+	}
+	return m, nil
+}
+
+// GetServerSyncView2 is GetServerSyncView with the state of each sync node unit.
+func (sm *sdkManager) GetServerSyncView2(id string) (view map[string][]server.SyncUnitView, err error) {
 	err = sm.getServer(id, func(sdk *serverSdk) error {
 		view, err = sdk.getSyncView()
 		return err
@@ -234,7 +322,16 @@ func (sm *sdkManager) GetServerSyncView(id string) (view map[string][]xrpc.Sessi
 	return view, nil
 }
 
-func (sm *sdkManager) GetServerProxyView(id string) (view map[string][]server.ProxyUnitView, err error) {
+func (sm *sdkManager) GetServerProxyView(id string) (map[string][]server.ProxyUnitView, error) {
+	view, err := sm.GetServerProxyView2(id)
+	if err != nil {
+		return nil, err
+	}
+	return view.Units, nil
+}
+
+// GetServerProxyView2 is GetServerProxyView with the denied proxy counters.
+func (sm *sdkManager) GetServerProxyView2(id string) (view *server.ProxyView, err error) {
 	err = sm.getServer(id, func(sdk *serverSdk) error {
 		view, err = sdk.getProxyView()
 		return err
@@ -245,6 +342,110 @@ func (sm *sdkManager) GetServerProxyView(id string) (view map[string][]server.Pr
 	return view, nil
 }
 
+func (sm *sdkManager) GetServerTrafficView(id string) (view *comm.TrafficView, err error) {
+	err = sm.getServer(id, func(sdk *serverSdk) error {
+		view, err = sdk.getTrafficView()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return view, nil
+}
+
+func (sm *sdkManager) ResetServerTraffic(id string, kind, name string) error {
+	return sm.getServer(id, func(sdk *serverSdk) (err error) {
+		defer func() {
+			if err == nil {
+				sm.logger.Info("serverSdk:", "reset server traffic", id, kind, name)
+			} else {
+				sm.logger.Warn("serverSdk:", "reset server traffic", id, kind, name, "err:", err.Error())
+			}
+		}()
+		return sdk.resetTraffic(kind, name)
+	})
+}
+
+func (sm *sdkManager) AddServerSyncNode(id string, node config.NodeConfig) error {
+	return sm.getServer(id, func(sdk *serverSdk) (err error) {
+		defer func() {
+			if err == nil {
+				sm.logger.Info("serverSdk:", "add server sync node", id, node.NodeName)
+			} else {
+				sm.logger.Warn("serverSdk:", "add server sync node", id, node.NodeName, "err:", err.Error())
+			}
+		}()
+		return sdk.updateSync(func(s *server.Server) error {
+			return s.AddSyncNode(node)
+		}, func(cfg *config.ServerConfig) error {
+			err := node.Check()
+			if err != nil {
+				return err
+			}
+			if slices.ContainsFunc(cfg.SyncNodes, func(one config.NodeConfig) bool {
+				return one.NodeName == node.NodeName
+			}) {
+				return server.ErrSyncNodeExists.Errorf(node.NodeName)
+			}
+			cfg.SyncNodes = append(cfg.SyncNodes, node)
+			return nil
+		})
+	})
+}
+
+func (sm *sdkManager) DelServerSyncNode(id string, node string) error {
+	return sm.getServer(id, func(sdk *serverSdk) (err error) {
+		defer func() {
+			if err == nil {
+				sm.logger.Info("serverSdk:", "del server sync node", id, node)
+			} else {
+				sm.logger.Warn("serverSdk:", "del server sync node", id, node, "err:", err.Error())
+			}
+		}()
+		return sdk.updateSync(func(s *server.Server) error {
+			return s.DelSyncNode(node)
+		}, func(cfg *config.ServerConfig) error {
+			nodes := slices.DeleteFunc(cfg.SyncNodes, func(one config.NodeConfig) bool {
+				return one.NodeName == node
+			})
+			if len(nodes) == len(cfg.SyncNodes) {
+				return server.ErrNotFoundNode.Errorf(node)
+			}
+			cfg.SyncNodes = nodes
+			cfg.SyncPaused = slices.DeleteFunc(cfg.SyncPaused, func(one string) bool {
+				return one == node
+			})
+			return nil
+		})
+	})
+}
+
+func (sm *sdkManager) PauseServerSyncNode(id string, node string, pause bool) error {
+	return sm.getServer(id, func(sdk *serverSdk) (err error) {
+		defer func() {
+			if err == nil {
+				sm.logger.Info("serverSdk:", "pause server sync node", id, node, pause)
+			} else {
+				sm.logger.Warn("serverSdk:", "pause server sync node", id, node, pause, "err:", err.Error())
+			}
+		}()
+		return sdk.updateSync(func(s *server.Server) error {
+			return s.PauseSyncNode(node, pause)
+		}, func(cfg *config.ServerConfig) error {
+			if !slices.ContainsFunc(cfg.SyncNodes, func(one config.NodeConfig) bool { return one.NodeName == node }) {
+				return server.ErrNotFoundNode.Errorf(node)
+			}
+			cfg.SyncPaused = slices.DeleteFunc(cfg.SyncPaused, func(one string) bool {
+				return one == node
+			})
+			if pause {
+				cfg.SyncPaused = append(cfg.SyncPaused, node)
+			}
+			return nil
+		})
+	})
+}
+
 func (sm *sdkManager) getServer(id string, fn func(sdk *serverSdk) error) error {
 	defer sm.Lock().Unlock()
 	index := findIndex(sm.sList, id)
@@ -273,10 +474,38 @@ func (ss *serverSdk) update(fn func(cfg *ServerConfig)) error {
 	return ss.run(false, true)
 }
 
+// updateSync changes the sync nodes of the running server and the saved config together, without reload.
+func (ss *serverSdk) updateSync(fn func(s *server.Server) error, cfgFn func(cfg *config.ServerConfig) error) error {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	cfg := dcopy.CopyT(ss.config.ServerConfig)
+	err := cfgFn(cfg)
+	if err != nil {
+		return err
+	}
+	if ss.status {
+		err = fn(ss.server)
+		if err != nil {
+			return err
+		}
+	}
+	ss.config.ServerConfig = cfg
+	return ss.sm.save()
+}
+
 func (ss *serverSdk) reload() error {
 	return ss.run(true, true)
 }
 
+func (ss *serverSdk) reloadUsers() error {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	if !ss.status {
+		return errors.New("no running")
+	}
+	return ss.server.ReloadUsers()
+}
+
 func (ss *serverSdk) start() error {
 	return ss.run(true, false)
 }
@@ -293,6 +522,24 @@ func (ss *serverSdk) stop() error {
 	return nil
 }
 
+// drain does not hold the lock while waiting, so that the views still work.
+func (ss *serverSdk) drain(timeout time.Duration) error {
+	ss.mux.Lock()
+	s := ss.server
+	ss.mux.Unlock()
+	if s == nil {
+		return errors.New("no running")
+	}
+	err := s.Drain(timeout)
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	if ss.server == s {
+		ss.server = nil
+		ss.status = false
+	}
+	return err
+}
+
 func (ss *serverSdk) getConfig() *ServerConfig {
 	ss.mux.Lock()
 	defer ss.mux.Unlock()
@@ -326,7 +573,7 @@ func (ss *serverSdk) getLinkView() ([]comm.LinkView, error) {
 	return ss.server.GetLinkView(), nil
 }
 
-func (ss *serverSdk) getSyncView() (map[string][]xrpc.SessionView, error) {
+func (ss *serverSdk) getSyncView() (map[string][]server.SyncUnitView, error) {
 	ss.mux.Lock()
 	defer ss.mux.Unlock()
 	if !ss.status {
@@ -335,7 +582,7 @@ func (ss *serverSdk) getSyncView() (map[string][]xrpc.SessionView, error) {
 	return ss.server.GetSyncView(), nil
 }
 
-func (ss *serverSdk) getProxyView() (map[string][]server.ProxyUnitView, error) {
+func (ss *serverSdk) getProxyView() (*server.ProxyView, error) {
 	ss.mux.Lock()
 	defer ss.mux.Unlock()
 	if !ss.status {
@@ -343,3 +590,21 @@ func (ss *serverSdk) getProxyView() (map[string][]server.ProxyUnitView, error) {
 	}
 	return ss.server.GetProxyView(), nil
 }
+
+func (ss *serverSdk) getTrafficView() (*comm.TrafficView, error) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	if !ss.status {
+		return nil, errors.New("no running")
+	}
+	return ss.server.GetTrafficView(), nil
+}
+
+func (ss *serverSdk) resetTraffic(kind, name string) error {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	if !ss.status {
+		return errors.New("no running")
+	}
+	return ss.server.ResetTraffic(kind, name)
+}
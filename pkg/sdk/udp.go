@@ -0,0 +1,193 @@
+package sdk
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultUDPIdle = 60 * time.Second
+	maxDatagram    = 64 * 1024
+	maxUDPSessions = 1024 // sources served at once, datagrams of new sources are dropped beyond it
+	maxUDPPending  = 64   // datagrams queued for a session, the rest are dropped while its link is busy
+)
+
+func isPacketNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return true
+	default:
+		return false
+	}
+}
+
+// writeDatagram writes one datagram with its length first, so the boundaries survive the link stream.
+func writeDatagram(w io.Writer, b []byte) error {
+	if len(b) >= maxDatagram {
+		return errors.New("datagram too large")
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readDatagram(r io.Reader, buf []byte) (int, error) {
+	var head [2]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(head[:]))
+	if n > len(buf) {
+		return 0, errors.New("datagram too large")
+	}
+	return io.ReadFull(r, buf[:n])
+}
+
+// copyDatagram relays the datagrams between a connected udp conn and a link stream, until one side ends.
+func copyDatagram(conn net.Conn, rwc io.ReadWriteCloser) {
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := readDatagram(rwc, buf)
+			if err != nil {
+				return
+			}
+			_, err = conn.Write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		err = writeDatagram(rwc, buf[:n])
+		if err != nil {
+			return
+		}
+	}
+}
+
+type udpSession struct {
+	queue chan []byte  // datagrams waiting for the link, dropped when full
+	last  atomic.Int64 // unix nano of the last datagram
+	cl    context.CancelFunc
+}
+
+// serveUDP keeps a link for each source address of pc, the link is closed after idle time without datagrams.
+// The links are dialed in the background, so a slow dial only holds the datagrams of its own source.
+func serveUDP(ctx context.Context, pc net.PacketConn, idle time.Duration, dial func(ctx context.Context) (net.Conn, error), onErr func(err error)) {
+	defer pc.Close()
+	ctx, cl := context.WithCancel(ctx)
+	defer cl()
+	var mux sync.Mutex
+	sessions := make(map[string]*udpSession)
+	remove := func(key string, sess *udpSession) {
+		mux.Lock()
+		if sessions[key] == sess {
+			delete(sessions, key)
+		}
+		mux.Unlock()
+		sess.cl()
+	}
+	go ctxtool.RunTimerFunc(ctx, max(idle/2, time.Second), func(ctx context.Context) error {
+		now := time.Now()
+		expired := make(map[string]*udpSession)
+		mux.Lock()
+		for key, sess := range sessions {
+			if now.Sub(time.Unix(0, sess.last.Load())) >= idle {
+				expired[key] = sess
+			}
+		}
+		mux.Unlock()
+		for key, sess := range expired {
+			remove(key, sess)
+		}
+		return nil
+	})
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		key := addr.String()
+		mux.Lock()
+		sess, ok := sessions[key]
+		if !ok {
+			if len(sessions) >= maxUDPSessions {
+				mux.Unlock()
+				continue
+			}
+			sess = &udpSession{queue: make(chan []byte, maxUDPPending)}
+			sess.last.Store(time.Now().UnixNano())
+			var sctx context.Context
+			sctx, sess.cl = context.WithCancel(ctx)
+			sessions[key] = sess
+			go func() {
+				defer remove(key, sess)
+				err := sess.serve(sctx, pc, addr, dial)
+				if err != nil && onErr != nil && sctx.Err() == nil {
+					onErr(err)
+				}
+			}()
+		}
+		mux.Unlock()
+		sess.last.Store(time.Now().UnixNano())
+		select {
+		case sess.queue <- append([]byte(nil), buf[:n]...):
+		default:
+		}
+	}
+}
+
+// serve dials the link of the session, then relays the datagrams until ctx is done or the link ends.
+func (sess *udpSession) serve(ctx context.Context, pc net.PacketConn, addr net.Addr, dial func(ctx context.Context) (net.Conn, error)) error {
+	conn, err := dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cl := context.WithCancel(ctx)
+	defer cl()
+	go func() {
+		defer cl()
+		rbuf := make([]byte, maxDatagram)
+		for {
+			n, err := readDatagram(conn, rbuf)
+			if err != nil {
+				return
+			}
+			sess.last.Store(time.Now().UnixNano())
+			_, err = pc.WriteTo(rbuf[:n], addr)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case b := <-sess.queue:
+			err = writeDatagram(conn, b)
+			if err != nil {
+				return nil
+			}
+		}
+	}
+}
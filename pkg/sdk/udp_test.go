@@ -0,0 +1,159 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDatagram(t *testing.T) {
+	var buf bytes.Buffer
+	list := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{1}, 1500)}
+	for _, b := range list {
+		err := writeDatagram(&buf, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rbuf := make([]byte, maxDatagram)
+	for _, b := range list {
+		n, err := readDatagram(&buf, rbuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rbuf[:n], b) {
+			t.Fatal("datagram boundary lost")
+		}
+	}
+	if writeDatagram(&buf, make([]byte, maxDatagram)) == nil {
+		t.Fatal("too large datagram written")
+	}
+}
+
+func TestServeUDP(t *testing.T) {
+	ctx, cl := context.WithCancel(context.Background())
+	defer cl()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := make(chan net.Conn, 2)
+	go serveUDP(ctx, pc, time.Minute, func(ctx context.Context) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		links <- c2
+		return c1, nil
+	}, nil)
+	// the link side echoes the datagrams with a prefix
+	go func() {
+		for link := range links {
+			go func(link net.Conn) {
+				buf := make([]byte, maxDatagram)
+				for {
+					n, err := readDatagram(link, buf)
+					if err != nil {
+						return
+					}
+					if writeDatagram(link, append([]byte("echo:"), buf[:n]...)) != nil {
+						return
+					}
+				}
+			}(link)
+		}
+	}()
+	for _, msg := range []string{"a", "b"} {
+		conn, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "echo:"+msg {
+			t.Fatal("unexpected reply:", string(buf[:n]))
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestServeUDPSlowDial(t *testing.T) {
+	ctx, cl := context.WithCancel(context.Background())
+	defer cl()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dials atomic.Int64
+	errs := make(chan error, 1)
+	go serveUDP(ctx, pc, time.Minute, func(ctx context.Context) (net.Conn, error) {
+		if dials.Add(1) == 1 {
+			// the first source hangs on its dial until it fails
+			<-time.After(time.Second)
+			return nil, errors.New("slow dial")
+		}
+		c1, c2 := net.Pipe()
+		go func() {
+			buf := make([]byte, maxDatagram)
+			for {
+				n, err := readDatagram(c2, buf)
+				if err != nil {
+					return
+				}
+				if writeDatagram(c2, buf[:n]) != nil {
+					return
+				}
+			}
+		}()
+		return c1, nil
+	}, func(err error) {
+		errs <- err
+	})
+	slow, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	_, err = slow.Write([]byte("slow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for dials.Load() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fast, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	_, err = fast.Write([]byte("fast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = fast.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, 64)
+	n, err := fast.Read(buf)
+	if err != nil {
+		t.Fatal("blocked by the slow dial:", err)
+	}
+	if string(buf[:n]) != "fast" {
+		t.Fatal("unexpected reply:", string(buf[:n]))
+	}
+	select {
+	case err = <-errs:
+		if err.Error() != "slow dial" {
+			t.Fatal("unexpected error:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial error not reported")
+	}
+}
@@ -29,8 +29,10 @@ type ListenView struct {
 }
 
 type DialView struct {
-	Id     string `json:"id"`
-	Status bool   `json:"status"`
+	Id       string `json:"id"`
+	Status   bool   `json:"status"`
+	Retries  uint64 `json:"retries"`
+	Failures uint64 `json:"failures"`
 	*DialConfig
 }
 
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type routeCandidate struct {
+	unit   xrpc.ReverseRpc
+	info   *comm.RegisterListenerInfo
+	delay  time.Duration
+	active int64
+	path   []string
+}
+
+func (rc *routeCandidate) weight() int {
+	if rc.info.Settings.Weight <= 0 {
+		return 1
+	}
+	return rc.info.Settings.Weight
+}
+
+// rrKey is the round robin counter of a service, the local and the remote candidates count apart.
+type rrKey struct {
+	name   string
+	remote bool
+}
+
+type balancer struct {
+	mux sync.Mutex
+	r   *rand.Rand
+	rr  map[rrKey]uint64
+}
+
+func newBalancer() *balancer {
+	return &balancer{
+		r:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		rr: make(map[rrKey]uint64),
+	}
+}
+
+// pick selects one candidate of the local or the remote list, the strategy declared by the first candidate wins:
+// the earliest registered listener of the local list, or the first by node name of the remote list.
+func (b *balancer) pick(name string, remote bool, list []routeCandidate) *routeCandidate {
+	if len(list) == 0 {
+		return nil
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	switch list[0].info.Settings.Balance {
+	case comm.BalanceRoundRobin:
+		key := rrKey{name: name, remote: remote}
+		i := b.rr[key]
+		b.rr[key] = i + 1
+		return &list[i%uint64(len(list))]
+	case comm.BalanceWeighted:
+		total := 0
+		for i := range list {
+			total += list[i].weight()
+		}
+		n := b.r.Intn(total)
+		for i := range list {
+			n -= list[i].weight()
+			if n < 0 {
+				return &list[i]
+			}
+		}
+		return &list[len(list)-1]
+	case comm.BalanceLeastLink:
+		return b.pickMin(list, func(rc *routeCandidate) int64 {
+			return rc.active
+		})
+	case comm.BalanceLowestDelay:
+		return b.pickMin(list, func(rc *routeCandidate) int64 {
+			return int64(rc.delay)
+		})
+	default:
+		return &list[b.r.Intn(len(list))]
+	}
+}
+
+func (b *balancer) pickMin(list []routeCandidate, fn func(rc *routeCandidate) int64) *routeCandidate {
+	var mins []int
+	var m int64
+	for i := range list {
+		v := fn(&list[i])
+		if len(mins) == 0 || v < m {
+			m = v
+			mins = append(mins[:0], i)
+		} else if v == m {
+			mins = append(mins, i)
+		}
+	}
+	return &list[mins[b.r.Intn(len(mins))]]
+}
+
+func (b *balancer) forget(name string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	delete(b.rr, rrKey{name: name})
+	delete(b.rr, rrKey{name: name, remote: true})
+}
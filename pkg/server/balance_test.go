@@ -0,0 +1,63 @@
+package server
+
+import (
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"testing"
+	"time"
+)
+
+func testCandidates(balance string, n int) []routeCandidate {
+	list := make([]routeCandidate, 0, n)
+	for i := 0; i < n; i++ {
+		list = append(list, routeCandidate{
+			info: &comm.RegisterListenerInfo{
+				Name:     "tl",
+				Settings: comm.Settings{Balance: balance, Weight: i},
+			},
+			delay:  time.Duration(n-i) * time.Millisecond,
+			active: int64(i),
+		})
+	}
+	return list
+}
+
+func TestBalancer(t *testing.T) {
+	b := newBalancer()
+	list := testCandidates(comm.BalanceRoundRobin, 3)
+	for i := 0; i < 6; i++ {
+		if rc := b.pick("tl", false, list); rc != &list[i%3] {
+			t.Fatal("round robin order", i)
+		}
+	}
+	// the remote list counts apart from the local one
+	if rc := b.pick("tl", true, list); rc != &list[0] {
+		t.Fatal("round robin shared between local and remote")
+	}
+	if rc := b.pick("tl", false, list); rc != &list[0] {
+		t.Fatal("round robin order of local")
+	}
+	list = testCandidates(comm.BalanceLeastLink, 3)
+	if rc := b.pick("tl", false, list); rc != &list[0] {
+		t.Fatal("least link")
+	}
+	list = testCandidates(comm.BalanceLowestDelay, 3)
+	if rc := b.pick("tl", false, list); rc != &list[2] {
+		t.Fatal("lowest delay")
+	}
+	list = testCandidates(comm.BalanceWeighted, 3)
+	list[0].info.Settings.Weight = 0
+	list[1].info.Settings.Weight = 0
+	list[2].info.Settings.Weight = 1000000
+	count := 0
+	for i := 0; i < 100; i++ {
+		if b.pick("tl", false, list) == &list[2] {
+			count++
+		}
+	}
+	if count < 90 {
+		t.Fatal("weighted", count)
+	}
+	if b.pick("tl", false, nil) != nil {
+		t.Fatal("nil list")
+	}
+}
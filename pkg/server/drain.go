@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+	drainNotifyTimeout  = 5 * time.Second
+)
+
+// Drain stops accepting new links, proxies and listeners, asks the clients to move their listeners to other nodes,
+// then waits for the active links and proxies to end until timeout (0 is 30s) and closes the server.
+func (s *Server) Drain(timeout time.Duration) error {
+	if !s.draining.CompareAndSwap(false, true) {
+		return ErrServerDraining
+	}
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	s.logger.Info("server:", s.nodeName, "drain start, timeout:", timeout)
+	s.notifyDrain()
+	ctx, cl := context.WithTimeout(s.Context(), timeout)
+	defer cl()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		links, proxies := s.activeCount()
+		if links == 0 && proxies == 0 {
+			s.logger.Info("server:", s.nodeName, "drain done")
+			break
+		}
+		select {
+		case <-ticker.C:
+			continue
+		case <-ctx.Done():
+			s.logger.Warn("server:", s.nodeName, "drain timeout, cut links:", links, "proxies:", proxies)
+		}
+		break
+	}
+	return s.Close()
+}
+
+// Draining reports whether the server is draining.
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// notifyDrain tells every registered listener that the server is going away, the clients of old versions just ignore it.
+func (s *Server) notifyDrain() {
+	var wg sync.WaitGroup
+	for _, unit := range s.route.locals() {
+		wg.Add(1)
+		go func(unit xrpc.ReverseRpc) {
+			defer wg.Done()
+			ctx, cl := context.WithTimeout(unit.Context(), drainNotifyTimeout)
+			defer cl()
+			_ = unit.Rpc(ctx, comm.CallDrain, s.nodeName, nil)
+		}(unit.ReverseRpc)
+	}
+	wg.Wait()
+}
+
+// activeCount returns the live links and proxies, the closed ones kept for the views are left out.
+func (s *Server) activeCount() (links, proxies int) {
+	s.lm.lock.Lock()
+	boxes := make([]*linkBox, 0, len(s.lm.boxMap))
+	for _, box := range s.lm.boxMap {
+		boxes = append(boxes, box)
+	}
+	s.lm.lock.Unlock()
+	for _, box := range boxes {
+		if box.alive() {
+			links++
+		}
+	}
+	s.proxy.m.Range(func(_ xrpc.Stream, info *proxyInfo) bool {
+		if !info.closed.Load() {
+			proxies++
+		}
+		return true
+	})
+	return links, proxies
+}
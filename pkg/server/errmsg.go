@@ -5,9 +5,20 @@ import "github.com/peakedshout/go-pandorasbox/tool/xerror"
 var (
 	ErrNodeAuthFailed       = xerror.New("node auth failed")
 	ErrRegisterListenerInfo = xerror.New("register listener info err: %v")
+	ErrInvalidBalance       = xerror.New("register listener info err: invalid balance: %s")
+	ErrServiceOwned         = xerror.New("register listener info err: service name is owned by other user: %s")
 	ErrInvalidLinkId        = xerror.New("invalid link id")
 	ErrNotFoundService      = xerror.New("not found service: %s")
 	ErrNotFoundNode         = xerror.New("not found node: %s")
+	ErrSyncNodeExists       = xerror.New("sync node exists: %s")
 	ErrInvalidNode          = xerror.New("invalid node: %s")
 	ErrLinkNodeFailed       = xerror.New("link node failed")
+	ErrPermissionDenied     = xerror.New("permission denied: %s")
+	ErrNatProbeDenied       = xerror.New("permission denied: nat probe to %s")
+	ErrProxyDenied          = xerror.New("proxy denied by egress policy: %s")
+	ErrQuotaExceeded        = xerror.New("traffic quota exceeded: %s:%s")
+	ErrInvalidTrafficKind   = xerror.New("invalid traffic kind: %s")
+	ErrRouteEventOverflow   = xerror.New("route event overflow")
+	ErrServerDraining       = xerror.New("server is draining")
+	ErrDuplicateUser        = xerror.New("duplicate user: %s")
 )
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"sync"
+	"time"
+)
+
+const routeEventBuffer = 256
+
+// delayChanged reports whether the delay moved enough to be worth an event, small jitter is ignored.
+func delayChanged(old, cur time.Duration) bool {
+	diff := cur - old
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff >= 10*time.Millisecond && diff >= min(old, cur)/5
+}
+
+// routeWatcher is one subscriber of the route events, it is dropped instead of blocking the route when it falls behind.
+type routeWatcher struct {
+	q    comm.ServiceRouteQuery
+	ch   chan comm.RouteEvent
+	drop chan struct{}
+}
+
+func (rw *routeWatcher) match(e *comm.RouteEvent) bool {
+	if e.Unit == nil {
+		return rw.q.Node == "" || rw.q.Node == e.Node
+	}
+	return !e.Unit.Settings.SwitchHide && rw.q.Match(e.Unit)
+}
+
+type routeEvents struct {
+	mux sync.Mutex
+	m   map[*routeWatcher]struct{}
+}
+
+func newRouteEvents() *routeEvents {
+	return &routeEvents{m: make(map[*routeWatcher]struct{})}
+}
+
+func (re *routeEvents) watch(q comm.ServiceRouteQuery) *routeWatcher {
+	rw := &routeWatcher{
+		q:    q,
+		ch:   make(chan comm.RouteEvent, routeEventBuffer),
+		drop: make(chan struct{}),
+	}
+	re.mux.Lock()
+	defer re.mux.Unlock()
+	re.m[rw] = struct{}{}
+	return rw
+}
+
+func (re *routeEvents) unwatch(rw *routeWatcher) {
+	re.mux.Lock()
+	defer re.mux.Unlock()
+	delete(re.m, rw)
+}
+
+func (re *routeEvents) watched() bool {
+	re.mux.Lock()
+	defer re.mux.Unlock()
+	return len(re.m) != 0
+}
+
+func (re *routeEvents) emitUnit(typ string, unit comm.ServiceRouteViewUnit) {
+	re.emit(comm.RouteEvent{Type: typ, Time: time.Now(), Unit: &unit})
+}
+
+func (re *routeEvents) emitNode(typ string, node string) {
+	re.emit(comm.RouteEvent{Type: typ, Time: time.Now(), Node: node})
+}
+
+func (re *routeEvents) emit(e comm.RouteEvent) {
+	re.mux.Lock()
+	defer re.mux.Unlock()
+	for rw := range re.m {
+		if !rw.match(&e) {
+			continue
+		}
+		select {
+		case rw.ch <- e:
+		default:
+			delete(re.m, rw)
+			close(rw.drop)
+		}
+	}
+}
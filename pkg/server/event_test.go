@@ -0,0 +1,63 @@
+package server
+
+import (
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"testing"
+	"time"
+)
+
+func TestDelayChanged(t *testing.T) {
+	if delayChanged(100*time.Millisecond, 105*time.Millisecond) {
+		t.Fatal("jitter is a change")
+	}
+	if !delayChanged(100*time.Millisecond, 150*time.Millisecond) {
+		t.Fatal("change not found")
+	}
+	if delayChanged(time.Millisecond, 5*time.Millisecond) {
+		t.Fatal("tiny change is a change")
+	}
+}
+
+func TestRouteEvents(t *testing.T) {
+	re := newRouteEvents()
+	if re.watched() {
+		t.Fatal("watched without watcher")
+	}
+	all := re.watch(comm.ServiceRouteQuery{})
+	web := re.watch(comm.ServiceRouteQuery{Name: "web*", Node: "n1"})
+	re.emitUnit(comm.RouteEventRegister, comm.ServiceRouteViewUnit{Name: "web", Node: "n1"})
+	re.emitUnit(comm.RouteEventRegister, comm.ServiceRouteViewUnit{Name: "db", Node: "n1"})
+	re.emitUnit(comm.RouteEventRegister, comm.ServiceRouteViewUnit{Name: "web", Node: "n1", Settings: comm.Settings{SwitchHide: true}})
+	re.emitNode(comm.RouteEventNodeUp, "n2")
+	if len(all.ch) != 3 || len(web.ch) != 1 {
+		t.Fatal("unexpected events:", len(all.ch), len(web.ch))
+	}
+	for i := 0; i < routeEventBuffer; i++ {
+		re.emitNode(comm.RouteEventNodeDown, "n1")
+	}
+	select {
+	case <-all.drop:
+	default:
+		t.Fatal("slow watcher not dropped")
+	}
+	re.unwatch(web)
+	if re.watched() {
+		t.Fatal("watched after unwatch")
+	}
+}
+
+func TestRouteNodeDown(t *testing.T) {
+	r := (&Server{}).newRoute("n0", 0)
+	rw := r.events.watch(comm.ServiceRouteQuery{})
+	u1, u2 := &remoteRouteUnit{node: "n1"}, &remoteRouteUnit{node: "n1"}
+	r.setRemote("n1", u1)
+	if len(rw.ch) != 1 || (<-rw.ch).Type != comm.RouteEventNodeUp {
+		t.Fatal("node up not emitted")
+	}
+	// nothing removed, the node is still up
+	r.delRemote("n1", u2)
+	r.delRemote("n2", u2)
+	if len(rw.ch) != 0 {
+		t.Fatal("node down emitted without removal:", (<-rw.ch).Node)
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamKeeper serializes the sends of a relayed stream and answers the keepalive probes on it.
+// A probe is an empty message, the receiver echoes it unless it is waiting for the answer of its own probe.
+type streamKeeper struct {
+	xrpc.Stream
+	mux     sync.Mutex
+	last    atomic.Int64 // unix nano of the last received message
+	probing atomic.Bool
+}
+
+func newStreamKeeper(stream xrpc.Stream) *streamKeeper {
+	sk := &streamKeeper{Stream: stream}
+	sk.last.Store(time.Now().UnixNano())
+	return sk
+}
+
+func (sk *streamKeeper) send(b []byte) error {
+	sk.mux.Lock()
+	defer sk.mux.Unlock()
+	return sk.Stream.Send(b)
+}
+
+// recv returns the next data message, the probes are answered or consumed on the way.
+func (sk *streamKeeper) recv(b *[]byte) error {
+	for {
+		err := sk.Stream.Recv(b)
+		if err != nil {
+			return err
+		}
+		sk.last.Store(time.Now().UnixNano())
+		if len(*b) != 0 {
+			return nil
+		}
+		if !sk.probing.Swap(false) {
+			err = sk.send(nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// probe sends a probe when nothing was received for the interval, and reports false
+// if the previous probe was not answered within another interval.
+func (sk *streamKeeper) probe(now time.Time, interval time.Duration) bool {
+	silent := now.Sub(time.Unix(0, sk.last.Load()))
+	if silent < interval {
+		return true
+	}
+	if sk.probing.Load() {
+		return silent < 2*interval
+	}
+	sk.probing.Store(true)
+	return sk.send(nil) == nil
+}
+
+// idleWatcher closes a link or proxy stream that carried no data for the idle timeout,
+// or whose peer stopped answering the keepalive probes.
+type idleWatcher struct {
+	idle      time.Duration
+	keepAlive time.Duration
+	active    atomic.Int64 // unix nano of the last data
+	keepers   []*streamKeeper
+	skip      func() bool // the idle timeout does not apply while it reports true, nil is never
+}
+
+func newIdleWatcher(idle, keepAlive time.Duration, keepers ...*streamKeeper) *idleWatcher {
+	iw := &idleWatcher{idle: idle, keepAlive: keepAlive, keepers: keepers}
+	iw.touch()
+	return iw
+}
+
+func (iw *idleWatcher) touch() {
+	iw.active.Store(time.Now().UnixNano())
+}
+
+// check returns the close reason, or empty if the stream is still alive.
+func (iw *idleWatcher) check(now time.Time) string {
+	if iw.idle > 0 && (iw.skip == nil || !iw.skip()) && now.Sub(time.Unix(0, iw.active.Load())) >= iw.idle {
+		return comm.CloseReasonIdle
+	}
+	if iw.keepAlive > 0 {
+		for _, sk := range iw.keepers {
+			if !sk.probe(now, iw.keepAlive) {
+				return comm.CloseReasonKeepAlive
+			}
+		}
+	}
+	return ""
+}
+
+// run checks until ctx is done, closeFn is called once with the reason.
+func (iw *idleWatcher) run(ctx context.Context, closeFn func(reason string)) {
+	tick := iw.idle
+	if iw.keepAlive > 0 && (tick == 0 || iw.keepAlive < tick) {
+		tick = iw.keepAlive
+	}
+	if tick == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(max(tick/4, 100*time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if reason := iw.check(now); reason != "" {
+					closeFn(reason)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// getIdleTimeout returns the idle timeout of a link, the setting of a local service overrides
+// the server one and a negative setting turns it off.
+func (s *Server) getIdleTimeout(rrpc xrpc.ReverseRpc) time.Duration {
+	if unit, ok := rrpc.(*localRouteUnit); ok && unit.info.Settings.IdleTimeout != 0 {
+		return time.Duration(max(unit.info.Settings.IdleTimeout, 0)) * time.Millisecond
+	}
+	return s.idleTimeout
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"testing"
+	"time"
+)
+
+type testProbeStream struct {
+	xrpc.Stream
+	sent int
+}
+
+func (tps *testProbeStream) Send(a any) error {
+	tps.sent++
+	return nil
+}
+
+func TestIdleWatcher(t *testing.T) {
+	iw := newIdleWatcher(time.Second, 0)
+	now := time.Now()
+	if iw.check(now) != "" {
+		t.Fatal("active link closed")
+	}
+	if iw.check(now.Add(time.Second)) != comm.CloseReasonIdle {
+		t.Fatal("idle link not closed")
+	}
+	iw = newIdleWatcher(0, 0)
+	if iw.check(now.Add(time.Hour)) != "" {
+		t.Fatal("closed without timeout")
+	}
+}
+
+func TestIdleWatcherKeepAlive(t *testing.T) {
+	stream := &testProbeStream{}
+	sk := newStreamKeeper(stream)
+	iw := newIdleWatcher(0, time.Second, sk)
+	now := time.Now()
+	if iw.check(now) != "" || stream.sent != 0 {
+		t.Fatal("probe sent too early")
+	}
+	if iw.check(now.Add(time.Second)) != "" || stream.sent != 1 {
+		t.Fatal("probe not sent")
+	}
+	if iw.check(now.Add(1500*time.Millisecond)) != "" || stream.sent != 1 {
+		t.Fatal("probe sent twice")
+	}
+	if iw.check(now.Add(2*time.Second)) != comm.CloseReasonKeepAlive {
+		t.Fatal("dead peer not closed")
+	}
+
+	// an answered probe keeps the link
+	sk.last.Store(now.Add(2 * time.Second).UnixNano())
+	sk.probing.Store(false)
+	if iw.check(now.Add(2500*time.Millisecond)) != "" {
+		t.Fatal("alive peer closed")
+	}
+}
+
+func TestIdleWatcherP2P(t *testing.T) {
+	lb := &linkBox{lm: &linkManager{s: &Server{}}, info: &linkInfo{lid: "l1", idle: time.Second}}
+	iw := lb.newWatcher()
+	now := time.Now()
+	if err := lb.setP2P(0, "l1", &comm.LinkP2PView{Error: "p2p failed"}); err != nil {
+		t.Fatal(err)
+	}
+	if iw.check(now.Add(2*time.Second)) != comm.CloseReasonIdle {
+		t.Fatal("idle relay link not closed")
+	}
+	if err := lb.setP2P(1<<63, "l1", &comm.LinkP2PView{Network: "udp"}); err != nil {
+		t.Fatal(err)
+	}
+	if iw.check(now.Add(2*time.Second)) != "" {
+		t.Fatal("p2p link closed by the idle timeout")
+	}
+}
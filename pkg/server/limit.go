@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"sync"
+	"time"
+)
+
+const (
+	dirUp   = 0 // source -> target
+	dirDown = 1 // target -> source
+)
+
+// tokenBucket limits bytes per second, the burst is one second of the rate.
+type tokenBucket struct {
+	mux    sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens and returns how long the caller should wait before sending them.
+func (tb *tokenBucket) reserve(n int) time.Duration {
+	tb.mux.Lock()
+	defer tb.mux.Unlock()
+	now := time.Now()
+	tb.tokens = min(tb.rate, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+type rateMeter struct {
+	mux sync.Mutex
+	sec int64
+	cur int64
+	pre int64
+}
+
+func (rm *rateMeter) add(n int) {
+	rm.mux.Lock()
+	defer rm.mux.Unlock()
+	sec := time.Now().Unix()
+	if sec != rm.sec {
+		if sec == rm.sec+1 {
+			rm.pre = rm.cur
+		} else {
+			rm.pre = 0
+		}
+		rm.sec = sec
+		rm.cur = 0
+	}
+	rm.cur += int64(n)
+}
+
+// rate returns the bytes of the last whole second.
+func (rm *rateMeter) rate() int64 {
+	rm.mux.Lock()
+	defer rm.mux.Unlock()
+	switch time.Now().Unix() {
+	case rm.sec:
+		return rm.pre
+	case rm.sec + 1:
+		return rm.cur
+	default:
+		return 0
+	}
+}
+
+type sharedBucket struct {
+	ref     int
+	buckets [2]*tokenBucket
+}
+
+// rateLimiter limits one link or proxy stream by all scopes it belongs to.
+type rateLimiter struct {
+	buckets [][2]*tokenBucket
+	limit   [2]int64
+	meter   [2]rateMeter
+	release func()
+	traffic *trafficCounter
+}
+
+func (rl *rateLimiter) wait(ctx context.Context, dir int, n int) error {
+	rl.meter[dir].add(n)
+	if rl.traffic != nil {
+		rl.traffic.add(dir, n)
+	}
+	var d time.Duration
+	for _, one := range rl.buckets {
+		if one[dir] != nil {
+			d = max(d, one[dir].reserve(n))
+		}
+	}
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (rl *rateLimiter) add(buckets [2]*tokenBucket, rate int64) {
+	if rate <= 0 {
+		return
+	}
+	rl.buckets = append(rl.buckets, buckets)
+	for i := range rl.limit {
+		if rl.limit[i] == 0 || rate < rl.limit[i] {
+			rl.limit[i] = rate
+		}
+	}
+}
+
+func (rl *rateLimiter) rate() [2]int64 {
+	return [2]int64{rl.meter[dirUp].rate(), rl.meter[dirDown].rate()}
+}
+
+func (rl *rateLimiter) close() {
+	if rl.release != nil {
+		rl.release()
+	}
+	if rl.traffic != nil {
+		rl.traffic.close()
+	}
+}
+
+type rateManager struct {
+	cfg      config.RateLimitConfig
+	server   [2]*tokenBucket
+	mux      sync.Mutex
+	users    map[string]*sharedBucket
+	services map[string]*sharedBucket
+}
+
+func newRateManager(cfg *config.RateLimitConfig) *rateManager {
+	rm := &rateManager{
+		users:    make(map[string]*sharedBucket),
+		services: make(map[string]*sharedBucket),
+	}
+	if cfg != nil {
+		rm.cfg = *cfg
+	}
+	rm.server = [2]*tokenBucket{newTokenBucket(rm.cfg.Server), newTokenBucket(rm.cfg.Server)}
+	return rm
+}
+
+// newLimiter makes the limiter of a link or proxy stream, an empty user or service skips its scope.
+func (rm *rateManager) newLimiter(user, service string) *rateLimiter {
+	rl := &rateLimiter{}
+	rm.mux.Lock()
+	defer rm.mux.Unlock()
+	rl.add(rm.server, rm.cfg.Server)
+	var releases []func()
+	if user != "" {
+		if rate := rm.getRate(rm.cfg.Users, rm.cfg.User, user); rate > 0 {
+			rl.add(rm.acquire(rm.users, user, rate), rate)
+			releases = append(releases, func() { rm.releaseBucket(rm.users, user) })
+		}
+	}
+	if service != "" {
+		if rate := rm.getRate(rm.cfg.Services, rm.cfg.Service, service); rate > 0 {
+			rl.add(rm.acquire(rm.services, service, rate), rate)
+			releases = append(releases, func() { rm.releaseBucket(rm.services, service) })
+		}
+	}
+	rl.add([2]*tokenBucket{newTokenBucket(rm.cfg.Link), newTokenBucket(rm.cfg.Link)}, rm.cfg.Link)
+	rl.release = func() {
+		rm.mux.Lock()
+		defer rm.mux.Unlock()
+		for _, fn := range releases {
+			fn()
+		}
+	}
+	return rl
+}
+
+func (rm *rateManager) getRate(m map[string]int64, def int64, key string) int64 {
+	if rate, ok := m[key]; ok {
+		return rate
+	}
+	return def
+}
+
+func (rm *rateManager) acquire(m map[string]*sharedBucket, key string, rate int64) [2]*tokenBucket {
+	sb, ok := m[key]
+	if !ok {
+		sb = &sharedBucket{buckets: [2]*tokenBucket{newTokenBucket(rate), newTokenBucket(rate)}}
+		m[key] = sb
+	}
+	sb.ref++
+	return sb.buckets
+}
+
+func (rm *rateManager) releaseBucket(m map[string]*sharedBucket, key string) {
+	sb, ok := m[key]
+	if !ok {
+		return
+	}
+	sb.ref--
+	if sb.ref <= 0 {
+		delete(m, key)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rm := newRateManager(&config.RateLimitConfig{
+		User:     1000,
+		Link:     2000,
+		Services: map[string]int64{"tl": 500},
+	})
+	rl := rm.newLimiter("u", "tl")
+	if rl.limit != [2]int64{500, 500} {
+		t.Fatal("limit", rl.limit)
+	}
+	if rl2 := rm.newLimiter("u", "tl"); rm.users["u"].ref != 2 {
+		t.Fatal("shared user bucket")
+	} else {
+		rl2.close()
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err := rl.wait(context.Background(), dirUp, 250)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatal("not limited", d)
+	}
+	if rl.wait(context.Background(), dirDown, 250) != nil {
+		t.Fatal("download limited by upload")
+	}
+	rl.close()
+	if len(rm.users) != 0 || len(rm.services) != 0 {
+		t.Fatal("release")
+	}
+	if rl := rm.newLimiter("", ""); rl.limit != [2]int64{2000, 2000} {
+		t.Fatal("empty scope", rl.limit)
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"errors"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
 	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
 	"github.com/peakedshout/go-pandorasbox/tool/expired"
 	"github.com/peakedshout/go-pandorasbox/xrpc"
@@ -57,13 +58,15 @@ func (lm *linkManager) newBox(rctx context.Context, info *linkInfo) *linkBox {
 	defer lm.lock.Unlock()
 	ctx, cl := context.WithCancel(rctx)
 	box := &linkBox{
-		lm:   lm,
-		id:   id,
-		info: info,
-		ctx:  ctx,
-		cl:   cl,
-		run:  make(chan struct{}),
+		lm:    lm,
+		id:    id,
+		info:  info,
+		ctx:   ctx,
+		cl:    cl,
+		run:   make(chan struct{}),
+		limit: lm.s.rate.newLimiter(info.user, info.link),
 	}
+	box.limit.traffic = lm.s.traffic.account(info.trafficKey())
 	lm.boxMap[id] = box
 	lm.expiredCtx.SetWithDuration(box, lm.linkTimeout)
 	ctxtool.GWaitFunc(ctx, box.ExpiredFunc)
@@ -72,6 +75,7 @@ func (lm *linkManager) newBox(rctx context.Context, info *linkInfo) *linkBox {
 
 type linkInfo struct {
 	link        string
+	user        string
 	sit         [3]string // source itself target
 	stSessId    [2]string // source target init sess id
 	ppStreamId  [2]string // source target p sess_stream id
@@ -79,6 +83,17 @@ type linkInfo struct {
 	lid         string // identification bit instead of reliable uuid
 	lList       []string
 	nList       []string
+	idle        time.Duration
+	closeReason string
+	p2p         [2]*comm.LinkP2PView // source target
+}
+
+func (li *linkInfo) trafficKey() trafficKey {
+	node := li.sit[2]
+	if node == "" {
+		node = li.sit[1]
+	}
+	return trafficKey{user: li.user, service: li.link, node: node}
 }
 
 type linkBox struct {
@@ -92,10 +107,15 @@ type linkBox struct {
 
 	run chan struct{}
 
+	limit *rateLimiter
+	watch *idleWatcher
+
 	closer sync.Once
 	mux    sync.Mutex
+	direct atomic.Bool // a side reported a working p2p connection, the relay only carries the keepalives
 	p1     xrpc.Stream // from
 	p2     xrpc.Stream // to
+	k1, k2 *streamKeeper
 }
 
 func (lb *linkBox) Id() any {
@@ -113,6 +133,7 @@ func (lb *linkBox) getId(r bool) uint64 {
 func (lb *linkBox) ExpiredFunc() {
 	lb.closer.Do(func() {
 		lb.cl()
+		lb.limit.close()
 		lb.mux.Lock()
 		if lb.p1 != nil {
 			_ = lb.p1.Close()
@@ -134,6 +155,25 @@ func (lb *linkBox) ExpiredFunc() {
 	})
 }
 
+// alive reports whether the link is neither closed nor waiting in the cache of the link view.
+func (lb *linkBox) alive() bool {
+	if lb.ctx.Err() != nil {
+		return false
+	}
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	return lb.info.closeReason == ""
+}
+
+// closeWith closes the working link and keeps the reason for the link view.
+func (lb *linkBox) closeWith(reason string) {
+	lb.mux.Lock()
+	lb.info.closeReason = reason
+	lb.mux.Unlock()
+	lb.lm.s.logger.Info("server:", lb.lm.s.nodeName, "close link:", lb.info.lid, "reason:", reason)
+	lb.ExpiredFunc()
+}
+
 func (lb *linkBox) doExpired() {
 	lb.lm.expiredCtx.Remove(lb.id, true)
 }
@@ -142,6 +182,31 @@ func (lb *linkBox) delExpired() {
 	lb.lm.expiredCtx.Remove(lb.id, false)
 }
 
+// setP2P records the p2p result reported by the side of id.
+func (lb *linkBox) setP2P(id uint64, lid string, view *comm.LinkP2PView) error {
+	if lb.info.lid != lid {
+		return ErrInvalidLinkId
+	}
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	if (id>>63)&1 == 1 {
+		lb.info.p2p[1] = view
+	} else {
+		lb.info.p2p[0] = view
+	}
+	if view.Error == "" {
+		lb.direct.Store(true)
+	}
+	return nil
+}
+
+// newWatcher returns the idle watcher of the working link, the p2p links are kept without data on the relay.
+func (lb *linkBox) newWatcher() *idleWatcher {
+	iw := newIdleWatcher(lb.info.idle, lb.lm.s.keepAlive, lb.k1, lb.k2)
+	iw.skip = lb.direct.Load
+	return iw
+}
+
 func (lb *linkBox) join(id uint64, lid string, sess xrpc.Stream) error {
 	if lb.ctx.Err() != nil || lb.info.lid != lid {
 		return ErrInvalidLinkId
@@ -162,6 +227,7 @@ func (lb *linkBox) join(id uint64, lid string, sess xrpc.Stream) error {
 		}
 		lb.info.ppStreamId[0] = sess.Id()
 		lb.p2 = sess
+		lb.k2 = newStreamKeeper(sess)
 		if lb.p1 != nil {
 			lb.delExpired()
 			s = true
@@ -174,6 +240,7 @@ func (lb *linkBox) join(id uint64, lid string, sess xrpc.Stream) error {
 		}
 		lb.info.ppStreamId[1] = sess.Id()
 		lb.p1 = sess
+		lb.k1 = newStreamKeeper(sess)
 		if lb.p2 != nil {
 			lb.delExpired()
 			s = true
@@ -188,6 +255,8 @@ func (lb *linkBox) join(id uint64, lid string, sess xrpc.Stream) error {
 		if err != nil {
 			return err
 		}
+		lb.watch = lb.newWatcher()
+		lb.watch.run(lb.ctx, lb.closeWith)
 		close(lb.run)
 	}
 	select {
@@ -198,20 +267,25 @@ func (lb *linkBox) join(id uint64, lid string, sess xrpc.Stream) error {
 	case <-lb.run:
 	}
 
-	var obj xrpc.Stream
+	own, obj := lb.k1, lb.k2
+	dir := dirUp
 	if isP2 {
-		obj = lb.p1
-	} else {
-		obj = lb.p2
+		own, obj = lb.k2, lb.k1
+		dir = dirDown
 	}
 
 	var b []byte
 	for {
-		err := sess.Recv(&b)
+		err := own.recv(&b)
+		if err != nil {
+			return err
+		}
+		lb.watch.touch()
+		err = lb.limit.wait(lb.ctx, dir, len(b))
 		if err != nil {
 			return err
 		}
-		err = obj.Send(b)
+		err = obj.send(b)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	natProbeCount    = 3
+	natProbeInterval = 100 * time.Millisecond
+	maxNatProbeToken = 64
+)
+
+// handleNatMap lets the client read the public address of its session, then waits until the client closes the stream.
+func (s *Server) handleNatMap(ctx xrpc.Stream) error {
+	err := s.allow(ctx.Context(), config.RoleLink)
+	if err != nil {
+		return err
+	}
+	err = ctx.Recv(nil)
+	if err != nil {
+		return err
+	}
+	err = ctx.Send(nil)
+	if err != nil {
+		return err
+	}
+	_ = ctx.Recv(nil)
+	return nil
+}
+
+// handleNatProbe sends the token of the client from a new udp port to the address,
+// only the public ip of the client session is allowed so that the node can not be used to flood others.
+func (s *Server) handleNatProbe(ctx xrpc.Rpc) (any, error) {
+	err := s.allow(ctx.Context(), config.RoleLink)
+	if err != nil {
+		return nil, err
+	}
+	var req comm.NatProbeRequest
+	err = ctx.Bind(&req)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Token) == 0 || len(req.Token) > maxNatProbeToken {
+		return nil, ErrPermissionDenied.Errorf("invalid nat probe token")
+	}
+	addr, err := netip.ParseAddrPort(req.Address)
+	if err != nil {
+		return nil, err
+	}
+	pub, _ := xrpc.GetSessionAuthInfoT[string](ctx.Context(), xrpc.LocalPubAddress)
+	host, _, err := net.SplitHostPort(pub)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || ip.Unmap() != addr.Addr().Unmap() {
+		return nil, ErrNatProbeDenied.Errorf(req.Address)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	for i := 0; i < natProbeCount; i++ {
+		if i != 0 {
+			select {
+			case <-ctx.Context().Done():
+				return nil, ctx.Context().Err()
+			case <-time.After(natProbeInterval):
+			}
+		}
+		_, err = conn.WriteToUDPAddrPort(req.Token, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
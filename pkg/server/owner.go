@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"path"
+	"slices"
+	"sync"
+)
+
+// getUser returns the authenticated principal of the session, sessions without a username fall back to the node auth user.
+// The username is only trusted if the server checks the user/password, otherwise any client could claim any name.
+func (s *Server) getUser(ctx context.Context) string {
+	if !s.auth {
+		return s.user
+	}
+	user, err := xrpc.GetSessionAuthInfoT[string](ctx, comm.UserName)
+	if err != nil || user == "" {
+		return s.user
+	}
+	return user
+}
+
+type serviceOwner struct {
+	owners []string
+	grants map[string]struct{}
+	count  int // registered listeners of the name, the owner is dropped with the last one
+}
+
+func (so *serviceOwner) isOwner(user string) bool {
+	return slices.Contains(so.owners, user)
+}
+
+func (so *serviceOwner) allow(user string) bool {
+	if so.isOwner(user) {
+		return true
+	}
+	_, ok := so.grants[user]
+	return ok
+}
+
+type ownerManager struct {
+	mux    sync.Mutex
+	static []config.ServiceOwnerConfig
+	remote func(name string) (owners, grants []string)
+	m      map[string]*serviceOwner
+}
+
+// newOwnerManager returns the owner manager, remote looks up the owners and the grants of a name in the synced routes.
+func newOwnerManager(static []config.ServiceOwnerConfig, remote func(name string) (owners, grants []string)) *ownerManager {
+	return &ownerManager{
+		static: static,
+		remote: remote,
+		m:      make(map[string]*serviceOwner),
+	}
+}
+
+// claim checks whether user may register the service name and returns the owners of the name. A name not listed in
+// the config and not owned locally is owned by the owners of the synced routes, or else by its first registrant.
+// Owners may grant co-registration to other users. Each successful claim must be released.
+func (om *ownerManager) claim(info *comm.RegisterListenerInfo, user string) ([]string, error) {
+	om.mux.Lock()
+	defer om.mux.Unlock()
+	so, ok := om.m[info.Name]
+	if !ok {
+		so = &serviceOwner{grants: make(map[string]struct{})}
+		if owners := om.getStatic(info.Name); owners != nil {
+			so.owners = owners
+		} else if owners, grants := om.getRemote(info.Name); owners != nil {
+			so.owners = owners
+			for _, one := range grants {
+				so.grants[one] = struct{}{}
+			}
+		} else {
+			so.owners = []string{user}
+		}
+	}
+	if !so.allow(user) {
+		return nil, ErrServiceOwned.Errorf(info.Name)
+	}
+	if so.isOwner(user) {
+		for _, one := range info.Grants {
+			so.grants[one] = struct{}{}
+		}
+	}
+	so.count++
+	om.m[info.Name] = so
+	return so.owners, nil
+}
+
+// release drops the listener of a claim, the owner of the name is forgotten with its last listener.
+func (om *ownerManager) release(name string) {
+	om.mux.Lock()
+	defer om.mux.Unlock()
+	so, ok := om.m[name]
+	if !ok {
+		return
+	}
+	so.count--
+	if so.count <= 0 {
+		delete(om.m, name)
+	}
+}
+
+func (om *ownerManager) getRemote(name string) ([]string, []string) {
+	if om.remote == nil {
+		return nil, nil
+	}
+	return om.remote(name)
+}
+
+func (om *ownerManager) getStatic(name string) []string {
+	for _, one := range om.static {
+		if ok, _ := path.Match(one.Name, name); ok {
+			return one.Owners
+		}
+	}
+	return nil
+}
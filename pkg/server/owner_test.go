@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"slices"
+	"testing"
+)
+
+func TestOwnerManager(t *testing.T) {
+	remote := map[string][2][]string{"synced": {{"dave"}, {"erin"}}}
+	om := newOwnerManager([]config.ServiceOwnerConfig{{Name: "web-*", Owners: []string{"alice"}}}, func(name string) ([]string, []string) {
+		return remote[name][0], remote[name][1]
+	})
+	claim := func(info *comm.RegisterListenerInfo, user string) error {
+		_, err := om.claim(info, user)
+		return err
+	}
+	if claim(&comm.RegisterListenerInfo{Name: "web-a"}, "bob") == nil {
+		t.Fatal("static owner")
+	}
+	if err := claim(&comm.RegisterListenerInfo{Name: "web-a", Grants: []string{"bob"}}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := claim(&comm.RegisterListenerInfo{Name: "web-a"}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := claim(&comm.RegisterListenerInfo{Name: "tl"}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if claim(&comm.RegisterListenerInfo{Name: "tl"}, "alice") == nil {
+		t.Fatal("first registrant owner")
+	}
+	if claim(&comm.RegisterListenerInfo{Name: "tl", Grants: []string{"alice"}}, "carol") == nil {
+		t.Fatal("grant by non owner")
+	}
+	// the owner is dropped with the last listener
+	om.release("tl")
+	if err := claim(&comm.RegisterListenerInfo{Name: "tl"}, "alice"); err != nil {
+		t.Fatal("owner kept after release:", err)
+	}
+	om.release("tl")
+	if len(om.m) != 1 {
+		t.Fatal("owners left after release:", len(om.m))
+	}
+	// a name owned on a synced node
+	if claim(&comm.RegisterListenerInfo{Name: "synced"}, "bob") == nil {
+		t.Fatal("name owned on a synced node claimed")
+	}
+	if owners, err := om.claim(&comm.RegisterListenerInfo{Name: "synced"}, "dave"); err != nil || !slices.Equal(owners, []string{"dave"}) {
+		t.Fatal("synced owner refused:", owners, err)
+	}
+	if err := claim(&comm.RegisterListenerInfo{Name: "synced"}, "erin"); err != nil {
+		t.Fatal("synced grant refused:", err)
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	ctx, err := xrpc.SetSessionAuthInfoT[string](context.Background(), comm.UserName, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{user: "node"}
+	if user := s.getUser(ctx); user != "node" {
+		t.Fatal("unverified username:", user)
+	}
+	s.auth = true
+	if user := s.getUser(ctx); user != "alice" {
+		t.Fatal("verified username:", user)
+	}
+	if user := s.getUser(context.Background()); user != "node" {
+		t.Fatal("node user:", user)
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"net"
+	"slices"
+	"strings"
+)
+
+type egressRule struct {
+	allow    bool
+	users    []string
+	networks []string
+	nets     []*net.IPNet
+	ports    [][2]uint16
+	domains  []string
+}
+
+func (er *egressRule) match(user, network, host string, ip net.IP, port uint16) bool {
+	if len(er.users) != 0 && !slices.Contains(er.users, user) {
+		return false
+	}
+	if len(er.networks) != 0 && !slices.Contains(er.networks, network) {
+		return false
+	}
+	if len(er.nets) != 0 && !slices.ContainsFunc(er.nets, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+		return false
+	}
+	if len(er.ports) != 0 && !slices.ContainsFunc(er.ports, func(r [2]uint16) bool { return port >= r[0] && port <= r[1] }) {
+		return false
+	}
+	if len(er.domains) != 0 && !slices.ContainsFunc(er.domains, func(d string) bool { return matchDomain(host, d) }) {
+		return false
+	}
+	return true
+}
+
+func matchDomain(host, suffix string) bool {
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return host == suffix || strings.HasSuffix(host, "."+suffix)
+}
+
+// egressPolicy decides which targets the proxy may dial, the rules are checked in order.
+type egressPolicy struct {
+	rules []egressRule
+	deny  bool
+}
+
+func newEgressPolicy(list []config.ProxyPolicyConfig, def string) (*egressPolicy, error) {
+	ep := &egressPolicy{deny: def == config.PolicyDeny}
+	for _, one := range list {
+		err := one.Check()
+		if err != nil {
+			return nil, err
+		}
+		rule := newEgressRule(one.Users, one.Network, one.CIDR, one.Ports, one.Domains)
+		rule.allow = one.Action == config.PolicyAllow
+		ep.rules = append(ep.rules, rule)
+	}
+	return ep, nil
+}
+
+// newEgressRule makes the rule from the checked config fields.
+func newEgressRule(users, network, cidr, ports, domains []string) egressRule {
+	rule := egressRule{
+		users:    users,
+		networks: network,
+	}
+	for _, s := range cidr {
+		ipNet, _ := config.ParseCIDR(s)
+		rule.nets = append(rule.nets, ipNet)
+	}
+	for _, s := range ports {
+		l, r, _ := config.ParsePortRange(s)
+		rule.ports = append(rule.ports, [2]uint16{l, r})
+	}
+	for _, s := range domains {
+		rule.domains = append(rule.domains, strings.Trim(strings.ToLower(s), "."))
+	}
+	return rule
+}
+
+func (ep *egressPolicy) empty() bool {
+	return len(ep.rules) == 0 && !ep.deny
+}
+
+// allow checks the resolved ip of the target, host is the requested name used by domain rules.
+func (ep *egressPolicy) allow(user, network, host string, ip net.IP, port uint16) bool {
+	for i := range ep.rules {
+		if ep.rules[i].match(user, network, host, ip, port) {
+			return ep.rules[i].allow
+		}
+	}
+	return !ep.deny
+}
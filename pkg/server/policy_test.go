@@ -0,0 +1,40 @@
+package server
+
+import (
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"net"
+	"testing"
+)
+
+func TestEgressPolicy(t *testing.T) {
+	ep, err := newEgressPolicy([]config.ProxyPolicyConfig{
+		{Action: config.PolicyAllow, Users: []string{"admin"}},
+		{Action: config.PolicyDeny, CIDR: []string{"127.0.0.0/8", "169.254.169.254"}},
+		{Action: config.PolicyAllow, Domains: []string{"example.com"}, Ports: []string{"443", "8000-9000"}},
+		{Action: config.PolicyAllow, Network: []string{"udp"}, CIDR: []string{"10.0.0.0/8"}},
+	}, config.PolicyDeny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		user, network, host, ip string
+		port                    uint16
+		allow                   bool
+	}{
+		{"admin", "tcp", "127.0.0.1", "127.0.0.1", 22, true},
+		{"u", "tcp", "localhost", "127.0.0.1", 443, false},
+		{"u", "tcp", "evil.example.com", "169.254.169.254", 443, false},
+		{"u", "tcp", "www.example.com", "93.184.216.34", 443, true},
+		{"u", "tcp", "www.example.com", "93.184.216.34", 8080, true},
+		{"u", "tcp", "www.example.com", "93.184.216.34", 80, false},
+		{"u", "tcp", "badexample.com", "93.184.216.34", 443, false},
+		{"u", "tcp", "93.184.216.34", "93.184.216.34", 443, false},
+		{"u", "udp", "10.1.1.1", "10.1.1.1", 53, true},
+		{"u", "tcp", "10.1.1.1", "10.1.1.1", 53, false},
+	}
+	for i, c := range cases {
+		if ep.allow(c.user, c.network, c.host, net.ParseIP(c.ip), c.port) != c.allow {
+			t.Fatal("case", i)
+		}
+	}
+}
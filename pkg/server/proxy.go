@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/peakedshout/anchorage-core/pkg/comm"
 	"github.com/peakedshout/go-pandorasbox/tool/expired"
 	"github.com/peakedshout/go-pandorasbox/tool/tmap"
@@ -10,19 +11,107 @@ import (
 	"github.com/peakedshout/go-pandorasbox/xrpc"
 	"net"
 	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func (s *Server) dialProxy(ctx context.Context, req *comm.ProxyRequest) (net.Conn, error) {
+// proxyDialInfo is how the target of the proxy was dialed.
+type proxyDialInfo struct {
+	chain   []string      // upstream proxies dialed through, empty is direct
+	resolve time.Duration // time spent on the name resolution
+}
+
+// dialProxy dials the target of the proxy request, the direct addresses are raced by happy eyeballs.
+func (s *Server) dialProxy(ctx context.Context, user string, req *comm.ProxyRequest) (net.Conn, *proxyDialInfo, error) {
 	switch req.Network {
-	case "tcp", "udp":
-		dr := new(net.Dialer)
-		return dr.DialContext(ctx, req.Network, req.Address)
-	case "quic":
-		return xquic.DialContext(ctx, req.Network, req.Address)
+	case "tcp", "udp", "quic":
 	default:
-		return nil, errors.New("invalid network")
+		return nil, nil, errors.New("invalid network")
+	}
+	host, portStr, err := net.SplitHostPort(req.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := new(proxyDialInfo)
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		now := time.Now()
+		ips, err = s.resolver.lookup(ctx, host)
+		info.resolve = time.Since(now)
+		if err != nil {
+			if !s.policy.empty() || s.upstream.empty() {
+				return nil, info, err
+			}
+			// the name may be resolvable only behind the upstream
+			ips = []net.IP{nil}
+		}
+	}
+	// dial the checked ip instead of the name, so the target can not be changed by another resolution.
+	var direct, targets []string
+	var routes []*upstreamRoute
+	for _, ip := range ips {
+		if !s.policy.allow(user, req.Network, host, ip, uint16(port)) {
+			continue
+		}
+		address := req.Address
+		if ip != nil {
+			address = net.JoinHostPort(ip.String(), portStr)
+		}
+		route := s.upstream.route(user, req.Network, host, ip, uint16(port))
+		if route == nil {
+			direct = append(direct, address)
+			continue
+		}
+		// without a policy the upstream resolves the name by itself
+		if s.policy.empty() {
+			address = req.Address
+		}
+		routes = append(routes, route)
+		targets = append(targets, address)
+	}
+	var errs []error
+	if len(direct) != 0 {
+		conn, err := dialRace(ctx, direct, func(ctx context.Context, address string) (net.Conn, error) {
+			return s.dialProxyAddr(ctx, req.Network, address)
+		})
+		if err == nil {
+			return conn, info, nil
+		}
+		errs = append(errs, err)
+	}
+	for i, route := range routes {
+		conn, err := route.dial(ctx, req.Network, targets[i])
+		if err == nil {
+			info.chain = route.names
+			return conn, info, nil
+		}
+		errs = append(errs, err)
+		if targets[i] == req.Address {
+			break
+		}
+	}
+	if len(errs) != 0 {
+		return nil, info, errors.Join(errs...)
+	}
+	s.proxy.deny(user)
+	s.logger.Warn("server:", s.nodeName, "proxy deny ->", fmt.Sprintf("%s_%s", req.Network, req.Address), "user:", user)
+	return nil, info, ErrProxyDenied.Errorf(req.Address)
+}
+
+func (s *Server) dialProxyAddr(ctx context.Context, network string, address string) (net.Conn, error) {
+	if network == "quic" {
+		return xquic.DialContext(ctx, network, address)
 	}
+	dr := new(net.Dialer)
+	return dr.DialContext(ctx, network, address)
 }
 
 func newProxyManager(nm map[string][]*comm.NodeUnit, cache *expired.TODO, multi int) *proxyManager {
@@ -31,6 +120,7 @@ func newProxyManager(nm map[string][]*comm.NodeUnit, cache *expired.TODO, multi
 		cache:         cache,
 		timeout:       10 * time.Second,
 		cfg:           xrpc.NewTmpShareStreamConfig(false, multi),
+		deniedUsers:   make(map[string]int64),
 	}
 }
 
@@ -40,17 +130,36 @@ type proxyManager struct {
 	cache   *expired.TODO
 	timeout time.Duration
 	cfg     *xrpc.ShareStreamConfig
+
+	mux         sync.Mutex
+	denied      int64
+	deniedUsers map[string]int64
+}
+
+func (pm *proxyManager) deny(user string) {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	pm.denied++
+	pm.deniedUsers[user]++
 }
 
 type proxyInfo struct {
-	nodes []string
-	node  string
+	user   string
+	limit  *rateLimiter
+	nodes  []string
+	node   string
+	dial   *proxyDialInfo
+	reason atomic.Value
+	closed atomic.Bool // the stream is closed, the info is only kept for the proxy view
 
 	lnk, laddr, rnk, raddr, onk, oaddr string
 }
 
-func (pm *proxyManager) Record(l xrpc.Stream, node string, nodes []string, req *comm.ProxyRequest, t xrpc.Stream, conn net.Conn) func() {
-	info := &proxyInfo{node: node, nodes: nodes, onk: req.Network, oaddr: req.Address}
+func (pm *proxyManager) Record(l xrpc.Stream, user string, limit *rateLimiter, node string, nodes []string, req *comm.ProxyRequest, t xrpc.Stream, conn net.Conn, dial *proxyDialInfo) func() {
+	if dial == nil {
+		dial = new(proxyDialInfo)
+	}
+	info := &proxyInfo{user: user, limit: limit, node: node, nodes: nodes, dial: dial, onk: req.Network, oaddr: req.Address}
 	info.laddr, _ = xrpc.GetSessionAuthInfoT[string](l.Context(), xrpc.LocalPubAddress)
 	info.lnk, _ = xrpc.GetSessionAuthInfoT[string](l.Context(), xrpc.LocalPubNetwork)
 	if t != nil {
@@ -63,6 +172,7 @@ func (pm *proxyManager) Record(l xrpc.Stream, node string, nodes []string, req *
 	}
 	pm.m.Store(l, info)
 	return func() {
+		info.closed.Store(true)
 		fn := func() {
 			pm.m.Delete(l)
 		}
@@ -74,11 +184,20 @@ func (pm *proxyManager) Record(l xrpc.Stream, node string, nodes []string, req *
 	}
 }
 
-func (pm *proxyManager) View() map[string][]ProxyUnitView {
+// closeWith keeps the close reason of the proxy stream for the proxy view.
+func (pm *proxyManager) closeWith(l xrpc.Stream, reason string) {
+	if info, ok := pm.m.Load(l); ok {
+		info.reason.Store(reason)
+	}
+}
+
+func (pm *proxyManager) View() *ProxyView {
 	m := make(map[string][]ProxyUnitView)
 	pm.m.Range(func(stream xrpc.Stream, info *proxyInfo) bool {
+		reason, _ := info.reason.Load().(string)
 		m[info.node] = append(m[info.node], ProxyUnitView{
 			StreamView:    xrpc.GetStreamView(stream),
+			User:          info.user,
 			Nodes:         info.nodes,
 			Node:          info.node,
 			FromNetwork:   info.lnk,
@@ -87,6 +206,11 @@ func (pm *proxyManager) View() map[string][]ProxyUnitView {
 			ToAddress:     info.raddr,
 			TargetNetwork: info.onk,
 			TargetAddress: info.oaddr,
+			Chain:         info.dial.chain,
+			ResolveDelay:  info.dial.resolve,
+			Rate:          info.limit.rate(),
+			RateLimit:     info.limit.limit,
+			CloseReason:   reason,
 		})
 		return true
 	})
@@ -95,5 +219,15 @@ func (pm *proxyManager) View() map[string][]ProxyUnitView {
 			return list[i].MonitorInfo.CreateTime.Before(list[j].MonitorInfo.CreateTime)
 		})
 	}
-	return m
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	users := make(map[string]int64, len(pm.deniedUsers))
+	for k, v := range pm.deniedUsers {
+		users[k] = v
+	}
+	return &ProxyView{
+		Units:       m,
+		Denied:      pm.denied,
+		DeniedUsers: users,
+	}
 }
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	resolutionDelay = 50 * time.Millisecond  // rfc 8305 section 3
+	attemptDelay    = 250 * time.Millisecond // rfc 8305 section 5
+
+	maxResolveCache  = 4096             // cached answers, the hostnames come from the proxy users
+	systemResolveTTL = 30 * time.Second // the system resolver does not report the ttl
+)
+
+type resolveKey struct {
+	host  string
+	qtype uint16
+}
+
+type resolveCache struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+// resolver resolves the targets of the proxy, the answers of the configured dns servers are cached by their ttl,
+// and the answers of the system resolver for systemResolveTTL.
+type resolver struct {
+	exchanges  []func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	preferIPv4 bool
+	maxTTL     time.Duration
+
+	mux   sync.Mutex
+	cache map[resolveKey]*resolveCache
+}
+
+func newResolver(cfg *config.ResolverConfig) (*resolver, error) {
+	r := &resolver{cache: make(map[resolveKey]*resolveCache)}
+	if cfg == nil {
+		return r, nil
+	}
+	err := cfg.Check()
+	if err != nil {
+		return nil, err
+	}
+	r.preferIPv4 = cfg.PreferIPv4
+	r.maxTTL = time.Duration(cfg.MaxTTL) * time.Second
+	for _, one := range cfg.Upstreams {
+		r.exchanges = append(r.exchanges, newDnsExchange(one))
+	}
+	return r, nil
+}
+
+func newDnsExchange(cfg config.ResolverUpstreamConfig) func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	tlsCfg := &tls.Config{InsecureSkipVerify: cfg.InsecureTls}
+	if cfg.Network == config.ResolverHttps {
+		hc := &http.Client{Transport: &http.Transport{
+			ForceAttemptHTTP2:   true,
+			TLSClientConfig:     tlsCfg,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		}}
+		return func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+			b, err := m.Pack()
+			if err != nil {
+				return nil, err
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Address, bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/dns-message")
+			req.Header.Set("Accept", "application/dns-message")
+			resp, err := hc.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("doh status: %s", resp.Status)
+			}
+			b, err = io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+			if err != nil {
+				return nil, err
+			}
+			msg := new(dns.Msg)
+			return msg, msg.Unpack(b)
+		}
+	}
+	dc := &dns.Client{Net: cfg.Network}
+	if cfg.Network == config.ResolverTls {
+		dc.Net = "tcp-tls"
+		dc.TLSConfig = tlsCfg
+	}
+	return func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		msg, _, err := dc.ExchangeContext(ctx, m, cfg.Address)
+		return msg, err
+	}
+}
+
+// lookup resolves the ipv4 and ipv6 addresses of host at the same time, and sorts them for the happy eyeballs dial.
+func (r *resolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	type result struct {
+		v6  bool
+		ips []net.IP
+		err error
+	}
+	ch := make(chan result, 2)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		go func(qtype uint16) {
+			ips, err := r.query(ctx, host, qtype)
+			ch <- result{v6: qtype == dns.TypeAAAA, ips: ips, err: err}
+		}(qtype)
+	}
+	var v4, v6 []net.IP
+	var errs []error
+	var wait <-chan time.Time
+	for i := 0; i < 2; i++ {
+		var res result
+		select {
+		case res = <-ch:
+		case <-wait:
+			return sortAddresses(v4, v6, r.preferIPv4), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if res.err != nil {
+			errs = append(errs, res.err)
+		}
+		if res.v6 {
+			v6 = res.ips
+		} else {
+			v4 = res.ips
+		}
+		// one family has answered, give the other one a short while
+		if len(res.ips) != 0 && wait == nil {
+			wait = time.After(resolutionDelay)
+		}
+	}
+	if len(v4) == 0 && len(v6) == 0 {
+		if len(errs) != 0 {
+			return nil, errors.Join(errs...)
+		}
+		return nil, fmt.Errorf("no address of host: %s", host)
+	}
+	return sortAddresses(v4, v6, r.preferIPv4), nil
+}
+
+func (r *resolver) query(ctx context.Context, host string, qtype uint16) ([]net.IP, error) {
+	key := resolveKey{host: dns.Fqdn(host), qtype: qtype}
+	now := time.Now()
+	if ips, ok := r.getCache(key, now); ok {
+		return ips, nil
+	}
+	if len(r.exchanges) == 0 {
+		network := "ip4"
+		if qtype == dns.TypeAAAA {
+			network = "ip6"
+		}
+		ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			ips, err = nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.setCache(key, ips, systemResolveTTL, now)
+		return ips, nil
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(key.host, qtype)
+	var errs []error
+	for _, exchange := range r.exchanges {
+		msg, err := exchange(ctx, m)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+			errs = append(errs, fmt.Errorf("dns rcode: %s", dns.RcodeToString[msg.Rcode]))
+			continue
+		}
+		ips, ttl := parseAnswer(msg, qtype)
+		r.setCache(key, ips, ttl, now)
+		return ips, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (r *resolver) getCache(key resolveKey, now time.Time) ([]net.IP, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	one, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if now.Before(one.expire) {
+		return one.ips, true
+	}
+	delete(r.cache, key)
+	return nil, false
+}
+
+// setCache keeps the answer for ttl (at most maxTTL). When the cache is full, the expired answers are swept,
+// then the one expiring first is evicted.
+func (r *resolver) setCache(key resolveKey, ips []net.IP, ttl time.Duration, now time.Time) {
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.cache[key]; !ok && len(r.cache) >= maxResolveCache {
+		var oldest resolveKey
+		var first time.Time
+		for k, one := range r.cache {
+			if !now.Before(one.expire) {
+				delete(r.cache, k)
+			} else if first.IsZero() || one.expire.Before(first) {
+				oldest, first = k, one.expire
+			}
+		}
+		if len(r.cache) >= maxResolveCache {
+			delete(r.cache, oldest)
+		}
+	}
+	r.cache[key] = &resolveCache{ips: ips, expire: now.Add(ttl)}
+}
+
+// parseAnswer returns the addresses of the answer and the least ttl, the negative answer takes the ttl of the soa.
+func parseAnswer(msg *dns.Msg, qtype uint16) ([]net.IP, time.Duration) {
+	var ips []net.IP
+	ttl := uint32(0)
+	first := true
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch x := rr.(type) {
+		case *dns.A:
+			if qtype == dns.TypeA {
+				ip = x.A
+			}
+		case *dns.AAAA:
+			if qtype == dns.TypeAAAA {
+				ip = x.AAAA
+			}
+		}
+		if ip == nil {
+			continue
+		}
+		ips = append(ips, ip)
+		if first || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			first = false
+		}
+	}
+	if len(ips) == 0 {
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = min(soa.Hdr.Ttl, soa.Minttl)
+			}
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second
+}
+
+// sortAddresses interleaves the two families and begins with the preferred one (rfc 8305 section 4).
+func sortAddresses(v4, v6 []net.IP, preferIPv4 bool) []net.IP {
+	first, second := v6, v4
+	if preferIPv4 {
+		first, second = v4, v6
+	}
+	list := make([]net.IP, 0, len(v4)+len(v6))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			list = append(list, first[i])
+		}
+		if i < len(second) {
+			list = append(list, second[i])
+		}
+	}
+	return list
+}
+
+// dialRace starts the next attempt when the previous one failed or did not finish within the attempt delay,
+// the first connected attempt wins and the others are canceled (rfc 8305 section 5).
+func dialRace(ctx context.Context, addrs []string, dial func(ctx context.Context, address string) (net.Conn, error)) (net.Conn, error) {
+	if len(addrs) == 1 {
+		return dial(ctx, addrs[0])
+	}
+	type result struct {
+		i    int
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, len(addrs))
+	cancels := make([]context.CancelFunc, 0, len(addrs))
+	defer func() {
+		for _, cl := range cancels {
+			if cl != nil {
+				cl()
+			}
+		}
+	}()
+	start := func() <-chan time.Time {
+		i := len(cancels)
+		actx, cl := context.WithCancel(ctx)
+		cancels = append(cancels, cl)
+		go func() {
+			conn, err := dial(actx, addrs[i])
+			ch <- result{i: i, conn: conn, err: err}
+		}()
+		if len(cancels) == len(addrs) {
+			return nil
+		}
+		return time.After(attemptDelay)
+	}
+	next := start()
+	var errs []error
+	for pending := 1; pending > 0; {
+		select {
+		case res := <-ch:
+			pending--
+			if res.err == nil {
+				// keep the winner's context, the others are canceled and their late conns closed
+				cancels[res.i] = nil
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-ch; late.conn != nil {
+							_ = late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+			if len(cancels) < len(addrs) {
+				next = start()
+				pending++
+			}
+		case <-next:
+			next = start()
+			pending++
+		case <-ctx.Done():
+			go func(n int) {
+				for ; n > 0; n-- {
+					if late := <-ch; late.conn != nil {
+						_ = late.conn.Close()
+					}
+				}
+			}(pending)
+			return nil, ctx.Err()
+		}
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSortAddresses(t *testing.T) {
+	v4 := []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("2.2.2.2"), net.ParseIP("3.3.3.3")}
+	v6 := []net.IP{net.ParseIP("::1"), net.ParseIP("::2")}
+	list := sortAddresses(v4, v6, false)
+	want := []string{"::1", "1.1.1.1", "::2", "2.2.2.2", "3.3.3.3"}
+	for i, ip := range list {
+		if ip.String() != want[i] {
+			t.Fatal("unexpected order:", list)
+		}
+	}
+	if sortAddresses(v4, v6, true)[0].String() != "1.1.1.1" {
+		t.Fatal("ipv4 not preferred")
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	var count atomic.Int32
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		count.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		if q.Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(q.Name + " 60 IN A 127.0.0.1")
+			m.Answer = append(m.Answer, rr)
+		} else {
+			rr, _ := dns.NewRR("test. 60 IN SOA ns.test. admin.test. 1 60 60 60 30")
+			m.Ns = append(m.Ns, rr)
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	r, err := newResolver(&config.ResolverConfig{
+		Upstreams: []config.ResolverUpstreamConfig{{Network: config.ResolverUdp, Address: pc.LocalAddr().String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cl := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cl()
+	for i := 0; i < 3; i++ {
+		ips, err := r.lookup(ctx, "a.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || ips[0].String() != "127.0.0.1" {
+			t.Fatal("unexpected answer:", ips)
+		}
+	}
+	if count.Load() != 2 {
+		t.Fatal("answers not cached:", count.Load())
+	}
+}
+
+func TestDialRace(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cl()
+	var canceled atomic.Bool
+	now := time.Now()
+	conn, err := dialRace(ctx, []string{"fail", "slow", "ok"}, func(ctx context.Context, address string) (net.Conn, error) {
+		switch address {
+		case "fail":
+			return nil, errors.New("fail")
+		case "slow":
+			<-ctx.Done()
+			canceled.Store(true)
+			return nil, ctx.Err()
+		default:
+			c1, _ := net.Pipe()
+			return c1, nil
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	// the failed attempt starts the next one at once, the slow one holds the attempt delay
+	if d := time.Since(now); d < attemptDelay || d > 2*attemptDelay {
+		t.Fatal("unexpected race time:", d)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !canceled.Load() {
+		t.Fatal("loser not canceled")
+	}
+	_, err = dialRace(ctx, []string{"fail", "fail"}, func(ctx context.Context, address string) (net.Conn, error) {
+		return nil, errors.New(address)
+	})
+	if err == nil {
+		t.Fatal("all failed but no error")
+	}
+}
+
+func TestResolverCacheLimit(t *testing.T) {
+	r, err := newResolver(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	r.setCache(resolveKey{host: "old."}, nil, time.Second, now)
+	for i := 1; i < maxResolveCache; i++ {
+		r.setCache(resolveKey{host: fmt.Sprintf("h%d.", i)}, nil, time.Minute, now)
+	}
+	r.setCache(resolveKey{host: "new."}, nil, time.Minute, now)
+	if len(r.cache) != maxResolveCache {
+		t.Fatal("cache over the limit:", len(r.cache))
+	}
+	if _, ok := r.getCache(resolveKey{host: "old."}, now); ok {
+		t.Fatal("the answer expiring first is kept")
+	}
+	r.setCache(resolveKey{host: "next."}, nil, time.Minute, now.Add(2*time.Minute))
+	if len(r.cache) != 1 {
+		t.Fatal("expired answers not swept:", len(r.cache))
+	}
+}
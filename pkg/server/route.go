@@ -1,22 +1,40 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"github.com/peakedshout/anchorage-core/pkg/comm"
-	"github.com/peakedshout/go-pandorasbox/tool/mslice"
+	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
 	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type remoteRouteInfo struct {
 	comm.RegisterListenerInfo
-	Delay time.Duration
+	Delay  time.Duration
+	Active int64
+	Hop    int
+	Path   []string // origin node first, advertising node last
+	Owners []string // owners of the service name on the origin node, empty from old version nodes
+}
+
+func (rri *remoteRouteInfo) origin(node string) string {
+	if len(rri.Path) == 0 {
+		return node
+	}
+	return rri.Path[0]
 }
 
 type localRouteUnit struct {
 	xrpc.ReverseRpc
-	info comm.RegisterListenerInfo
+	info   comm.RegisterListenerInfo
+	owners []string
+	active atomic.Int64
 }
 
 func (lru *localRouteUnit) isLocal() bool {
@@ -34,10 +52,12 @@ func (rru *remoteRouteUnit) isLocal() bool {
 	return false
 }
 
-func (rru *remoteRouteUnit) update(m map[string][]remoteRouteInfo) {
+func (rru *remoteRouteUnit) update(m map[string][]remoteRouteInfo) map[string][]remoteRouteInfo {
 	rru.mux.Lock()
 	defer rru.mux.Unlock()
+	old := rru.m
 	rru.m = m
+	return old
 }
 
 type routeManager struct {
@@ -47,31 +67,41 @@ type routeManager struct {
 	lMap      map[string][]*localRouteUnit
 	rMux      sync.Mutex
 	rMap      map[string][]*remoteRouteUnit
+	balancer  *balancer
+	maxHop    int
+	events    *routeEvents
 }
 
-func (s *Server) newRoute(localName string) *routeManager {
+func (s *Server) newRoute(localName string, maxHop uint) *routeManager {
+	if maxHop == 0 {
+		maxHop = 8
+	}
 	r := &routeManager{
 		s:         s,
 		localName: localName,
 		lMap:      make(map[string][]*localRouteUnit),
 		rMap:      make(map[string][]*remoteRouteUnit),
+		balancer:  newBalancer(),
+		maxHop:    int(maxHop),
+		events:    newRouteEvents(),
 	}
 	return r
 }
 
 func (r *routeManager) get(info *comm.LinkRequest) xrpc.ReverseRpc {
-	defer info.RemoveNode()
-	if info.GetNode() == r.localName {
+	node := info.GetNode()
+	info.RemoveNode()
+	if node == r.localName {
 		return r.getLocal(info)
 	}
-	if info.GetNode() != "" {
-		return r.getRemote(info)
+	if node != "" {
+		return r.getRemote(node, info)
 	}
 	local := r.getLocal(info)
 	if local != nil {
 		return local
 	}
-	return r.getRemote(info)
+	return r.getRemote("", info)
 }
 
 func (r *routeManager) getLocalMap() map[string][]remoteRouteInfo {
@@ -84,6 +114,10 @@ func (r *routeManager) getLocalMap() map[string][]remoteRouteInfo {
 			l = append(l, remoteRouteInfo{
 				RegisterListenerInfo: unit.info,
 				Delay:                r.getDelayByCtx(unit.ReverseRpc.Context()),
+				Active:               unit.active.Load(),
+				Hop:                  0,
+				Path:                 []string{r.localName},
+				Owners:               unit.owners,
 			})
 		}
 		m[k] = l
@@ -91,27 +125,127 @@ func (r *routeManager) getLocalMap() map[string][]remoteRouteInfo {
 	return m
 }
 
+// remoteOwners returns the owners and the grants of the service name in the synced routes, nil if none is known.
+func (r *routeManager) remoteOwners(name string) (owners, grants []string) {
+	r.rMux.Lock()
+	defer r.rMux.Unlock()
+	for _, units := range r.rMap {
+		for _, unit := range units {
+			if unit.ReverseRpc.Context().Err() != nil {
+				continue
+			}
+			unit.mux.Lock()
+			for _, one := range unit.m[name] {
+				if len(one.Owners) != 0 {
+					owners = append(owners, one.Owners...)
+					grants = append(grants, one.Grants...)
+				}
+			}
+			unit.mux.Unlock()
+		}
+	}
+	slices.Sort(owners)
+	return slices.Compact(owners), grants
+}
+
+// getSyncMap returns the local routes and re-advertises the learned ones to target,
+// routes already passing through target are left out (split horizon). A draining server advertises nothing.
+func (r *routeManager) getSyncMap(target string) map[string][]remoteRouteInfo {
+	if r.s.draining.Load() {
+		return map[string][]remoteRouteInfo{}
+	}
+	m := r.getLocalMap()
+	r.rMux.Lock()
+	defer r.rMux.Unlock()
+	for node, units := range r.rMap {
+		if node == target {
+			continue
+		}
+		for _, unit := range units {
+			if unit.ReverseRpc.Context().Err() != nil {
+				continue
+			}
+			baseDelay := r.getDelayByCtx(unit.ReverseRpc.Context())
+			unit.mux.Lock()
+			for name, infos := range unit.m {
+				for _, one := range infos {
+					path := one.Path
+					if len(path) == 0 {
+						// a route of an old version node has no path, the node is its origin
+						path = []string{one.origin(node)}
+					}
+					if one.Hop+1 > r.maxHop || slices.Contains(path, target) {
+						continue
+					}
+					one.Delay += baseDelay
+					one.Hop++
+					one.Path = append(slices.Clone(path), r.localName)
+					m[name] = append(m[name], one)
+				}
+			}
+			unit.mux.Unlock()
+		}
+	}
+	return m
+}
+
+// filterSync drops the routes that would loop back to self or exceed the max hop.
+func (r *routeManager) filterSync(m map[string][]remoteRouteInfo) map[string][]remoteRouteInfo {
+	for name, infos := range m {
+		l := infos[:0]
+		for _, one := range infos {
+			if one.Hop > r.maxHop || slices.Contains(one.Path, r.localName) {
+				continue
+			}
+			l = append(l, one)
+		}
+		if len(l) == 0 {
+			delete(m, name)
+		} else {
+			m[name] = l
+		}
+	}
+	return m
+}
+
 func (r *routeManager) getLocal(info *comm.LinkRequest) xrpc.ReverseRpc {
 	r.lMux.Lock()
-	ll, ok := r.lMap[info.Link]
-	if ok {
-		list := mslice.MakeRandRangeSlice(0, len(ll))
-		for _, i := range list {
-			ctx := ll[i]
-			if ctx.Context().Err() == nil && ctx.info.Equal(info) {
-				r.lMux.Unlock()
-				return ctx
-			}
+	ll := r.lMap[info.Link]
+	list := make([]routeCandidate, 0, len(ll))
+	for _, unit := range ll {
+		if unit.Context().Err() == nil && unit.info.Equal(info) {
+			list = append(list, routeCandidate{
+				unit:   unit,
+				info:   &unit.info,
+				delay:  r.getDelayByCtx(unit.ReverseRpc.Context()),
+				active: unit.active.Load(),
+			})
 		}
 	}
 	r.lMux.Unlock()
-	return nil
+	rc := r.balancer.pick(info.Link, false, list)
+	if rc == nil {
+		return nil
+	}
+	return rc.unit
+}
+
+// locals returns every registered listener.
+func (r *routeManager) locals() []*localRouteUnit {
+	r.lMux.Lock()
+	defer r.lMux.Unlock()
+	var list []*localRouteUnit
+	for _, units := range r.lMap {
+		list = append(list, units...)
+	}
+	return list
 }
 
 func (r *routeManager) setLocal(name string, ctx *localRouteUnit) {
 	r.lMux.Lock()
 	defer r.lMux.Unlock()
 	r.lMap[name] = append(r.lMap[name], ctx)
+	r.events.emitUnit(comm.RouteEventRegister, r.localViewUnit(ctx))
 }
 
 func (r *routeManager) delLocal(name string, ctx *localRouteUnit) {
@@ -120,63 +254,147 @@ func (r *routeManager) delLocal(name string, ctx *localRouteUnit) {
 	for i, l := range r.lMap[name] {
 		if l == ctx {
 			r.lMap[name] = append(r.lMap[name][:i], r.lMap[name][i+1:]...)
+			r.events.emitUnit(comm.RouteEventUnregister, r.localViewUnit(ctx))
 			break
 		}
 	}
+	if len(r.lMap[name]) == 0 {
+		delete(r.lMap, name)
+		r.balancer.forget(name)
+	}
+}
+
+func (r *routeManager) track(unit xrpc.ReverseRpc, ctx context.Context) {
+	lu, ok := unit.(*localRouteUnit)
+	if !ok {
+		return
+	}
+	lu.active.Add(1)
+	ctxtool.GWaitFunc(ctx, func() {
+		lu.active.Add(-1)
+	})
 }
 
-func (r *routeManager) getRemote(info *comm.LinkRequest) xrpc.ReverseRpc {
-	if info.GetNode() != "" {
-		r.rMux.Lock()
-		defer r.rMux.Unlock()
-		units, ok := r.rMap[info.GetNode()]
-		if ok {
-			return r.getRemote2(units, info)
+func (r *routeManager) getRemote(node string, info *comm.LinkRequest) xrpc.ReverseRpc {
+	r.rMux.Lock()
+	var list []routeCandidate
+	if units, ok := r.rMap[node]; ok {
+		list = r.getRemote2(list, node, units, info, "")
+	} else {
+		nodes := make([]string, 0, len(r.rMap))
+		for n := range r.rMap {
+			nodes = append(nodes, n)
+		}
+		sort.Strings(nodes)
+		for _, n := range nodes {
+			list = r.getRemote2(list, n, r.rMap[n], info, node)
 		}
+	}
+	r.rMux.Unlock()
+	rc := r.balancer.pick(info.Link, true, list)
+	if rc == nil {
 		return nil
 	}
-	r.rMux.Lock()
-	defer r.rMux.Unlock()
-	for _, units := range r.rMap {
-		ctx := r.getRemote2(units, info)
-		if ctx != nil {
-			return ctx
+	if len(info.Node) == 0 && len(rc.path) > 1 {
+		// pin the rest of the advertised path, so each relay forwards to the next hop
+		hops := make([]string, 0, len(rc.path)-1)
+		for i := len(rc.path) - 2; i >= 0; i-- {
+			hops = append(hops, rc.path[i])
 		}
+		info.Node = hops
 	}
-	return nil
+	return rc.unit
 }
 
-func (r *routeManager) getRemote2(units []*remoteRouteUnit, info *comm.LinkRequest) xrpc.ReverseRpc {
-	list := mslice.MakeRandRangeSlice(0, len(units))
-	for _, i := range list {
-		unit := units[i]
+func (r *routeManager) getRemote2(list []routeCandidate, node string, units []*remoteRouteUnit, info *comm.LinkRequest, origin string) []routeCandidate {
+	for _, unit := range units {
+		if unit.ReverseRpc.Context().Err() != nil {
+			continue
+		}
+		baseDelay := r.getDelayByCtx(unit.ReverseRpc.Context())
 		unit.mux.Lock()
-		if lnInfos, ok := unit.m[info.Link]; ok {
-			for _, lnInfo := range lnInfos {
-				if lnInfo.Equal(info) && unit.ReverseRpc.Context().Err() == nil {
-					unit.mux.Unlock()
-					return unit
-				}
+		lnInfos := unit.m[info.Link]
+		for i := range lnInfos {
+			lnInfo := &lnInfos[i]
+			if origin != "" && lnInfo.origin(node) != origin {
+				continue
+			}
+			if lnInfo.Equal(info) {
+				list = append(list, routeCandidate{
+					unit:   unit,
+					info:   &lnInfo.RegisterListenerInfo,
+					delay:  baseDelay + lnInfo.Delay,
+					active: lnInfo.Active,
+					path:   lnInfo.Path,
+				})
 			}
 		}
 		unit.mux.Unlock()
 	}
-	return nil
+	return list
 }
 
 func (r *routeManager) setRemote(node string, unit *remoteRouteUnit) {
 	r.rMux.Lock()
 	defer r.rMux.Unlock()
 	r.rMap[node] = append(r.rMap[node], unit)
+	if len(r.rMap[node]) == 1 {
+		r.events.emitNode(comm.RouteEventNodeUp, node)
+	}
 }
 
 func (r *routeManager) delRemote(node string, unit *remoteRouteUnit) {
 	r.rMux.Lock()
 	defer r.rMux.Unlock()
-	for i, l := range r.rMap[node] {
-		if l == unit {
-			r.rMap[node] = append(r.rMap[node][:i], r.rMap[node][i+1:]...)
-			break
+	i := slices.Index(r.rMap[node], unit)
+	if i < 0 {
+		return
+	}
+	r.rMap[node] = slices.Delete(r.rMap[node], i, i+1)
+	r.diffRemote(node, unit, unit.update(nil), nil)
+	if len(r.rMap[node]) == 0 {
+		r.events.emitNode(comm.RouteEventNodeDown, node)
+	}
+}
+
+// updateRemote replaces the routes learned from unit, and emits the changes to the route watchers.
+func (r *routeManager) updateRemote(node string, unit *remoteRouteUnit, m map[string][]remoteRouteInfo) {
+	old := unit.update(m)
+	r.diffRemote(node, unit, old, m)
+}
+
+func (r *routeManager) diffRemote(node string, unit *remoteRouteUnit, old, cur map[string][]remoteRouteInfo) {
+	if !r.events.watched() {
+		return
+	}
+	baseDelay := r.getDelayByCtx(unit.ReverseRpc.Context())
+	key := func(one *remoteRouteInfo) string {
+		return one.Name + "\x00" + strings.Join(one.Path, "\x00")
+	}
+	group := func(m map[string][]remoteRouteInfo) map[string][]*remoteRouteInfo {
+		g := make(map[string][]*remoteRouteInfo)
+		for _, infos := range m {
+			for i := range infos {
+				k := key(&infos[i])
+				g[k] = append(g[k], &infos[i])
+			}
+		}
+		return g
+	}
+	og, cg := group(old), group(cur)
+	for k, ol := range og {
+		cl := cg[k]
+		for i, one := range ol {
+			if i >= len(cl) {
+				r.events.emitUnit(comm.RouteEventUnregister, r.remoteViewUnit(node, baseDelay, one))
+			} else if delayChanged(one.Delay, cl[i].Delay) {
+				r.events.emitUnit(comm.RouteEventDelay, r.remoteViewUnit(node, baseDelay, cl[i]))
+			}
+		}
+	}
+	for k, cl := range cg {
+		for _, one := range cl[min(len(og[k]), len(cl)):] {
+			r.events.emitUnit(comm.RouteEventRegister, r.remoteViewUnit(node, baseDelay, one))
 		}
 	}
 }
@@ -191,14 +409,7 @@ func (r *routeManager) getView(hide bool) *comm.ServiceRouteView {
 			if hide && unit.info.Settings.SwitchHide {
 				continue
 			}
-			info := comm.ServiceRouteViewUnit{
-				Name:     unit.info.Name,
-				Node:     r.localName,
-				Notes:    unit.info.Notes,
-				Auth:     unit.info.Auth != nil,
-				Settings: unit.info.Settings,
-				Delay:    r.getDelayByCtx(unit.ReverseRpc.Context()),
-			}
+			info := r.localViewUnit(unit)
 			nv[r.localName][info.Name] = append(nv[r.localName][info.Name], info)
 			sv[info.Name] = append(sv[info.Name], info)
 		}
@@ -206,7 +417,6 @@ func (r *routeManager) getView(hide bool) *comm.ServiceRouteView {
 	r.lMux.Unlock()
 	r.rMux.Lock()
 	for node, units := range r.rMap {
-		nv[node] = make(map[string][]comm.ServiceRouteViewUnit)
 		for _, unit := range units {
 			baseDelay := r.getDelayByCtx(unit.ReverseRpc.Context())
 			unit.mux.Lock()
@@ -215,15 +425,11 @@ func (r *routeManager) getView(hide bool) *comm.ServiceRouteView {
 					if hide && one.Settings.SwitchHide {
 						continue
 					}
-					info := comm.ServiceRouteViewUnit{
-						Name:     one.Name,
-						Node:     node,
-						Notes:    one.Notes,
-						Auth:     one.Auth != nil,
-						Settings: one.Settings,
-						Delay:    baseDelay + one.Delay,
+					info := r.remoteViewUnit(node, baseDelay, &one)
+					if nv[info.Node] == nil {
+						nv[info.Node] = make(map[string][]comm.ServiceRouteViewUnit)
 					}
-					nv[node][info.Name] = append(nv[node][info.Name], info)
+					nv[info.Node][info.Name] = append(nv[info.Node][info.Name], info)
 					sv[info.Name] = append(sv[info.Name], info)
 				}
 			}
@@ -237,6 +443,84 @@ func (r *routeManager) getView(hide bool) *comm.ServiceRouteView {
 	}
 }
 
+func (r *routeManager) localViewUnit(unit *localRouteUnit) comm.ServiceRouteViewUnit {
+	return comm.ServiceRouteViewUnit{
+		Name:     unit.info.Name,
+		Node:     r.localName,
+		Notes:    unit.info.Notes,
+		Auth:     unit.info.Auth != nil,
+		Settings: unit.info.Settings,
+		Delay:    r.getDelayByCtx(unit.ReverseRpc.Context()),
+		Active:   unit.active.Load(),
+		Hop:      0,
+		Path:     []string{r.localName},
+	}
+}
+
+func (r *routeManager) remoteViewUnit(node string, baseDelay time.Duration, one *remoteRouteInfo) comm.ServiceRouteViewUnit {
+	return comm.ServiceRouteViewUnit{
+		Name:     one.Name,
+		Node:     one.origin(node),
+		Notes:    one.Notes,
+		Auth:     one.Auth != nil,
+		Settings: one.Settings,
+		Delay:    baseDelay + one.Delay,
+		Active:   one.Active,
+		Hop:      one.Hop + 1,
+		Path:     append(slices.Clone(one.Path), r.localName),
+	}
+}
+
+// query returns the matched units of the route view, sorted and paged by q.
+func (r *routeManager) query(hide bool, q *comm.ServiceRouteQuery) *comm.ServiceRouteQueryResult {
+	var list []comm.ServiceRouteViewUnit
+	for _, units := range r.getView(hide).ServiceView {
+		for i := range units {
+			if q.Match(&units[i]) {
+				list = append(list, units[i])
+			}
+		}
+	}
+	sortRouteUnits(list, q.Sort, q.Desc)
+	total := len(list)
+	list = list[min(q.Offset, total):]
+	if q.Limit > 0 && q.Limit < len(list) {
+		list = list[:q.Limit]
+	}
+	return &comm.ServiceRouteQueryResult{Total: total, Units: list}
+}
+
+func sortRouteUnits(list []comm.ServiceRouteViewUnit, by string, desc bool) {
+	key := func(a, b *comm.ServiceRouteViewUnit) int {
+		switch by {
+		case comm.RouteSortDelay:
+			return cmp.Compare(a.Delay, b.Delay)
+		case comm.RouteSortHop:
+			return cmp.Compare(a.Hop, b.Hop)
+		case comm.RouteSortActive:
+			return cmp.Compare(a.Active, b.Active)
+		default:
+			return 0
+		}
+	}
+	slices.SortFunc(list, func(a, b comm.ServiceRouteViewUnit) int {
+		c := key(&a, &b)
+		if c == 0 {
+			c = cmp.Compare(a.Name, b.Name)
+		}
+		if c == 0 {
+			c = cmp.Compare(a.Node, b.Node)
+		}
+		if c == 0 {
+			c = cmp.Compare(a.Delay, b.Delay)
+		}
+		if desc {
+			return -c
+		}
+		return c
+	})
+}
+
 func (r *routeManager) getDelayByCtx(ctx context.Context) time.Duration {
 	sid, err := xrpc.GetSessionAuthInfoT[string](ctx, xrpc.SessionId)
 	if err != nil {
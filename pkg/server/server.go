@@ -13,18 +13,37 @@ import (
 	"github.com/peakedshout/go-pandorasbox/xnet/xmulti"
 	"github.com/peakedshout/go-pandorasbox/xrpc"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
 	nodeName string
+	user     string
+	auth     bool // every session passed a user/password auth, so its username is verified
+	users    *userManager
+	roles    []string
 	server   *xrpc.Server
 	addrs    []net.Addr
 
+	disableProxy     bool
+	disableRouteView bool
+
+	idleTimeout time.Duration
+	keepAlive   time.Duration
+	draining    atomic.Bool
+
 	lm    *linkManager
 	route *routeManager
 	sm    *syncManager
 	proxy *proxyManager
+	owner *ownerManager
+
+	policy   *egressPolicy
+	upstream *upstreamManager
+	resolver *resolver
+	rate     *rateManager
+	traffic  *trafficManager
 
 	logger logger.Logger
 }
@@ -54,6 +73,7 @@ func NewServerContext(ctx context.Context, config *config.ServerConfig) (*Server
 		HandshakeTimeout:         time.Duration(config.NodeInfo.HandshakeTimeout) * time.Millisecond,
 		SwitchNetworkSpeedTicker: true,
 		SessionAuthCallback: func(info xrpc.AuthInfo) (xrpc.AuthInfo, error) {
+			delete(info, comm.Password) // never kept in the session
 			n, err := xrpc.GetAuthInfo[string](info, comm.NodeName)
 			if err != nil || n != nodeName {
 				return nil, ErrNodeAuthFailed
@@ -64,25 +84,89 @@ func NewServerContext(ctx context.Context, config *config.ServerConfig) (*Server
 		Upgrader:   upgrader,
 		CacheTime:  10 * time.Second,
 	}
+	users, err := newUserManager(config.Users, config.UsersFile)
+	if err != nil {
+		return nil, err
+	}
+	user := ""
+	var upFn func(info xrpc.AuthInfo) (xrpc.AuthInfo, error)
 	if config.NodeInfo.Auth != nil {
-		sc.SessionAuthCallback = xrpc.UPAuthCallback(config.NodeInfo.Auth.UserName, config.NodeInfo.Auth.Password)
+		user = config.NodeInfo.Auth.UserName
+		upFn = xrpc.UPAuthCallback(config.NodeInfo.Auth.UserName, config.NodeInfo.Auth.Password)
+	}
+	auth := upFn != nil || users.enable()
+	if auth {
+		sc.SessionAuthCallback = func(info xrpc.AuthInfo) (xrpc.AuthInfo, error) {
+			n, _ := xrpc.GetAuthInfo[string](info, comm.UserName)
+			p, _ := xrpc.GetAuthInfo[string](info, comm.Password)
+			// checked here only, the session keeps the username
+			defer delete(info, comm.Password)
+			if users.enable() {
+				if users.verify(n, p) == nil {
+					return nil, nil
+				}
+			}
+			if upFn == nil || (n != "" && n != user) {
+				return nil, ErrNodeAuthFailed
+			}
+			// the up auth gets the info untouched
+			res, err := upFn(info)
+			if res != nil {
+				delete(res, comm.Password)
+			}
+			return res, err
+		}
 	}
 	server := xrpc.NewServer(sc)
 	addrs := comm.MakeBaseAddress(config.NodeInfo.BaseNetwork)
 	s := &Server{
 		nodeName: config.NodeInfo.NodeName,
+		user:     user,
+		auth:     auth,
+		users:    users,
+		roles:    defaultRoles(config.DefaultRoles),
 		server:   server,
 		addrs:    addrs,
 		logger:   logger.MustLogger(ctx),
+
+		disableProxy:     config.DisableProxy,
+		disableRouteView: config.DisableRouteView,
+
+		idleTimeout: time.Duration(config.IdleTimeout) * time.Millisecond,
+	}
+	if config.KeepAlive != 0 {
+		s.keepAlive = time.Duration(max(config.KeepAlive, 5*1000)) * time.Millisecond
+	}
+	s.rate = newRateManager(config.RateLimit)
+	s.traffic, err = s.newTrafficManager(config.Traffic)
+	if err != nil {
+		_ = server.Close()
+		return nil, err
 	}
 	s.lm = s.newLinkManager(config.LinkTimeout)
-	s.route = s.newRoute(s.nodeName)
-	err = s.newNodeManager(time.Duration(config.SyncTimeInterval)*time.Millisecond, config.SyncNodes)
+	s.route = s.newRoute(s.nodeName, config.SyncMaxHop)
+	s.owner = newOwnerManager(config.ServiceOwners, s.route.remoteOwners)
+	s.policy, err = newEgressPolicy(config.ProxyPolicy, config.ProxyPolicyDefault)
+	if err != nil {
+		_ = server.Close()
+		return nil, err
+	}
+	s.upstream, err = newUpstreamManager(config.ProxyUpstreams, config.ProxyRoutes)
+	if err != nil {
+		_ = server.Close()
+		return nil, err
+	}
+	s.resolver, err = newResolver(config.Resolver)
+	if err != nil {
+		_ = server.Close()
+		return nil, err
+	}
+	err = s.newNodeManager(time.Duration(config.SyncTimeInterval)*time.Millisecond, config.SyncNodes, config.SyncPaused, config.SyncBackoff)
 	if err != nil {
 		_ = server.Close()
 		return nil, err
 	}
-	s.proxy = newProxyManager(s.sm.nm, expired.NewTODO(expired.Init(s.server.Context(), 1)), config.ProxyMulti)
+	s.proxy = newProxyManager(s.sm.nodeMap(), expired.NewTODO(expired.Init(s.server.Context(), 1)), config.ProxyMulti)
 	s.handle()
 	return s, nil
 }
@@ -97,6 +181,7 @@ func (s *Server) Serve() error {
 	defer ln.Close()
 	cl := s.sm.run()
 	defer cl()
+	defer s.traffic.run(s.server.Context())()
 	s.logger.Info("server:", s.nodeName, "start serve ...")
 	return s.server.Serve(ln)
 }
@@ -112,11 +197,48 @@ func (s *Server) SyncServe(ch chan<- error) error {
 	defer ln.Close()
 	cl := s.sm.run()
 	defer cl()
+	defer s.traffic.run(s.server.Context())()
 	ch <- nil
 	s.logger.Info("server:", s.nodeName, "start serve ...")
 	return s.server.Serve(ln)
 }
 
+// AddSyncNode starts to sync with node, the sessions of the other nodes are not touched.
+func (s *Server) AddSyncNode(node config.NodeConfig) error {
+	err := node.Check()
+	if err != nil {
+		return err
+	}
+	err = s.sm.add(node)
+	if err != nil {
+		return err
+	}
+	s.proxy.Set(s.sm.nodeMap())
+	s.logger.Info("server:", s.nodeName, "add sync node config:", node.NodeName)
+	return nil
+}
+
+// DelSyncNode stops to sync with node and closes its sessions.
+func (s *Server) DelSyncNode(node string) error {
+	err := s.sm.del(node)
+	if err != nil {
+		return err
+	}
+	s.proxy.Set(s.sm.nodeMap())
+	s.logger.Info("server:", s.nodeName, "del sync node config:", node)
+	return nil
+}
+
+// PauseSyncNode stops or restarts the sync with node, the node stays in the config.
+func (s *Server) PauseSyncNode(node string, pause bool) error {
+	err := s.sm.pause(node, pause)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("server:", s.nodeName, "pause sync node:", node, pause)
+	return nil
+}
+
 func (s *Server) Close() error {
 	return s.server.Close()
 }
@@ -133,29 +255,52 @@ func (s *Server) handle() {
 	s.server.MustAddHandler(comm.CallRegister, s.handleListener)
 	s.server.MustAddHandler(comm.CallLink, s.handleLink)
 	s.server.MustAddHandler(comm.CallLinkReq, s.handleLinkReq)
+	s.server.MustAddHandler(comm.CallLinkP2P, s.handleLinkP2P)
+	s.server.MustAddHandler(comm.CallNatMap, s.handleNatMap)
+	s.server.MustAddHandler(comm.CallNatProbe, s.handleNatProbe)
 	s.server.MustAddHandler(comm.CallSync, s.handleSync)
 	s.server.MustAddHandler(comm.CallRouteView, s.handleRouteViewReq)
+	s.server.MustAddHandler(comm.CallRouteQuery, s.handleRouteQueryReq)
+	s.server.MustAddHandler(comm.CallRouteEvent, s.handleRouteEvent)
 	s.server.MustAddHandler(comm.CallProxy, s.handleProxy)
 }
 
 func (s *Server) handleListener(ctx xrpc.ReverseRpc) error {
+	if s.draining.Load() {
+		return ErrServerDraining
+	}
+	err := s.allow(ctx.Context(), config.RoleRegister)
+	if err != nil {
+		return err
+	}
 	var info comm.RegisterListenerInfo
-	err := ctx.Bind(&info)
+	err = ctx.Bind(&info)
 	if err != nil {
 		return ErrRegisterListenerInfo.Errorf(err)
 	}
 	if info.Name == "" {
 		return ErrRegisterListenerInfo.Errorf("nil service name")
 	}
+	if !comm.CheckBalance(info.Settings.Balance) {
+		return ErrInvalidBalance.Errorf(info.Settings.Balance)
+	}
+	user := s.getUser(ctx.Context())
+	owners, err := s.owner.claim(&info, user)
+	if err != nil {
+		s.logger.Warn("server:", s.nodeName, "refuse listener:", info.Name, "user:", user)
+		return err
+	}
+	defer s.owner.release(info.Name)
 	unit := &localRouteUnit{
 		ReverseRpc: ctx,
 		info:       info,
+		owners:     owners,
 	}
 	s.route.setLocal(info.Name, unit)
-	s.logger.Info("server:", s.nodeName, "add listener:", info.Name)
+	s.logger.Info("server:", s.nodeName, "add listener:", info.Name, "user:", user)
 	defer func() {
 		s.route.delLocal(info.Name, unit)
-		s.logger.Info("server:", s.nodeName, "del listener:", info.Name)
+		s.logger.Info("server:", s.nodeName, "del listener:", info.Name, "user:", user)
 	}()
 	<-ctx.Context().Done()
 	return nil
@@ -178,9 +323,29 @@ func (s *Server) handleLink(ctx xrpc.Stream) error {
 	return box.join(id, lid, ctx)
 }
 
+func (s *Server) handleLinkP2P(ctx xrpc.Rpc) (any, error) {
+	var report comm.LinkP2PReport
+	err := ctx.Bind(&report)
+	if err != nil {
+		return nil, err
+	}
+	box := s.lm.getBox(report.BoxId)
+	if box == nil {
+		return nil, ErrInvalidLinkId
+	}
+	return nil, box.setP2P(report.BoxId, report.BoxLId, &report.View)
+}
+
 func (s *Server) handleLinkReq(ctx xrpc.Rpc) (any, error) {
+	if s.draining.Load() {
+		return nil, ErrServerDraining
+	}
+	err := s.allow(ctx.Context(), config.RoleLink)
+	if err != nil {
+		return nil, err
+	}
 	var info comm.LinkRequest
-	err := ctx.Bind(&info)
+	err = ctx.Bind(&info)
 	if err != nil {
 		return nil, err
 	}
@@ -191,13 +356,20 @@ func (s *Server) handleLinkReq(ctx xrpc.Rpc) (any, error) {
 
 	sid, _ := xrpc.GetSessionAuthInfoT[string](ctx.Context(), xrpc.SessionId)
 	tid, _ := xrpc.GetSessionAuthInfoT[string](rrpc.Context(), xrpc.SessionId)
-	binfo := &linkInfo{link: info.Link, stSessId: [2]string{sid, tid}, lid: uuid.NewId(1)}
+	binfo := &linkInfo{link: info.Link, user: s.getUser(ctx.Context()), stSessId: [2]string{sid, tid}, lid: uuid.NewId(1)}
 	binfo.sit[1] = s.nodeName
 	if unit, ok := rrpc.(*remoteRouteUnit); ok {
 		binfo.sit[2] = unit.node
 	}
+	binfo.idle = s.getIdleTimeout(rrpc)
+	err = s.traffic.check(binfo.trafficKey())
+	if err != nil {
+		s.logger.Warn("server:", s.nodeName, "refuse link req:", info.Link, "err:", err)
+		return nil, err
+	}
 
 	box := s.lm.newBox(rrpc.Context(), binfo)
+	s.route.track(rrpc, box.ctx)
 	defer func() {
 		if err != nil {
 			box.doExpired()
@@ -217,8 +389,12 @@ func (s *Server) handleLinkReq(ctx xrpc.Rpc) (any, error) {
 }
 
 func (s *Server) handleSync(ctx xrpc.ReverseRpc) error {
+	err := s.allow(ctx.Context(), config.RoleSync)
+	if err != nil {
+		return err
+	}
 	var info syncInfo
-	err := ctx.Bind(&info)
+	err = ctx.Bind(&info)
 	if err != nil {
 		return err
 	}
@@ -243,22 +419,116 @@ func (s *Server) handleSync(ctx xrpc.ReverseRpc) error {
 		if err != nil {
 			return err
 		}
-		ru.update(m)
+		s.route.updateRemote(info.SourceNode, ru, s.route.filterSync(m))
 		return nil
 	})
 }
 
 func (s *Server) handleRouteViewReq(ctx xrpc.Rpc) (any, error) {
+	if s.disableRouteView {
+		return nil, ErrPermissionDenied.Errorf("route view is disabled")
+	}
+	err := s.allow(ctx.Context(), config.RoleView)
+	if err != nil {
+		return nil, err
+	}
 	view := s.route.getView(true)
 	return view, nil
 }
 
+func (s *Server) handleRouteQueryReq(ctx xrpc.Rpc) (any, error) {
+	if s.disableRouteView {
+		return nil, ErrPermissionDenied.Errorf("route view is disabled")
+	}
+	err := s.allow(ctx.Context(), config.RoleView)
+	if err != nil {
+		return nil, err
+	}
+	var q comm.ServiceRouteQuery
+	err = ctx.Bind(&q)
+	if err != nil {
+		return nil, err
+	}
+	err = q.Check()
+	if err != nil {
+		return nil, err
+	}
+	return s.route.query(true, &q), nil
+}
+
+// handleRouteEvent sends the route events matched by the query of the client, until the stream is closed.
+func (s *Server) handleRouteEvent(ctx xrpc.Stream) error {
+	if s.disableRouteView {
+		return ErrPermissionDenied.Errorf("route view is disabled")
+	}
+	err := s.allow(ctx.Context(), config.RoleView)
+	if err != nil {
+		return err
+	}
+	var q comm.ServiceRouteQuery
+	err = ctx.Recv(&q)
+	if err != nil {
+		return err
+	}
+	err = q.Check()
+	if err != nil {
+		return err
+	}
+	rw := s.route.events.watch(q)
+	defer s.route.events.unwatch(rw)
+	tmpCtx, cl := context.WithCancel(ctx.Context())
+	defer cl()
+	go func() {
+		defer cl()
+		var tmp comm.ServiceRouteQuery
+		for ctx.Recv(&tmp) == nil {
+		}
+	}()
+	for {
+		select {
+		case e := <-rw.ch:
+			err = ctx.Send(e)
+			if err != nil {
+				return err
+			}
+		case <-rw.drop:
+			return ErrRouteEventOverflow
+		case <-tmpCtx.Done():
+			return tmpCtx.Err()
+		}
+	}
+}
+
 func (s *Server) handleProxy(ctx xrpc.Stream) error {
+	if s.disableProxy {
+		return ErrPermissionDenied.Errorf("proxy is disabled")
+	}
+	if s.draining.Load() {
+		return ErrServerDraining
+	}
+	err := s.allow(ctx.Context(), config.RoleProxy)
+	if err != nil {
+		return err
+	}
 	var req comm.ProxyRequest
-	err := ctx.Recv(&req)
+	err = ctx.Recv(&req)
 	if err != nil {
 		return err
 	}
+	user := s.getUser(ctx.Context())
+	node, nodes := req.GetNode(s.nodeName)
+	tk := trafficKey{user: user, node: node}
+	if node == "" {
+		tk.node = s.nodeName
+	}
+	err = s.traffic.check(tk)
+	if err != nil {
+		s.logger.Warn("server:", s.nodeName, "refuse proxy ->", fmt.Sprintf("%s_%s", req.Network, req.Address), "err:", err)
+		return err
+	}
+	limit := s.rate.newLimiter(user, "")
+	limit.traffic = s.traffic.account(tk)
+	defer limit.close()
 	tmpCtx, cl := context.WithCancel(ctx.Context())
 	defer cl()
 	stop := make(chan struct{})
@@ -273,21 +543,33 @@ func (s *Server) handleProxy(ctx xrpc.Stream) error {
 		}
 	}()
 
-	node, nodes := req.GetNode(s.nodeName)
 	if node == "" {
-		conn, err := s.dialProxy(tmpCtx, &req)
+		conn, dial, err := s.dialProxy(tmpCtx, user, &req)
 		if err != nil {
 			return err
 		}
 		defer conn.Close()
 		close(stop)
-		defer s.proxy.Record(ctx, s.nodeName, nodes, &req, nil, conn)()
-		s.logger.Info("server:", s.nodeName, "proxy direct ->", fmt.Sprintf("%s_%s", req.Network, req.Address))
+		defer s.proxy.Record(ctx, user, limit, s.nodeName, nodes, &req, nil, conn, dial)()
+		s.logger.Info("server:", s.nodeName, "proxy direct ->", fmt.Sprintf("%s_%s", req.Network, req.Address), "user:", user)
+		keeper := newStreamKeeper(ctx)
+		watch := newIdleWatcher(s.idleTimeout, s.keepAlive, keeper)
+		watch.run(tmpCtx, func(reason string) {
+			s.proxy.closeWith(ctx, reason)
+			s.logger.Info("server:", s.nodeName, "close proxy ->", fmt.Sprintf("%s_%s", req.Network, req.Address), "reason:", reason)
+			_ = conn.Close()
+			_ = ctx.Close()
+		})
 		go func() {
 			defer conn.Close()
 			var buf []byte
 			for {
-				err := ctx.Recv(&buf)
+				err := keeper.recv(&buf)
+				if err != nil {
+					return
+				}
+				watch.touch()
+				err = limit.wait(ctx.Context(), dirUp, len(buf))
 				if err != nil {
 					return
 				}
@@ -303,7 +585,12 @@ func (s *Server) handleProxy(ctx xrpc.Stream) error {
 			if err != nil {
 				return err
 			}
-			err = ctx.Send(buf[:n])
+			watch.touch()
+			err = limit.wait(ctx.Context(), dirDown, n)
+			if err != nil {
+				return err
+			}
+			err = keeper.send(buf[:n])
 			if err != nil {
 				return err
 			}
@@ -317,17 +604,30 @@ func (s *Server) handleProxy(ctx xrpc.Stream) error {
 		}
 		defer stream.Close()
 		close(stop)
-		defer s.proxy.Record(ctx, s.nodeName, nodes, &req, stream, nil)()
-		s.logger.Info("server:", s.nodeName, "proxy indirect ->", fmt.Sprintf("%s_%s", req.Network, req.Address))
+		defer s.proxy.Record(ctx, user, limit, s.nodeName, nodes, &req, stream, nil, nil)()
+		s.logger.Info("server:", s.nodeName, "proxy indirect ->", fmt.Sprintf("%s_%s", req.Network, req.Address), "user:", user)
+		keeper, next := newStreamKeeper(ctx), newStreamKeeper(stream)
+		watch := newIdleWatcher(s.idleTimeout, s.keepAlive, keeper, next)
+		watch.run(tmpCtx, func(reason string) {
+			s.proxy.closeWith(ctx, reason)
+			s.logger.Info("server:", s.nodeName, "close proxy ->", fmt.Sprintf("%s_%s", req.Network, req.Address), "reason:", reason)
+			_ = stream.Close()
+			_ = ctx.Close()
+		})
 		go func() {
 			defer stream.Close()
 			var buf []byte
 			for {
-				err := ctx.Recv(&buf)
+				err := keeper.recv(&buf)
+				if err != nil {
+					return
+				}
+				watch.touch()
+				err = limit.wait(ctx.Context(), dirUp, len(buf))
 				if err != nil {
 					return
 				}
-				err = stream.Send(buf)
+				err = next.send(buf)
 				if err != nil {
 					return
 				}
@@ -335,11 +635,16 @@ func (s *Server) handleProxy(ctx xrpc.Stream) error {
 		}()
 		var buf []byte
 		for {
-			err = stream.Recv(&buf)
+			err = next.recv(&buf)
+			if err != nil {
+				return err
+			}
+			watch.touch()
+			err = limit.wait(ctx.Context(), dirDown, len(buf))
 			if err != nil {
 				return err
 			}
-			err = ctx.Send(buf)
+			err = keeper.send(buf)
 			if err != nil {
 				return err
 			}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
 	"github.com/peakedshout/anchorage-core/pkg/config"
 	"testing"
 	"time"
@@ -31,3 +32,25 @@ func TestNewServerContext(t *testing.T) {
 	defer s.Close()
 	_ = s.Serve()
 }
+
+func TestActiveCount(t *testing.T) {
+	live, cl1 := context.WithCancel(context.Background())
+	defer cl1()
+	dead, cl2 := context.WithCancel(context.Background())
+	cl2()
+	s := &Server{
+		lm: &linkManager{boxMap: map[uint64]*linkBox{
+			1: {ctx: live, info: &linkInfo{}},
+			2: {ctx: dead, info: &linkInfo{}},
+			3: {ctx: live, info: &linkInfo{closeReason: comm.CloseReasonIdle}},
+		}},
+		proxy: &proxyManager{},
+	}
+	// a closed proxy waiting for the view cache
+	info := &proxyInfo{}
+	info.closed.Store(true)
+	s.proxy.m.Store(nil, info)
+	if links, proxies := s.activeCount(); links != 1 || proxies != 0 {
+		t.Fatal("unexpected active count:", links, proxies)
+	}
+}
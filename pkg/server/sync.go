@@ -6,55 +6,340 @@ import (
 	"github.com/peakedshout/anchorage-core/pkg/config"
 	"github.com/peakedshout/go-pandorasbox/tool/uuid"
 	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"math"
+	"math/rand"
+	"slices"
+	"sync"
 	"time"
 )
 
+const (
+	SyncStateConnecting = "connecting"
+	SyncStateConnected  = "connected"
+	SyncStateBackoff    = "backoff"
+	SyncStatePaused     = "paused"
+)
+
+// syncBackoff is the exponential retry delay of the broken sync connections.
+type syncBackoff struct {
+	min        time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     float64
+}
+
+func newSyncBackoff(cfg *config.SyncBackoffConfig) *syncBackoff {
+	if cfg == nil {
+		return &syncBackoff{min: 1 * time.Second, max: 60 * time.Second, multiplier: 2, jitter: 0.2}
+	}
+	sb := &syncBackoff{
+		min:        time.Duration(cfg.Min) * time.Millisecond,
+		max:        time.Duration(cfg.Max) * time.Millisecond,
+		multiplier: cfg.Multiplier,
+		jitter:     cfg.Jitter,
+	}
+	if sb.min <= 0 {
+		sb.min = 1 * time.Second
+	}
+	if sb.max <= 0 {
+		sb.max = 60 * time.Second
+	}
+	sb.max = max(sb.max, sb.min)
+	if sb.multiplier < 1 {
+		sb.multiplier = 2
+	}
+	return sb
+}
+
+// delay returns the wait before the next retry after failures consecutive failures, 0 failures waits the min.
+func (sb *syncBackoff) delay(failures int) time.Duration {
+	d := float64(sb.min) * math.Pow(sb.multiplier, float64(max(failures-1, 0)))
+	d = min(d, float64(sb.max))
+	if sb.jitter > 0 {
+		d += d * sb.jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// syncState is the observable state of one sync node unit.
+type syncState struct {
+	mux         sync.Mutex
+	state       string
+	lastErr     string
+	lastSuccess time.Time
+	failures    int
+	nextRetry   time.Time
+	synced      bool // the current connection has synced
+}
+
+func (ss *syncState) connecting() {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	ss.state = SyncStateConnecting
+	ss.nextRetry = time.Time{}
+	ss.synced = false
+}
+
+// success is called by every route sync of the peer, which proves the connection works.
+func (ss *syncState) success() {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	ss.state = SyncStateConnected
+	ss.lastSuccess = time.Now()
+	ss.failures = 0
+	ss.synced = true
+}
+
+// fail records the broken connection and returns the wait before the next retry.
+func (ss *syncState) fail(err error, sb *syncBackoff) time.Duration {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	if err != nil {
+		ss.lastErr = err.Error()
+	} else {
+		ss.lastErr = "sync closed"
+	}
+	if !ss.synced {
+		ss.failures++
+	}
+	d := sb.delay(ss.failures)
+	ss.state = SyncStateBackoff
+	ss.nextRetry = time.Now().Add(d)
+	return d
+}
+
+func (ss *syncState) view(paused bool) SyncUnitView {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	view := SyncUnitView{
+		State:       ss.state,
+		LastError:   ss.lastErr,
+		LastSuccess: ss.lastSuccess,
+		Failures:    ss.failures,
+		NextRetry:   ss.nextRetry,
+	}
+	if paused {
+		view.State = SyncStatePaused
+		view.NextRetry = time.Time{}
+	}
+	return view
+}
+
+// syncPeer is the sync node units of one node name, each of them can be removed or paused alone.
+type syncPeer struct {
+	cfgs   []config.NodeConfig
+	units  []*comm.NodeUnit
+	states []*syncState       // state of each unit
+	cl     context.CancelFunc // closes the units
+	stop   context.CancelFunc // stops the sync, nil is not syncing
+	paused bool
+}
+
 type syncManager struct {
 	s        *Server
-	nm       map[string][]*comm.NodeUnit
 	interval time.Duration
+	backoff  *syncBackoff
+
+	mux   sync.Mutex
+	ctx   context.Context // set once serving
+	peers map[string]*syncPeer
+	nm    map[string][]*comm.NodeUnit
 }
 
-func (s *Server) newNodeManager(interval time.Duration, nodes []config.NodeConfig) error {
-	nm, err := comm.MakeNodeUnit(s.server.Context(), nodes)
-	if err != nil {
-		return err
-	}
+func (s *Server) newNodeManager(interval time.Duration, nodes []config.NodeConfig, paused []string, backoff *config.SyncBackoffConfig) error {
 	if interval < 1*time.Second {
 		interval = 1 * time.Second
 	}
 	s.sm = &syncManager{
 		s:        s,
-		nm:       nm,
 		interval: interval,
+		backoff:  newSyncBackoff(backoff),
+		peers:    make(map[string]*syncPeer),
+		nm:       make(map[string][]*comm.NodeUnit),
+	}
+	for _, node := range nodes {
+		err := s.sm.join(node)
+		if err != nil {
+			return err
+		}
+	}
+	for _, node := range paused {
+		if peer, ok := s.sm.peers[node]; ok {
+			peer.paused = true
+		}
 	}
 	return nil
 }
 
 func (sm *syncManager) run() context.CancelFunc {
 	ctx, cl := context.WithCancel(sm.s.server.Context())
-	for _, units := range sm.nm {
-		for _, unit := range units {
-			go sm.syncNode(ctx, unit)
-		}
+	sm.mux.Lock()
+	defer sm.mux.Unlock()
+	sm.ctx = ctx
+	for _, peer := range sm.peers {
+		sm.start(peer)
 	}
 	return cl
 }
 
-func (sm *syncManager) syncNode(ctx context.Context, nu *comm.NodeUnit) {
+// start syncs the units of peer until it is paused or removed, the caller holds the lock.
+func (sm *syncManager) start(peer *syncPeer) {
+	if sm.ctx == nil || peer.paused || peer.stop != nil {
+		return
+	}
+	ctx, cl := context.WithCancel(sm.ctx)
+	peer.stop = cl
+	for i, unit := range peer.units {
+		go sm.syncNode(ctx, unit, peer.states[i])
+	}
+}
+
+// add adds a sync node at runtime, a node name already synced is refused so that it is not synced twice.
+func (sm *syncManager) add(node config.NodeConfig) error {
+	sm.mux.Lock()
+	defer sm.mux.Unlock()
+	if _, ok := sm.peers[node.NodeName]; ok {
+		return ErrSyncNodeExists.Errorf(node.NodeName)
+	}
+	return sm.join(node)
+}
+
+// join adds the units of node to the peer of its name, the configs of a node may list several addresses.
+// The caller holds the lock.
+func (sm *syncManager) join(node config.NodeConfig) error {
+	ctx, cl := context.WithCancel(sm.s.server.Context())
+	nm, err := comm.MakeNodeUnit(ctx, []config.NodeConfig{node})
+	if err != nil {
+		cl()
+		return err
+	}
+	peer, ok := sm.peers[node.NodeName]
+	if !ok {
+		peer = &syncPeer{cl: cl}
+		sm.peers[node.NodeName] = peer
+	} else {
+		pcl := peer.cl
+		peer.cl = func() {
+			pcl()
+			cl()
+		}
+	}
+	units := nm[node.NodeName]
+	states := make([]*syncState, len(units))
+	for i := range states {
+		states[i] = &syncState{state: SyncStateConnecting}
+	}
+	peer.cfgs = append(peer.cfgs, node)
+	peer.units = append(peer.units, units...)
+	peer.states = append(peer.states, states...)
+	sm.nm[node.NodeName] = append(slices.Clone(sm.nm[node.NodeName]), units...)
+	if peer.stop != nil {
+		// the peer is syncing, only the new units have to start
+		ctx, cl := context.WithCancel(sm.ctx)
+		stop := peer.stop
+		peer.stop = func() {
+			stop()
+			cl()
+		}
+		for i, unit := range units {
+			go sm.syncNode(ctx, unit, states[i])
+		}
+	} else {
+		sm.start(peer)
+	}
+	return nil
+}
+
+func (sm *syncManager) del(node string) error {
+	sm.mux.Lock()
+	defer sm.mux.Unlock()
+	peer, ok := sm.peers[node]
+	if !ok {
+		return ErrNotFoundNode.Errorf(node)
+	}
+	if peer.stop != nil {
+		peer.stop()
+	}
+	peer.cl()
+	delete(sm.peers, node)
+	delete(sm.nm, node)
+	return nil
+}
+
+func (sm *syncManager) pause(node string, paused bool) error {
+	sm.mux.Lock()
+	defer sm.mux.Unlock()
+	peer, ok := sm.peers[node]
+	if !ok {
+		return ErrNotFoundNode.Errorf(node)
+	}
+	peer.paused = paused
+	if !paused {
+		sm.start(peer)
+	} else if peer.stop != nil {
+		peer.stop()
+		peer.stop = nil
+	}
+	return nil
+}
+
+// nodeMap returns a copy of the sync node units, which is safe to keep.
+func (sm *syncManager) nodeMap() map[string][]*comm.NodeUnit {
+	sm.mux.Lock()
+	defer sm.mux.Unlock()
+	m := make(map[string][]*comm.NodeUnit, len(sm.nm))
+	for node, units := range sm.nm {
+		m[node] = units
+	}
+	return m
+}
+
+// view returns the state and the sessions of every sync node unit.
+func (sm *syncManager) view() map[string][]SyncUnitView {
+	sm.mux.Lock()
+	defer sm.mux.Unlock()
+	m := make(map[string][]SyncUnitView, len(sm.peers))
+	for node, peer := range sm.peers {
+		list := make([]SyncUnitView, 0, len(peer.units))
+		for i, unit := range peer.units {
+			view := peer.states[i].view(peer.paused)
+			view.Sessions = unit.SessionView()
+			list = append(list, view)
+		}
+		m[node] = list
+	}
+	return m
+}
+
+func (sm *syncManager) syncNode(ctx context.Context, nu *comm.NodeUnit, ss *syncState) {
 	for ctx.Err() == nil {
-		_ = sm.syncNodeOnce(ctx, nu)
-		time.Sleep(1 * time.Second)
+		ss.connecting()
+		err := sm.syncNodeOnce(ctx, nu, ss)
+		if ctx.Err() != nil {
+			return
+		}
+		d := ss.fail(err, sm.backoff)
+		sm.s.logger.Warn("server:", sm.s.nodeName, "sync node:", nu.Node, "broken, retry in", d.Round(time.Millisecond), "err:", err)
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
 	}
 }
 
-func (sm *syncManager) syncNodeOnce(nCtx context.Context, nu *comm.NodeUnit) error {
+func (sm *syncManager) syncNodeOnce(nCtx context.Context, nu *comm.NodeUnit, ss *syncState) error {
 	xCtx := xrpc.SetClientShareStreamClass(nCtx, xrpc.ClientNotShareStream)
 	err := nu.ReverseRpc(xCtx, comm.CallSync, syncInfo{
 		SourceNode: sm.s.nodeName,
 		TargetNode: nu.Node,
 	}, map[string]xrpc.ClientReverseRpcHandler{
 		comm.CallLinkReq: func(ctx xrpc.ClientReverseRpcContext) (any, error) {
+			if sm.s.draining.Load() {
+				return nil, ErrServerDraining
+			}
 			var info comm.LinkRequest
 			err := ctx.Bind(&info)
 			if err != nil {
@@ -75,8 +360,14 @@ func (sm *syncManager) syncNodeOnce(nCtx context.Context, nu *comm.NodeUnit) err
 			if unit, ok := rrpc.(*remoteRouteUnit); ok {
 				binfo.sit[2] = unit.node
 			}
+			binfo.idle = sm.s.getIdleTimeout(rrpc)
+			err = sm.s.traffic.check(binfo.trafficKey())
+			if err != nil {
+				return nil, err
+			}
 
 			box := sm.s.lm.newBox(rrpc.Context(), binfo)
+			sm.s.route.track(rrpc, box.ctx)
 			defer func() {
 				if err != nil {
 					box.doExpired()
@@ -114,7 +405,8 @@ func (sm *syncManager) syncNodeOnce(nCtx context.Context, nu *comm.NodeUnit) err
 			return recv, nil
 		},
 		comm.CallSyncMap: func(context xrpc.ClientReverseRpcContext) (any, error) {
-			return sm.s.route.getLocalMap(), nil
+			ss.success()
+			return sm.s.route.getSyncMap(nu.Node), nil
 		},
 	})
 	return err
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"testing"
+	"time"
+)
+
+func TestSyncBackoff(t *testing.T) {
+	sb := newSyncBackoff(&config.SyncBackoffConfig{Min: 100, Max: 1000, Multiplier: 3})
+	want := []time.Duration{100, 100, 300, 900, 1000, 1000}
+	for i, d := range want {
+		if got := sb.delay(i); got != d*time.Millisecond {
+			t.Fatal("unexpected delay:", i, got)
+		}
+	}
+	sb = newSyncBackoff(nil)
+	for i := 0; i < 100; i++ {
+		d := sb.delay(2)
+		if d < 1600*time.Millisecond || d > 2400*time.Millisecond {
+			t.Fatal("jitter out of range:", d)
+		}
+	}
+}
+
+func TestSyncState(t *testing.T) {
+	sb := newSyncBackoff(&config.SyncBackoffConfig{Min: 100, Max: 1000})
+	ss := &syncState{}
+	ss.connecting()
+	ss.fail(errors.New("refused"), sb)
+	ss.connecting()
+	if d := ss.fail(nil, sb); d != 200*time.Millisecond {
+		t.Fatal("unexpected delay:", d)
+	}
+	view := ss.view(false)
+	if view.State != SyncStateBackoff || view.Failures != 2 || view.LastError != "sync closed" || view.NextRetry.IsZero() {
+		t.Fatal("unexpected view:", view)
+	}
+	ss.connecting()
+	ss.success()
+	if view = ss.view(false); view.State != SyncStateConnected || view.Failures != 0 || view.LastSuccess.IsZero() {
+		t.Fatal("unexpected view:", view)
+	}
+	// a synced connection starts again from the min
+	if d := ss.fail(errors.New("broken"), sb); d != 100*time.Millisecond {
+		t.Fatal("unexpected delay:", d)
+	}
+	if view = ss.view(true); view.State != SyncStatePaused || !view.NextRetry.IsZero() {
+		t.Fatal("unexpected view:", view)
+	}
+}
+
+func TestFilterSync(t *testing.T) {
+	r := (&Server{}).newRoute("n1", 2)
+	route := func(name string, hop int, path ...string) remoteRouteInfo {
+		return remoteRouteInfo{RegisterListenerInfo: comm.RegisterListenerInfo{Name: name}, Hop: hop, Path: path}
+	}
+	m := r.filterSync(map[string][]remoteRouteInfo{
+		"a":    {route("a", 1, "n3", "n2")},
+		"loop": {route("loop", 1, "n1", "n2")},
+		"far":  {route("far", 3, "n5", "n4", "n3", "n2"), route("far", 2, "n4", "n3", "n2")},
+		"old":  {route("old", 0)},
+	})
+	if len(m) != 3 || len(m["a"]) != 1 || len(m["old"]) != 1 {
+		t.Fatal("unexpected routes:", m)
+	}
+	if m["loop"] != nil {
+		t.Fatal("route looping back to its origin kept")
+	}
+	if len(m["far"]) != 1 || m["far"][0].Hop != 2 {
+		t.Fatal("max hop not applied:", m["far"])
+	}
+	if m["old"][0].origin("n2") != "n2" {
+		t.Fatal("unexpected origin of a pathless route")
+	}
+}
+
+func TestSyncAddExists(t *testing.T) {
+	sm := &syncManager{peers: map[string]*syncPeer{"n2": {}}}
+	err := sm.add(config.NodeConfig{NodeName: "n2"})
+	if !errors.Is(err, ErrSyncNodeExists) {
+		t.Fatal("existing sync node added:", err)
+	}
+}
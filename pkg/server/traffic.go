@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const trafficFlushInterval = 1 * time.Second
+
+type trafficKey struct {
+	user    string
+	service string
+	node    string
+}
+
+func (tk trafficKey) each(fn func(kind, name string)) {
+	if tk.user != "" {
+		fn(comm.TrafficUser, tk.user)
+	}
+	if tk.service != "" {
+		fn(comm.TrafficService, tk.service)
+	}
+	if tk.node != "" {
+		fn(comm.TrafficNode, tk.node)
+	}
+}
+
+// trafficCounter counts the bytes of one link or proxy stream without a lock, flush moves them into the stats.
+type trafficCounter struct {
+	tm    *trafficManager
+	key   trafficKey
+	bytes [2]atomic.Int64
+}
+
+func (tc *trafficCounter) add(dir int, n int) {
+	tc.bytes[dir].Add(int64(n))
+}
+
+// close moves the last bytes into the stats and stops counting.
+func (tc *trafficCounter) close() {
+	tc.tm.mux.Lock()
+	defer tc.tm.mux.Unlock()
+	tc.tm.flushOne(tc, time.Now())
+	delete(tc.tm.counters, tc)
+}
+
+type trafficManager struct {
+	s        *Server
+	mux      sync.Mutex
+	view     comm.TrafficView
+	counters map[*trafficCounter]struct{}
+	file     string
+	interval time.Duration
+	quotas   []config.TrafficQuotaConfig
+}
+
+func (s *Server) newTrafficManager(cfg *config.TrafficConfig) (*trafficManager, error) {
+	tm := &trafficManager{
+		s: s,
+		view: comm.TrafficView{
+			User:    make(map[string]*comm.TrafficStat),
+			Service: make(map[string]*comm.TrafficStat),
+			Node:    make(map[string]*comm.TrafficStat),
+		},
+		counters: make(map[*trafficCounter]struct{}),
+		interval: 60 * time.Second,
+	}
+	if cfg == nil {
+		return tm, nil
+	}
+	tm.file = cfg.File
+	tm.quotas = cfg.Quotas
+	if cfg.SaveInterval != 0 {
+		tm.interval = max(time.Duration(cfg.SaveInterval)*time.Millisecond, time.Second)
+	}
+	if tm.file != "" {
+		b, err := os.ReadFile(tm.file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(b) != 0 {
+			err = json.Unmarshal(b, &tm.view)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tm, nil
+}
+
+func (tm *trafficManager) getMap(kind string) map[string]*comm.TrafficStat {
+	var m *map[string]*comm.TrafficStat
+	switch kind {
+	case comm.TrafficUser:
+		m = &tm.view.User
+	case comm.TrafficService:
+		m = &tm.view.Service
+	case comm.TrafficNode:
+		m = &tm.view.Node
+	default:
+		return nil
+	}
+	if *m == nil {
+		*m = make(map[string]*comm.TrafficStat)
+	}
+	return *m
+}
+
+// getStat returns the counter of the name, and rolls the day and month counters over.
+func (tm *trafficManager) getStat(kind, name string, now time.Time) *comm.TrafficStat {
+	m := tm.getMap(kind)
+	stat, ok := m[name]
+	if !ok {
+		stat = &comm.TrafficStat{}
+		m[name] = stat
+	}
+	if day := now.Format(time.DateOnly); stat.Day != day {
+		stat.Day = day
+		stat.DayBytes = 0
+	}
+	if month := now.Format("2006-01"); stat.Month != month {
+		stat.Month = month
+		stat.MonthBytes = 0
+	}
+	return stat
+}
+
+// check returns an error if any counter of the key is over its quota.
+func (tm *trafficManager) check(key trafficKey) (err error) {
+	if len(tm.quotas) == 0 {
+		return nil
+	}
+	tm.mux.Lock()
+	defer tm.mux.Unlock()
+	now := time.Now()
+	tm.flush(now)
+	key.each(func(kind, name string) {
+		if err != nil {
+			return
+		}
+		for _, quota := range tm.quotas {
+			if quota.Kind != kind {
+				continue
+			}
+			if ok, _ := path.Match(quota.Name, name); !ok && quota.Name != "" {
+				continue
+			}
+			stat := tm.getStat(kind, name, now)
+			if (quota.Daily > 0 && stat.DayBytes >= quota.Daily) || (quota.Monthly > 0 && stat.MonthBytes >= quota.Monthly) {
+				err = ErrQuotaExceeded.Errorf(kind, name)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// account counts a new link of the key, and returns the counter of its bytes, which must be closed.
+func (tm *trafficManager) account(key trafficKey) *trafficCounter {
+	tm.mux.Lock()
+	defer tm.mux.Unlock()
+	now := time.Now()
+	key.each(func(kind, name string) {
+		tm.getStat(kind, name, now).Links++
+	})
+	tc := &trafficCounter{tm: tm, key: key}
+	tm.counters[tc] = struct{}{}
+	return tc
+}
+
+// flush moves the bytes of the counters into the stats, the caller holds mux.
+func (tm *trafficManager) flush(now time.Time) {
+	for tc := range tm.counters {
+		tm.flushOne(tc, now)
+	}
+}
+
+func (tm *trafficManager) flushOne(tc *trafficCounter, now time.Time) {
+	up, down := tc.bytes[dirUp].Swap(0), tc.bytes[dirDown].Swap(0)
+	if up == 0 && down == 0 {
+		return
+	}
+	tc.key.each(func(kind, name string) {
+		stat := tm.getStat(kind, name, now)
+		stat.Bytes[dirUp] += up
+		stat.Bytes[dirDown] += down
+		stat.DayBytes += up + down
+		stat.MonthBytes += up + down
+	})
+}
+
+func (tm *trafficManager) getView() *comm.TrafficView {
+	tm.mux.Lock()
+	defer tm.mux.Unlock()
+	tm.flush(time.Now())
+	return &comm.TrafficView{
+		User:    copyTrafficMap(tm.view.User),
+		Service: copyTrafficMap(tm.view.Service),
+		Node:    copyTrafficMap(tm.view.Node),
+	}
+}
+
+func copyTrafficMap(m map[string]*comm.TrafficStat) map[string]*comm.TrafficStat {
+	nm := make(map[string]*comm.TrafficStat, len(m))
+	for name, stat := range m {
+		one := *stat
+		nm[name] = &one
+	}
+	return nm
+}
+
+// reset clears the counters, an empty kind clears all and an empty name clears the whole kind.
+func (tm *trafficManager) reset(kind, name string) error {
+	tm.mux.Lock()
+	defer tm.mux.Unlock()
+	tm.flush(time.Now())
+	if kind == "" {
+		tm.view = comm.TrafficView{}
+		return nil
+	}
+	m := tm.getMap(kind)
+	if m == nil {
+		return ErrInvalidTrafficKind.Errorf(kind)
+	}
+	if name == "" {
+		clear(m)
+	} else {
+		delete(m, name)
+	}
+	return nil
+}
+
+func (tm *trafficManager) save() error {
+	if tm.file == "" {
+		return nil
+	}
+	tm.mux.Lock()
+	tm.flush(time.Now())
+	b, err := json.Marshal(tm.view)
+	tm.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := tm.file + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, tm.file)
+}
+
+// run moves the bytes of the links into the stats every second and saves them at intervals,
+// the returned function stops it and saves them at last.
+func (tm *trafficManager) run(ctx context.Context) context.CancelFunc {
+	ctx, cl := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		go func() {
+			_ = ctxtool.RunTimerFunc(ctx, trafficFlushInterval, func(ctx context.Context) error {
+				tm.mux.Lock()
+				defer tm.mux.Unlock()
+				tm.flush(time.Now())
+				return nil
+			})
+		}()
+		_ = ctxtool.RunTimerFunc(ctx, tm.interval, func(ctx context.Context) error {
+			err := tm.save()
+			if err != nil {
+				tm.s.logger.Warn("server:", tm.s.nodeName, "save traffic err:", err)
+			}
+			return nil
+		})
+	}()
+	return func() {
+		cl()
+		<-done
+		err := tm.save()
+		if err != nil {
+			tm.s.logger.Warn("server:", tm.s.nodeName, "save traffic err:", err)
+		}
+	}
+}
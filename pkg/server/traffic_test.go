@@ -0,0 +1,58 @@
+package server
+
+import (
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrafficManager(t *testing.T) {
+	cfg := &config.TrafficConfig{
+		File:   filepath.Join(t.TempDir(), "traffic.json"),
+		Quotas: []config.TrafficQuotaConfig{{Kind: "user", Name: "u*", Daily: 100}},
+	}
+	var s *Server
+	tm, err := s.newTrafficManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := trafficKey{user: "u1", service: "tl", node: "n1"}
+	if err = tm.check(key); err != nil {
+		t.Fatal(err)
+	}
+	tc := tm.account(key)
+	tc.add(dirUp, 60)
+	tc.add(dirDown, 40)
+	if tm.check(key) == nil {
+		t.Fatal("quota")
+	}
+	tc.add(dirUp, 10)
+	tc.close()
+	tc.add(dirUp, 10) // not counted after close
+	if stat := tm.getView().User["u1"]; stat == nil || stat.Bytes != [2]int64{70, 40} || stat.DayBytes != 110 {
+		t.Fatal("flush", stat)
+	}
+	if err = tm.check(trafficKey{user: "a1", service: "tl"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.save(); err != nil {
+		t.Fatal(err)
+	}
+	tm, err = s.newTrafficManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := tm.getView()
+	if stat := view.Service["tl"]; stat == nil || stat.Bytes != [2]int64{70, 40} || stat.Links != 1 {
+		t.Fatal("load", stat)
+	}
+	if err = tm.reset("user", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.check(key); err != nil {
+		t.Fatal(err)
+	}
+	if tm.reset("bad", "") == nil {
+		t.Fatal("bad kind")
+	}
+}
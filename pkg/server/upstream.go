@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type upstreamRoute struct {
+	rule  egressRule
+	chain []*config.ProxyUpstreamConfig
+	names []string
+}
+
+// upstreamManager chooses the upstream proxies the proxy dials through, the routes are checked in order.
+type upstreamManager struct {
+	routes []upstreamRoute
+}
+
+func newUpstreamManager(upstreams []config.ProxyUpstreamConfig, routes []config.ProxyRouteConfig) (*upstreamManager, error) {
+	m := make(map[string]*config.ProxyUpstreamConfig, len(upstreams))
+	for i := range upstreams {
+		one := &upstreams[i]
+		err := one.Check()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := m[one.Name]; ok {
+			return nil, fmt.Errorf("duplicate proxy upstream name: %s", one.Name)
+		}
+		m[one.Name] = one
+	}
+	um := &upstreamManager{}
+	for _, one := range routes {
+		err := one.Check()
+		if err != nil {
+			return nil, err
+		}
+		route := upstreamRoute{
+			rule:  newEgressRule(one.Users, one.Network, one.CIDR, one.Ports, one.Domains),
+			names: one.Chain,
+		}
+		for _, name := range one.Chain {
+			up, ok := m[name]
+			if !ok {
+				return nil, fmt.Errorf("not found proxy upstream: %s", name)
+			}
+			route.chain = append(route.chain, up)
+		}
+		um.routes = append(um.routes, route)
+	}
+	return um, nil
+}
+
+func (um *upstreamManager) empty() bool {
+	return len(um.routes) == 0
+}
+
+// route returns the upstream chain of the target, nil is direct.
+func (um *upstreamManager) route(user, network, host string, ip net.IP, port uint16) *upstreamRoute {
+	for i := range um.routes {
+		if um.routes[i].rule.match(user, network, host, ip, port) {
+			if len(um.routes[i].chain) == 0 {
+				return nil
+			}
+			return &um.routes[i]
+		}
+	}
+	return nil
+}
+
+// dial connects to the first upstream and asks each upstream to connect to the next one, and the last to address.
+func (ur *upstreamRoute) dial(ctx context.Context, network string, address string) (conn net.Conn, err error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("proxy upstream not support network: %s", network)
+	}
+	dr := new(net.Dialer)
+	conn, err = dr.DialContext(ctx, "tcp", ur.chain[0].Address)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer func() {
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			_ = conn.Close()
+			conn = nil
+		}
+	}()
+	for i, up := range ur.chain {
+		target := address
+		if i+1 < len(ur.chain) {
+			target = ur.chain[i+1].Address
+		}
+		switch up.Type {
+		case config.UpstreamSocks5:
+			err = socks5Connect(conn, up.Auth, target)
+		case config.UpstreamHttp:
+			conn, err = httpConnect(conn, up.Auth, target)
+		default:
+			err = fmt.Errorf("invalid proxy upstream type: %s", up.Type)
+		}
+		if err != nil {
+			return conn, fmt.Errorf("proxy upstream %s: %w", up.Name, err)
+		}
+	}
+	return conn, nil
+}
+
+func socks5Connect(conn net.Conn, auth *config.AuthInfo, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+	methods := []byte{0x00}
+	if auth != nil {
+		methods = append(methods, 0x02)
+	}
+	_, err = conn.Write(append([]byte{0x05, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	var resp [2]byte
+	_, err = io.ReadFull(conn, resp[:])
+	if err != nil {
+		return err
+	}
+	if resp[0] != 0x05 {
+		return errors.New("invalid socks5 version")
+	}
+	switch resp[1] {
+	case 0x00:
+	case 0x02:
+		if auth == nil || len(auth.UserName) > 255 || len(auth.Password) > 255 {
+			return errors.New("socks5 auth required")
+		}
+		req := []byte{0x01, byte(len(auth.UserName))}
+		req = append(req, auth.UserName...)
+		req = append(req, byte(len(auth.Password)))
+		req = append(req, auth.Password...)
+		_, err = conn.Write(req)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, resp[:])
+		if err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return errors.New("socks5 auth failed")
+		}
+	default:
+		return errors.New("socks5 no acceptable auth method")
+	}
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, 0x01), ip4...)
+		} else {
+			req = append(append(req, 0x04), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("socks5 host too long")
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+	var head [4]byte
+	_, err = io.ReadFull(conn, head[:])
+	if err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("socks5 connect failed: %d", head[1])
+	}
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		var l [1]byte
+		_, err = io.ReadFull(conn, l[:])
+		if err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return errors.New("invalid socks5 address type")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func httpConnect(conn net.Conn, auth *config.AuthInfo, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if auth != nil {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth.UserName+":"+auth.Password)))
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	// the body of a CONNECT response is the tunnel itself, do not read or close it
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("http connect failed: %s", resp.Status)
+	}
+	if br.Buffered() == 0 {
+		return conn, nil
+	}
+	// the target may speak first, keep what was read with the response
+	return &bufConn{Conn: conn, r: br}, nil
+}
+
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testListen(t *testing.T, fn func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fn(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func testPipe(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	go io.Copy(a, b)
+	_, _ = io.Copy(b, a)
+}
+
+// testSocks5 serves socks5 connect with username/password auth.
+func testSocks5(user, password string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, head[1])); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{0x05, 0x02})
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return
+		}
+		u := make([]byte, head[1])
+		_, _ = io.ReadFull(conn, u)
+		l := make([]byte, 1)
+		_, _ = io.ReadFull(conn, l)
+		p := make([]byte, l[0])
+		_, _ = io.ReadFull(conn, p)
+		if string(u) != user || string(p) != password {
+			_, _ = conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		_, _ = conn.Write([]byte{0x01, 0x00})
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		var host string
+		switch req[3] {
+		case 0x01:
+			ip := make([]byte, 4)
+			_, _ = io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 0x03:
+			_, _ = io.ReadFull(conn, l)
+			name := make([]byte, l[0])
+			_, _ = io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			return
+		}
+		port := make([]byte, 2)
+		_, _ = io.ReadFull(conn, port)
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+		if err != nil {
+			_, _ = conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		testPipe(conn, target)
+	}
+}
+
+// testHttpConnect serves http connect with basic auth.
+func testHttpConnect(user, password string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		r := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+		if u, p, ok := r.BasicAuth(); !ok || u != user || p != password {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		testPipe(conn, target)
+	}
+}
+
+func TestUpstreamChain(t *testing.T) {
+	// the target speaks first
+	target := testListen(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = conn.Write([]byte("hello"))
+		_, _ = io.Copy(conn, conn)
+	})
+	socks := testListen(t, testSocks5("su", "sp"))
+	httpProxy := testListen(t, testHttpConnect("hu", "hp"))
+	um, err := newUpstreamManager([]config.ProxyUpstreamConfig{
+		{Name: "s", Type: config.UpstreamSocks5, Address: socks, Auth: &config.AuthInfo{UserName: "su", Password: "sp"}},
+		{Name: "h", Type: config.UpstreamHttp, Address: httpProxy, Auth: &config.AuthInfo{UserName: "hu", Password: "hp"}},
+		{Name: "bad", Type: config.UpstreamSocks5, Address: socks, Auth: &config.AuthInfo{UserName: "su", Password: "x"}},
+	}, []config.ProxyRouteConfig{
+		{Chain: nil, CIDR: []string{"10.0.0.0/8"}},
+		{Chain: []string{"bad"}, Users: []string{"mallory"}},
+		{Chain: []string{"h", "s"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if um.route("", "tcp", "10.1.1.1", net.ParseIP("10.1.1.1"), 80) != nil {
+		t.Fatal("direct route has chain")
+	}
+	route := um.route("", "tcp", "localhost", nil, 80)
+	if route == nil || len(route.names) != 2 {
+		t.Fatal("chain not matched")
+	}
+	ctx, cl := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cl()
+	conn, err := route.dial(ctx, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatal("read greeting", err)
+	}
+	_, _ = conn.Write([]byte("ping"))
+	buf = buf[:4]
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Fatal("echo", err)
+	}
+	if _, err = route.dial(ctx, "udp", target); err == nil {
+		t.Fatal("udp through upstream")
+	}
+	bad := um.route("mallory", "tcp", "localhost", nil, 80)
+	if _, err = bad.dial(ctx, "tcp", target); err == nil {
+		t.Fatal("bad auth passed")
+	}
+	_, err = newUpstreamManager(nil, []config.ProxyRouteConfig{{Chain: []string{"none"}}})
+	if err == nil {
+		t.Fatal("unknown upstream accepted")
+	}
+}
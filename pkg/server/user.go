@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"github.com/peakedshout/go-pandorasbox/tool/hyaml"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const argon2idPrefix = "$argon2id$"
+
+// HashPassword makes a bcrypt hash of password for the server users config.
+func HashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// HashPasswordArgon2id makes an argon2id hash of password in the PHC string format.
+func HashPasswordArgon2id(password string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	var m, t uint32 = 64 * 1024, 3
+	var p uint8 = 4
+	key := argon2.IDKey([]byte(password), salt, t, m, p, 32)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, m, t, p,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func verifyPassword(hash, password string) error {
+	if !strings.HasPrefix(hash, argon2idPrefix) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	}
+	sl := strings.Split(hash, "$")
+	if len(sl) != 6 {
+		return errors.New("invalid argon2id hash")
+	}
+	var v int
+	_, err := fmt.Sscanf(sl[2], "v=%d", &v)
+	if err != nil || v != argon2.Version {
+		return errors.New("invalid argon2id version")
+	}
+	var m, t uint32
+	var p uint8
+	_, err = fmt.Sscanf(sl[3], "m=%d,t=%d,p=%d", &m, &t, &p)
+	if err != nil {
+		return errors.New("invalid argon2id params")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(sl[4])
+	if err != nil {
+		return err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(sl[5])
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(argon2.IDKey([]byte(password), salt, t, m, p, uint32(len(key))), key) != 1 {
+		return errors.New("password mismatch")
+	}
+	return nil
+}
+
+type userManager struct {
+	mux   sync.RWMutex
+	users []config.UserConfig
+	file  string
+	m     map[string]config.UserConfig
+}
+
+func newUserManager(users []config.UserConfig, file string) (*userManager, error) {
+	um := &userManager{
+		users: users,
+		file:  file,
+	}
+	err := um.reload()
+	if err != nil {
+		return nil, err
+	}
+	return um, nil
+}
+
+func (um *userManager) enable() bool {
+	return len(um.users) != 0 || um.file != ""
+}
+
+// reload rebuilds the user table from the config and the users file,
+// the old table stays in use if the file is invalid or a username is repeated.
+func (um *userManager) reload() error {
+	list := um.users
+	if um.file != "" {
+		b, err := os.ReadFile(um.file)
+		if err != nil {
+			return err
+		}
+		var fl []config.UserConfig
+		err = hyaml.Unmarshal(b, &fl)
+		if err != nil {
+			return err
+		}
+		list = append(append([]config.UserConfig{}, list...), fl...)
+	}
+	m := make(map[string]config.UserConfig, len(list))
+	var errs []error
+	for _, one := range list {
+		errs = append(errs, one.Check())
+		if _, ok := m[one.UserName]; ok {
+			errs = append(errs, ErrDuplicateUser.Errorf(one.UserName))
+			continue
+		}
+		m[one.UserName] = one
+	}
+	err := errors.Join(errs...)
+	if err != nil {
+		return err
+	}
+	um.mux.Lock()
+	defer um.mux.Unlock()
+	um.m = m
+	return nil
+}
+
+func (um *userManager) getRoles(user string) ([]string, bool) {
+	um.mux.RLock()
+	defer um.mux.RUnlock()
+	uc, ok := um.m[user]
+	if !ok {
+		return nil, false
+	}
+	return uc.Roles, true
+}
+
+func (um *userManager) verify(user, password string) error {
+	um.mux.RLock()
+	uc, ok := um.m[user]
+	um.mux.RUnlock()
+	if !ok || uc.Disable || uc.Expired(time.Now()) {
+		return ErrNodeAuthFailed
+	}
+	if verifyPassword(uc.Password, password) != nil {
+		return ErrNodeAuthFailed
+	}
+	return nil
+}
+
+// ReloadUsers reloads the users file without restarting the server,
+// sessions that already passed the auth are kept.
+func (s *Server) ReloadUsers() error {
+	err := s.users.reload()
+	if err != nil {
+		s.logger.Warn("server:", s.nodeName, "reload users err:", err)
+		return err
+	}
+	s.logger.Info("server:", s.nodeName, "reload users")
+	return nil
+}
+
+// defaultRoles returns the roles of the node auth user, which the sessions without a username and the sync peers of
+// old configs use too. Empty roles are all, so adding users does not cut off the existing clients and federations.
+func defaultRoles(roles []string) []string {
+	if len(roles) == 0 {
+		return []string{config.RoleAll}
+	}
+	return roles
+}
+
+// allow checks whether the session principal owns the role, a principal that is neither in the users nor the node
+// auth user has none.
+func (s *Server) allow(ctx context.Context, role string) error {
+	user := s.getUser(ctx)
+	roles, ok := s.users.getRoles(user)
+	if !ok && user == s.user {
+		roles = s.roles
+	}
+	if slices.Contains(roles, config.RoleAll) || slices.Contains(roles, role) {
+		return nil
+	}
+	s.logger.Warn("server:", s.nodeName, "deny", role, "user:", user)
+	return ErrPermissionDenied.Errorf(role)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"github.com/peakedshout/anchorage-core/pkg/comm"
+	"github.com/peakedshout/anchorage-core/pkg/config"
+	"github.com/peakedshout/go-pandorasbox/logger"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserManager(t *testing.T) {
+	h1, err := HashPassword("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := HashPasswordArgon2id("p2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	um, err := newUserManager([]config.UserConfig{
+		{UserName: "u1", Password: h1},
+		{UserName: "u2", Password: h2},
+		{UserName: "u3", Password: h1, Disable: true},
+		{UserName: "u4", Password: h1, ExpireAt: time.Now().Add(-time.Hour).Format(time.RFC3339)},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if um.verify("u1", "p1") != nil || um.verify("u2", "p2") != nil {
+		t.Fatal("verify failed")
+	}
+	if um.verify("u1", "p2") == nil || um.verify("u2", "p1") == nil {
+		t.Fatal("wrong password")
+	}
+	if um.verify("u3", "p1") == nil || um.verify("u4", "p1") == nil || um.verify("u5", "p1") == nil {
+		t.Fatal("disable or expired user")
+	}
+	_, err = newUserManager([]config.UserConfig{
+		{UserName: "u1", Password: h1},
+		{UserName: "u1", Password: h2},
+	}, "")
+	if err == nil || !strings.Contains(err.Error(), "u1") {
+		t.Fatal("duplicate user accepted:", err)
+	}
+}
+
+func TestAllowRoles(t *testing.T) {
+	h, err := HashPassword("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	um, err := newUserManager([]config.UserConfig{
+		{UserName: "admin", Password: h, Roles: []string{config.RoleAll}},
+		{UserName: "viewer", Password: h, Roles: []string{config.RoleView}},
+		{UserName: "none", Password: h},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{auth: true, user: "node", users: um, roles: defaultRoles(nil), logger: logger.MustLogger(context.Background())}
+	allow := func(user, role string) bool {
+		ctx, err := xrpc.SetSessionAuthInfoT[string](context.Background(), comm.UserName, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.allow(ctx, role) == nil
+	}
+	if !allow("admin", config.RoleSync) || !allow("viewer", config.RoleView) {
+		t.Fatal("granted role denied")
+	}
+	if allow("viewer", config.RoleLink) || allow("none", config.RoleView) {
+		t.Fatal("role of empty or other roles allowed")
+	}
+	if allow("unknown", config.RoleLink) {
+		t.Fatal("unknown user allowed on a server with users")
+	}
+	// the node auth user keeps every role with users added
+	if !allow("node", config.RoleSync) || !allow("", config.RoleLink) {
+		t.Fatal("node auth user denied")
+	}
+	s.roles = defaultRoles([]string{config.RoleView})
+	if allow("node", config.RoleSync) || !allow("node", config.RoleView) {
+		t.Fatal("default roles not applied")
+	}
+	if roles := defaultRoles(nil); !slices.Equal(roles, []string{config.RoleAll}) {
+		t.Fatal("empty default roles closed:", roles)
+	}
+}
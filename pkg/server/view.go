@@ -5,6 +5,7 @@ import (
 	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
 	"github.com/peakedshout/go-pandorasbox/xrpc"
 	"sort"
+	"time"
 )
 
 func (s *Server) GetLinkView() []comm.LinkView {
@@ -23,8 +24,15 @@ func (s *Server) GetLinkView() []comm.LinkView {
 			LinkId:          box.info.lid,
 			LinkList:        box.info.lList,
 			NodeList:        box.info.nList,
+			User:            box.info.user,
+			Rate:            box.limit.rate(),
+			RateLimit:       box.limit.limit,
+			CloseReason:     box.info.closeReason,
+			P2P:             box.info.p2p,
 		}
-		if box.p1 == nil || box.p2 == nil {
+		if box.info.closeReason != "" {
+			lv.Status = comm.LinkStatusDead
+		} else if box.p1 == nil || box.p2 == nil {
 			lv.Status = comm.LinkStatusWait
 		} else if !box.info.initialized {
 			lv.Status = comm.LinkStatusInit
@@ -51,23 +59,31 @@ func (s *Server) GetServerSessionView() []xrpc.SessionView {
 	return s.server.SessionView()
 }
 
-func (s *Server) GetSyncView() map[string][]xrpc.SessionView {
-	m := make(map[string][]xrpc.SessionView)
-	for node, units := range s.sm.nm {
-		for _, unit := range units {
-			m[node] = append(m[node], unit.SessionView()...)
-		}
-	}
+// SyncUnitView is one connection to a sync node, a node has a unit for each of its addresses.
+type SyncUnitView struct {
+	State       string // connecting, connected, backoff or paused
+	LastError   string
+	LastSuccess time.Time // last route sync through the connection
+	Failures    int       // consecutive failures, reset by a sync
+	NextRetry   time.Time // zero is not waiting
+	Sessions    []xrpc.SessionView
+}
+
+func (s *Server) GetSyncView() map[string][]SyncUnitView {
+	m := s.sm.view()
 	for _, list := range m {
-		sort.SliceStable(list, func(i, j int) bool {
-			return list[i].MonitorInfo.CreateTime.Before(list[j].MonitorInfo.CreateTime)
-		})
+		for _, unit := range list {
+			sort.SliceStable(unit.Sessions, func(i, j int) bool {
+				return unit.Sessions[i].MonitorInfo.CreateTime.Before(unit.Sessions[j].MonitorInfo.CreateTime)
+			})
+		}
 	}
 	return m
 }
 
 type ProxyUnitView struct {
 	xrpc.StreamView
+	User          string
 	Nodes         []string
 	Node          string
 	FromNetwork   string
@@ -76,8 +92,32 @@ type ProxyUnitView struct {
 	ToAddress     string
 	TargetNetwork string
 	TargetAddress string
+	Chain         []string // upstream proxies dialed through, empty is direct
+	ResolveDelay  time.Duration
+	Rate          [2]int64 // byte/s of upload and download
+	RateLimit     [2]int64 // 0 is unlimited
+	CloseReason   string
 }
 
-func (s *Server) GetProxyView() map[string][]ProxyUnitView {
+type ProxyView struct {
+	Units       map[string][]ProxyUnitView
+	Denied      int64
+	DeniedUsers map[string]int64
+}
+
+func (s *Server) GetProxyView() *ProxyView {
 	return s.proxy.View()
 }
+
+func (s *Server) GetTrafficView() *comm.TrafficView {
+	return s.traffic.getView()
+}
+
+func (s *Server) ResetTraffic(kind, name string) error {
+	err := s.traffic.reset(kind, name)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("server:", s.nodeName, "reset traffic", kind, name)
+	return nil
+}